@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type APIKeyServiceProvider interface {
+	Create(context.Context, *APIKey, bool) error
+	List(context.Context) ([]APIKey, error)
+	Revoke(context.Context, uint) error
+}
+
+type APIKeyController struct {
+	apiKeyService APIKeyServiceProvider
+}
+
+func (h *APIKeyController) CreateKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	var k APIKey
+	if err := req.Bind(c, &k); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	if err := h.apiKeyService.Create(c.Request().Context(), &k, req.Signing); err != nil {
+		return internalError(c, err)
+	}
+	requestLogger(c).Info().Uint("created_api_key_id", k.ID).Strs("scopes", k.Scopes).Msg("api key created")
+
+	// The key and its signing secret are only ever revealed when it's created.
+	return c.JSON(http.StatusCreated, k)
+}
+
+func (h *APIKeyController) ListKeys(c echo.Context) error {
+	keys, err := h.apiKeyService.List(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	for i := range keys {
+		keys[i].SigningSecret = nil
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (h *APIKeyController) RevokeKey(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	if err := h.apiKeyService.Revoke(c.Request().Context(), id); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+	requestLogger(c).Info().Uint("revoked_api_key_id", id).Msg("api key revoked")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *APIKeyController) Register(r *echo.Group) {
+	r.POST("", h.CreateKey, RequireScope(ScopeAdmin))
+	r.GET("", h.ListKeys, RequireScope(ScopeAdmin))
+	r.DELETE("/:id", h.RevokeKey, RequireScope(ScopeAdmin))
+}
+
+func NewAPIKeyController(s APIKeyServiceProvider) *APIKeyController {
+	return &APIKeyController{
+		apiKeyService: s,
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const apiKeyPrefixLength = len("wsk_") + 8
+
+type APIKeyStorer interface {
+	BeginTx(context.Context) (TxExecutor, error)
+	Create(context.Context, *APIKey, TxExecutor) error
+	List(context.Context) ([]APIKey, error)
+	GetActiveByHash(context.Context, string) (*APIKey, error)
+	GetActiveByID(context.Context, uint) (*APIKey, error)
+	LockAndGetByID(context.Context, uint, TxExecutor) (*APIKey, error)
+	Revoke(context.Context, *APIKey, TxExecutor) error
+	CreateAuditEvent(context.Context, *AuditEvent, TxExecutor) error
+}
+
+// APIKeyService manages the keys clients authenticate with. Only their
+// SHA-256 hashes are stored: the keys are random enough that a slow hash
+// wouldn't make them any harder to guess.
+type APIKeyService struct {
+	store APIKeyStorer
+}
+
+// Create creates the key. Keys created for `signing` also get a secret to
+// sign requests with.
+func (s *APIKeyService) Create(ctx context.Context, k *APIKey, signing bool) error {
+	key, err := newAPIKey()
+	if err != nil {
+		return err
+	}
+	k.Key = key
+	k.Prefix = key[:apiKeyPrefixLength]
+	k.KeyHash = hashAPIKey(key)
+
+	if signing {
+		secret, err := newSigningSecret()
+		if err != nil {
+			return err
+		}
+		k.SigningSecret = &secret
+	}
+
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.Create(ctx, k, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditAPIKeyCreated, nil, k); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *APIKeyService) List(ctx context.Context) ([]APIKey, error) {
+	return s.store.List(ctx)
+}
+
+// Revoke stops the key from authenticating any more requests. Revoking a
+// revoked key is a no-op.
+func (s *APIKeyService) Revoke(ctx context.Context, id uint) error {
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	k, err := s.store.LockAndGetByID(ctx, id, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ErrNotFound{Inner: err}
+		}
+		return err
+	}
+	if k.RevokedAt != nil {
+		return tx.Commit()
+	}
+
+	before := *k
+	if err := s.store.Revoke(ctx, k, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditAPIKeyRevoked, &before, k); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// audit records the change of the key from `before` to `after` within `tx`.
+// The key and its signing secret are left out.
+func (s *APIKeyService) audit(ctx context.Context, tx TxExecutor, action string, before, after *APIKey) error {
+	var b interface{}
+	if before != nil {
+		redacted := *before
+		redacted.Key, redacted.SigningSecret = "", nil
+		b = &redacted
+	}
+	redacted := *after
+	redacted.Key, redacted.SigningSecret = "", nil
+
+	ev, err := NewAuditEvent(ctx, action, "api_key", after.ID, b, &redacted, "")
+	if err != nil {
+		return err
+	}
+	return s.store.CreateAuditEvent(ctx, ev, tx)
+}
+
+// Authenticate returns the key, as long as it exists and wasn't revoked.
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	k, err := s.store.GetActiveByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrInvalidAPIKey{}
+		}
+		return nil, err
+	}
+	return k, nil
+}
+
+// GetSigningKey returns the key, as long as it exists, wasn't revoked, and
+// can sign requests.
+func (s *APIKeyService) GetSigningKey(ctx context.Context, id uint) (*APIKey, error) {
+	k, err := s.store.GetActiveByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrInvalidAPIKey{}
+		}
+		return nil, err
+	}
+	if k.SigningSecret == nil {
+		return nil, &ErrInvalidAPIKey{}
+	}
+	return k, nil
+}
+
+func NewAPIKeyService(store APIKeyStorer) *APIKeyService {
+	return &APIKeyService{
+		store: store,
+	}
+}
+
+type ErrInvalidAPIKey struct {
+}
+
+func (e *ErrInvalidAPIKey) Error() string {
+	return "Invalid API key"
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "wsk_" + hex.EncodeToString(b), nil
+}
+
+func newSigningSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "wss_" + hex.EncodeToString(b), nil
+}
+
+const apiKeysUsage = `usage: api-keys create [--signing] <name> <scope>...
+
+scopes: wallets:read, wallets:write, balance:credit, balance:debit, admin`
+
+// RunAPIKeys runs the `api-keys` subcommand described by `args`, which creates
+// keys without going through the API, e.g. the first admin key.
+func RunAPIKeys(ctx context.Context, s *APIKeyService, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "create" {
+		return errors.New(apiKeysUsage)
+	}
+
+	fs := flag.NewFlagSet("api-keys create", flag.ContinueOnError)
+	signing := fs.Bool("signing", false, "also create a secret to sign requests with")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New(apiKeysUsage)
+	}
+
+	req := CreateAPIKeyRequest{Name: fs.Arg(0), Scopes: fs.Args()[1:]}
+	if err := req.Validate(); err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+
+	k := APIKey{Name: req.Name, Scopes: req.Scopes}
+	if err := s.Create(ctx, &k, *signing); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created key %d (%s): %s\n", k.ID, strings.Join(k.Scopes, ", "), k.Key)
+	if k.SigningSecret != nil {
+		fmt.Fprintf(out, "signing secret: %s\n", *k.SigningSecret)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyAPIKeyStore struct {
+	Keys        []APIKey
+	AuditEvents []*AuditEvent
+}
+
+func (s *DummyAPIKeyStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	return &DummyTx{}, nil
+}
+
+func (s *DummyAPIKeyStore) Create(ctx context.Context, k *APIKey, tx TxExecutor) error {
+	k.ID = uint(len(s.Keys) + 1)
+	s.Keys = append(s.Keys, *k)
+	return nil
+}
+
+func (s *DummyAPIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	return s.Keys, nil
+}
+
+func (s *DummyAPIKeyStore) GetActiveByHash(ctx context.Context, hash string) (*APIKey, error) {
+	for i := range s.Keys {
+		if s.Keys[i].KeyHash == hash && s.Keys[i].RevokedAt == nil {
+			return &s.Keys[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *DummyAPIKeyStore) GetActiveByID(ctx context.Context, id uint) (*APIKey, error) {
+	for i := range s.Keys {
+		if s.Keys[i].ID == id && s.Keys[i].RevokedAt == nil {
+			return &s.Keys[i], nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *DummyAPIKeyStore) LockAndGetByID(ctx context.Context, id uint, tx TxExecutor) (*APIKey, error) {
+	for i := range s.Keys {
+		if s.Keys[i].ID == id {
+			k := s.Keys[i]
+			return &k, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *DummyAPIKeyStore) Revoke(ctx context.Context, k *APIKey, tx TxExecutor) error {
+	now := time.Now()
+	k.RevokedAt = &now
+	s.Keys[k.ID-1].RevokedAt = &now
+	return nil
+}
+
+func (s *DummyAPIKeyStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	s.AuditEvents = append(s.AuditEvents, ev)
+	return nil
+}
+
+func TestAPIKeyService(t *testing.T) {
+	t.Run("creates keys, storing only their hash", func(t *testing.T) {
+		store := DummyAPIKeyStore{}
+		service := NewAPIKeyService(&store)
+
+		k := APIKey{Name: "ledger", Scopes: []string{ScopeWalletsRead}}
+		assert.NoError(t, service.Create(context.Background(), &k, false))
+		assert.True(t, strings.HasPrefix(k.Key, "wsk_"))
+		assert.Len(t, k.Key, len("wsk_")+64)
+		assert.Equal(t, k.Key[:12], k.Prefix)
+		assert.NotContains(t, store.Keys[0].KeyHash, k.Key)
+		assert.Equal(t, hashAPIKey(k.Key), store.Keys[0].KeyHash)
+		assert.Nil(t, k.SigningSecret)
+	})
+
+	t.Run("audits keys being created and revoked, without revealing them", func(t *testing.T) {
+		store := DummyAPIKeyStore{}
+		service := NewAPIKeyService(&store)
+
+		k := APIKey{Name: "ledger", Scopes: []string{ScopeWalletsRead}}
+		assert.NoError(t, service.Create(context.Background(), &k, true))
+		assert.NoError(t, service.Revoke(context.Background(), k.ID))
+		assert.NoError(t, service.Revoke(context.Background(), k.ID))
+
+		if assert.Len(t, store.AuditEvents, 2) {
+			assert.Equal(t, AuditAPIKeyCreated, store.AuditEvents[0].Action)
+			assert.NotContains(t, string(store.AuditEvents[0].Diff), k.Key)
+			assert.NotContains(t, string(store.AuditEvents[0].Diff), *k.SigningSecret)
+			assert.NotContains(t, string(store.AuditEvents[0].Diff), k.KeyHash)
+			assert.Equal(t, AuditAPIKeyRevoked, store.AuditEvents[1].Action)
+			assert.Contains(t, string(store.AuditEvents[1].Diff), "revoked_at")
+		}
+	})
+
+	t.Run("creates keys that can sign requests", func(t *testing.T) {
+		service := NewAPIKeyService(&DummyAPIKeyStore{})
+		k := APIKey{Name: "ledger", Scopes: []string{ScopeWalletsRead}}
+		assert.NoError(t, service.Create(context.Background(), &k, true))
+		if assert.NotNil(t, k.SigningSecret) {
+			assert.True(t, strings.HasPrefix(*k.SigningSecret, "wss_"))
+		}
+
+		signing, err := service.GetSigningKey(context.Background(), k.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, k.SigningSecret, signing.SigningSecret)
+
+		assert.NoError(t, service.Revoke(context.Background(), k.ID))
+		_, err = service.GetSigningKey(context.Background(), k.ID)
+		var errKey *ErrInvalidAPIKey
+		assert.True(t, errors.As(err, &errKey))
+	})
+
+	t.Run("fails: signing with a key without a secret", func(t *testing.T) {
+		service := NewAPIKeyService(&DummyAPIKeyStore{})
+		k := APIKey{Name: "ledger", Scopes: []string{ScopeWalletsRead}}
+		assert.NoError(t, service.Create(context.Background(), &k, false))
+
+		for _, id := range []uint{k.ID, 42} {
+			_, err := service.GetSigningKey(context.Background(), id)
+			var errKey *ErrInvalidAPIKey
+			assert.True(t, errors.As(err, &errKey), id)
+		}
+	})
+
+	t.Run("authenticates keys until they're revoked", func(t *testing.T) {
+		service := NewAPIKeyService(&DummyAPIKeyStore{})
+		k := APIKey{Name: "ledger", Scopes: []string{ScopeWalletsRead}}
+		assert.NoError(t, service.Create(context.Background(), &k, false))
+
+		authenticated, err := service.Authenticate(context.Background(), k.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, k.ID, authenticated.ID)
+
+		assert.NoError(t, service.Revoke(context.Background(), k.ID))
+		_, err = service.Authenticate(context.Background(), k.Key)
+		var errKey *ErrInvalidAPIKey
+		assert.True(t, errors.As(err, &errKey))
+	})
+
+	t.Run("fails: unknown key", func(t *testing.T) {
+		service := NewAPIKeyService(&DummyAPIKeyStore{})
+		_, err := service.Authenticate(context.Background(), "wsk_unknown")
+		var errKey *ErrInvalidAPIKey
+		assert.True(t, errors.As(err, &errKey))
+
+		err = service.Revoke(context.Background(), 1)
+		var err404 *ErrNotFound
+		assert.True(t, errors.As(err, &err404))
+	})
+}
+
+func TestRunAPIKeys(t *testing.T) {
+	t.Run("creates a key", func(t *testing.T) {
+		store := DummyAPIKeyStore{}
+		var out bytes.Buffer
+		err := RunAPIKeys(context.Background(), NewAPIKeyService(&store), []string{"create", "ops", "admin"}, &out)
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), "created key 1 (admin): wsk_")
+		assert.Equal(t, "ops", store.Keys[0].Name)
+		assert.NotContains(t, out.String(), "signing secret")
+	})
+
+	t.Run("creates a key that can sign requests", func(t *testing.T) {
+		store := DummyAPIKeyStore{}
+		var out bytes.Buffer
+		err := RunAPIKeys(context.Background(), NewAPIKeyService(&store), []string{"create", "--signing", "ledger", "wallets:read"}, &out)
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), "signing secret: wss_")
+		assert.Equal(t, "ledger", store.Keys[0].Name)
+	})
+
+	t.Run("fails: usage or unknown scope", func(t *testing.T) {
+		for _, args := range [][]string{{}, {"create", "ops"}, {"delete", "1"}, {"create", "ops", "root"}, {"create", "--signing", "ops"}} {
+			err := RunAPIKeys(context.Background(), NewAPIKeyService(&DummyAPIKeyStore{}), args, &bytes.Buffer{})
+			assert.Error(t, err, args)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+)
+
+type APIKeyStore struct {
+	db DbExecutor
+}
+
+func (s *APIKeyStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	span := startStoreSpan(ctx, "APIKeyStore.BeginTx", "begin")
+	defer span.End()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, failSpan(span, err)
+	}
+	return tx, nil
+}
+
+func (s *APIKeyStore) Create(ctx context.Context, k *APIKey, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "APIKeyStore.Create", "insert_api_key")
+	defer span.End()
+
+	stmt, err := tx.PrepareNamed(`INSERT INTO api_keys
+		(name, prefix, key_hash, scopes, signing_secret)
+		VALUES (:name,:prefix,:key_hash,:scopes,:signing_secret)
+		RETURNING id, created_at`,
+	)
+	if err != nil {
+		return failSpan(span, err)
+	}
+
+	if err := stmt.Get(k, k); err != nil {
+		return failSpan(span, err)
+	}
+
+	return nil
+}
+
+func (s *APIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	span := startStoreSpan(ctx, "APIKeyStore.List", "select_api_keys")
+	defer span.End()
+
+	keys := []APIKey{}
+	stm := `SELECT * FROM api_keys ORDER BY id`
+	if err := s.db.Select(&keys, stm); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	return keys, nil
+}
+
+func (s *APIKeyStore) GetActiveByHash(ctx context.Context, hash string) (*APIKey, error) {
+	span := startStoreSpan(ctx, "APIKeyStore.GetActiveByHash", "select_api_key")
+	defer span.End()
+
+	var k APIKey
+	stm := `SELECT * FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL`
+	if err := s.db.Get(&k, stm, hash); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	return &k, nil
+}
+
+func (s *APIKeyStore) GetActiveByID(ctx context.Context, id uint) (*APIKey, error) {
+	span := startStoreSpan(ctx, "APIKeyStore.GetActiveByID", "select_api_key")
+	defer span.End()
+
+	var k APIKey
+	stm := `SELECT * FROM api_keys WHERE id=$1 AND revoked_at IS NULL`
+	if err := s.db.Get(&k, stm, id); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	return &k, nil
+}
+
+func (s *APIKeyStore) LockAndGetByID(ctx context.Context, id uint, tx TxExecutor) (*APIKey, error) {
+	span := startStoreSpan(ctx, "APIKeyStore.LockAndGetByID", "select_api_key_for_update")
+	defer span.End()
+
+	var k APIKey
+	stm := `SELECT * FROM api_keys WHERE id=$1 FOR UPDATE`
+	if err := tx.Get(&k, stm, id); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	return &k, nil
+}
+
+// Revoke revokes the key, unless it already was.
+func (s *APIKeyStore) Revoke(ctx context.Context, k *APIKey, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "APIKeyStore.Revoke", "revoke_api_key")
+	defer span.End()
+
+	stm := `UPDATE api_keys
+		SET revoked_at = COALESCE(revoked_at, current_timestamp)
+		WHERE id=$1
+		RETURNING revoked_at`
+	if err := tx.Get(&k.RevokedAt, stm, k.ID); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func (s *APIKeyStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "APIKeyStore.CreateAuditEvent", "insert_audit_event")
+	defer span.End()
+
+	if err := insertAuditEvent(tx, ev); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func NewAPIKeyStore(db DbExecutor) *APIKeyStore {
+	return &APIKeyStore{
+		db: db,
+	}
+}
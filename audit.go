@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequestInfo is what audit events record about the request that raised them.
+type RequestInfo struct {
+	ID       string
+	SourceIP string
+}
+
+type requestInfoContextKey struct{}
+
+func ContextWithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey{}, info)
+}
+
+// RequestInfoFromContext returns the request being served, or nil outside of
+// a request.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*RequestInfo)
+	return info
+}
+
+// NewIPExtractor tells the source IP of requests. It's the IP of the
+// connection, unless it comes from one of the `trustedProxies`, which report
+// the client's through X-Forwarded-For. Clients could otherwise forge the IP
+// recorded in the audit log.
+func NewIPExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipRange := range trustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// RequestInfoMiddleware passes the request's ID and source IP along, to the
+// services raising audit events. It goes after NewRequestLoggerMiddleware,
+// which assigns the ID. The IP comes from the echo's IPExtractor.
+func RequestInfoMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		info := RequestInfo{
+			ID:       c.Response().Header().Get(echo.HeaderXRequestID),
+			SourceIP: c.RealIP(),
+		}
+		c.SetRequest(c.Request().WithContext(ContextWithRequestInfo(c.Request().Context(), &info)))
+		return next(c)
+	}
+}
+
+// NewAuditEvent describes `action` on the entity, as made by whoever `ctx` is
+// authenticated as. `before` is nil for entities being created.
+func NewAuditEvent(ctx context.Context, action, entityType string, entityID uint, before, after interface{}, reason string) (*AuditEvent, error) {
+	diff, err := auditDiff(before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := AuditEvent{
+		Action:     action,
+		ActorType:  ActorSystem,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Diff:       diff,
+	}
+	if k := APIKeyFromContext(ctx); k != nil {
+		id := strconv.FormatUint(uint64(k.ID), 10)
+		ev.ActorType, ev.ActorID = ActorAPIKey, &id
+	} else if o := OwnerFromContext(ctx); o != nil {
+		ev.ActorType, ev.ActorID = ActorOwner, &o.ID
+	}
+	if info := RequestInfoFromContext(ctx); info != nil {
+		ev.RequestID, ev.SourceIP = &info.ID, &info.SourceIP
+	}
+	if reason != "" {
+		ev.Reason = &reason
+	}
+	return &ev, nil
+}
+
+type auditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// auditDiff compares the JSON representations of `before` and `after`,
+// keeping the top-level fields that differ.
+func auditDiff(before, after interface{}) (json.RawMessage, error) {
+	beforeFields, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := map[string]auditChange{}
+	for name, a := range afterFields {
+		if b, ok := beforeFields[name]; !ok || string(b) != string(a) {
+			diff[name] = auditChange{Before: beforeFields[name], After: a}
+		}
+	}
+	for name, b := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			diff[name] = auditChange{Before: b}
+		}
+	}
+	return json.Marshal(diff)
+}
+
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
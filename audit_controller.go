@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AuditServiceProvider interface {
+	List(context.Context, AuditFilter) ([]AuditEvent, error)
+}
+
+type AuditController struct {
+	auditService AuditServiceProvider
+}
+
+// ListEvents lists the audit events matching the filters, newest first. The
+// next page starts before the last event's ID.
+func (h *AuditController) ListEvents(c echo.Context) error {
+	var req ListAuditEventsRequest
+	var f AuditFilter
+	if err := req.Bind(c, &f); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	events, err := h.auditService.List(c.Request().Context(), f)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+func (h *AuditController) Register(r *echo.Group) {
+	r.GET("", h.ListEvents, RequireScope(ScopeAdmin))
+}
+
+func NewAuditController(s AuditServiceProvider) *AuditController {
+	return &AuditController{
+		auditService: s,
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "context"
+
+type AuditStorer interface {
+	List(context.Context, AuditFilter) ([]AuditEvent, error)
+}
+
+// AuditService reads the audit log. Events are written by the services making
+// the changes, in the same transaction.
+type AuditService struct {
+	store AuditStorer
+}
+
+func (s *AuditService) List(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	return s.store.List(ctx, f)
+}
+
+func NewAuditService(store AuditStorer) *AuditService {
+	return &AuditService{
+		store: store,
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// namedPreparer is a DbExecutor or a TxExecutor.
+type namedPreparer interface {
+	PrepareNamed(string) (*sqlx.NamedStmt, error)
+}
+
+// insertAuditEvent records `ev`. It's meant to run in the transaction making
+// the change the event is about, so one isn't stored without the other.
+func insertAuditEvent(db namedPreparer, ev *AuditEvent) error {
+	stmt, err := db.PrepareNamed(`INSERT INTO audit_events
+		(action, actor_type, actor_id, source_ip, request_id, entity_type, entity_id, diff, reason)
+		VALUES (:action,:actor_type,:actor_id,:source_ip,:request_id,:entity_type,:entity_id,:diff,:reason)
+		RETURNING id, created_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	return stmt.Get(ev, ev)
+}
+
+// AuditFilter narrows down the audit events listed. Zero values match every
+// event.
+type AuditFilter struct {
+	Action     string
+	ActorType  string
+	ActorID    string
+	EntityType string
+	EntityID   uint
+	From       time.Time
+	To         time.Time
+	// BeforeID pages through the events, newest first.
+	BeforeID uint
+	Limit    int
+}
+
+type AuditStore struct {
+	db DbExecutor
+}
+
+func (s *AuditStore) List(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	span := startStoreSpan(ctx, "AuditStore.List", "select_audit_events")
+	defer span.End()
+
+	var conds []string
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Action != "" {
+		where("action=$%d", f.Action)
+	}
+	if f.ActorType != "" {
+		where("actor_type=$%d", f.ActorType)
+	}
+	if f.ActorID != "" {
+		where("actor_id=$%d", f.ActorID)
+	}
+	if f.EntityType != "" {
+		where("entity_type=$%d", f.EntityType)
+	}
+	if f.EntityID != 0 {
+		where("entity_id=$%d", f.EntityID)
+	}
+	if !f.From.IsZero() {
+		where("created_at>=$%d", f.From)
+	}
+	if !f.To.IsZero() {
+		where("created_at<$%d", f.To)
+	}
+	if f.BeforeID != 0 {
+		where("id<$%d", f.BeforeID)
+	}
+
+	stm := `SELECT * FROM audit_events`
+	if len(conds) > 0 {
+		stm += ` WHERE ` + strings.Join(conds, ` AND `)
+	}
+	args = append(args, f.Limit)
+	stm += fmt.Sprintf(` ORDER BY id DESC LIMIT $%d`, len(args))
+
+	events := []AuditEvent{}
+	if err := s.db.Select(&events, stm, args...); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	return events, nil
+}
+
+func NewAuditStore(db DbExecutor) *AuditStore {
+	return &AuditStore{
+		db: db,
+	}
+}
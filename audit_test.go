@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAuditEvent(t *testing.T) {
+	t.Run("records the fields that changed", func(t *testing.T) {
+		before := Wallet{ID: 1, Name: "main", Balance: 500}
+		after := Wallet{ID: 1, Name: "main", Balance: 700}
+		ev, err := NewAuditEvent(context.Background(), AuditBalanceChanged, "wallet", 1, &before, &after, "deposit:3")
+		assert.NoError(t, err)
+
+		assert.JSONEq(t, `{"balance":{"before":500,"after":700}}`, string(ev.Diff))
+		assert.Equal(t, "wallet", ev.EntityType)
+		assert.Equal(t, uint(1), ev.EntityID)
+		if assert.NotNil(t, ev.Reason) {
+			assert.Equal(t, "deposit:3", *ev.Reason)
+		}
+	})
+
+	t.Run("records every field of created entities", func(t *testing.T) {
+		ev, err := NewAuditEvent(context.Background(), AuditDisputeOpened, "dispute", 1, nil, &Dispute{ID: 1, State: DisputeOpen}, "")
+		assert.NoError(t, err)
+
+		var diff map[string]auditChange
+		assert.NoError(t, json.Unmarshal(ev.Diff, &diff))
+		assert.JSONEq(t, `"open"`, string(diff["state"].After))
+		assert.JSONEq(t, `null`, string(diff["state"].Before))
+		assert.Nil(t, ev.Reason)
+	})
+
+	t.Run("records the actor and the request", func(t *testing.T) {
+		ctx := ContextWithRequestInfo(context.Background(), &RequestInfo{ID: "req-1", SourceIP: "10.0.0.1"})
+		for _, tc := range []struct {
+			ctx       context.Context
+			actorType string
+			actorID   *string
+		}{
+			{ctx, ActorSystem, nil},
+			{ContextWithAPIKey(ctx, &APIKey{ID: 7}), ActorAPIKey, strPtr("7")},
+			{ContextWithOwner(ctx, &Owner{ID: "player-1"}), ActorOwner, strPtr("player-1")},
+		} {
+			ev, err := NewAuditEvent(tc.ctx, AuditWalletCreated, "wallet", 1, nil, &Wallet{ID: 1}, "")
+			assert.NoError(t, err)
+			assert.Equal(t, tc.actorType, ev.ActorType)
+			assert.Equal(t, tc.actorID, ev.ActorID)
+			assert.Equal(t, strPtr("req-1"), ev.RequestID)
+			assert.Equal(t, strPtr("10.0.0.1"), ev.SourceIP)
+		}
+	})
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestRequestInfoMiddleware(t *testing.T) {
+	var info *RequestInfo
+	h := RequestInfoMiddleware(func(c echo.Context) error {
+		info = RequestInfoFromContext(c.Request().Context())
+		return nil
+	})
+
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	for name, tc := range map[string]struct {
+		trustedProxies []*net.IPNet
+		remoteAddr     string
+		sourceIP       string
+	}{
+		"ignores the headers without trusted proxies": {nil, "192.0.2.1:1234", "192.0.2.1"},
+		"trusts X-Forwarded-For from the proxies":     {[]*net.IPNet{proxies}, "192.0.2.1:1234", "203.0.113.7"},
+		"ignores X-Forwarded-For from anyone else":    {[]*net.IPNet{proxies}, "198.51.100.1:1234", "198.51.100.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := echo.New()
+			e.IPExtractor = NewIPExtractor(tc.trustedProxies)
+
+			req := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set(echo.HeaderXRealIP, "10.0.0.1")
+			req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+			resp := httptest.NewRecorder()
+			resp.Header().Set(echo.HeaderXRequestID, "req-1")
+			assert.NoError(t, h(e.NewContext(req, resp)))
+
+			if assert.NotNil(t, info) {
+				assert.Equal(t, RequestInfo{ID: "req-1", SourceIP: tc.sourceIP}, *info)
+			}
+		})
+	}
+}
+
+type DummyAuditService struct {
+	Filters []AuditFilter
+}
+
+func (s *DummyAuditService) List(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	s.Filters = append(s.Filters, f)
+	return []AuditEvent{{ID: 1, Action: AuditWalletCreated}}, nil
+}
+
+func TestAuditControllerListEvents(t *testing.T) {
+	serve := func(service *DummyAuditService, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/audit?"+query, nil)
+		resp := httptest.NewRecorder()
+		assert.NoError(t, NewAuditController(service).ListEvents(echo.New().NewContext(req, resp)))
+		return resp
+	}
+
+	t.Run("Succeeds, filtering the events", func(t *testing.T) {
+		service := DummyAuditService{}
+		resp := serve(&service, "action=wallet.created&actor_type=api_key&actor_id=7&entity_type=wallet&entity_id=1&from=2026-10-01T00:00:00Z&before_id=50&limit=10")
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		f := service.Filters[0]
+		assert.Equal(t, AuditWalletCreated, f.Action)
+		assert.Equal(t, ActorAPIKey, f.ActorType)
+		assert.Equal(t, "7", f.ActorID)
+		assert.Equal(t, "wallet", f.EntityType)
+		assert.Equal(t, uint(1), f.EntityID)
+		assert.Equal(t, 2026, f.From.Year())
+		assert.True(t, f.To.IsZero())
+		assert.Equal(t, uint(50), f.BeforeID)
+		assert.Equal(t, 10, f.Limit)
+
+		var events []AuditEvent
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &events))
+		assert.Len(t, events, 1)
+	})
+
+	t.Run("lists 100 events by default", func(t *testing.T) {
+		service := DummyAuditService{}
+		assert.Equal(t, http.StatusOK, serve(&service, "").Code)
+		assert.Equal(t, AuditFilter{Limit: 100}, service.Filters[0])
+	})
+
+	t.Run("HTTP 400 if the filters are invalid", func(t *testing.T) {
+		for _, query := range []string{
+			"entity_id=abc",
+			"from=yesterday",
+			"from=2026-10-02T00:00:00Z&to=2026-10-01T00:00:00Z",
+			"actor_type=robot",
+			"limit=0",
+			"limit=1001",
+		} {
+			t.Run(query, func(t *testing.T) {
+				service := DummyAuditService{}
+				assert.Equal(t, http.StatusBadRequest, serve(&service, query).Code)
+				assert.Empty(t, service.Filters)
+			})
+		}
+	})
+}
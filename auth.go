@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/lalvarezguillen/bluelabs-wallets-service/signing"
+)
+
+const HeaderAPIKey = "X-API-Key"
+
+const (
+	ScopeWalletsRead   = "wallets:read"
+	ScopeWalletsWrite  = "wallets:write"
+	ScopeBalanceCredit = "balance:credit"
+	ScopeBalanceDebit  = "balance:debit"
+	// ScopeAdmin grants every other scope, and the management of API keys
+	// and webhooks.
+	ScopeAdmin = "admin"
+)
+
+const missingScopeMessage = "API key lacks the required scope"
+
+var Scopes = []string{
+	ScopeWalletsRead,
+	ScopeWalletsWrite,
+	ScopeBalanceCredit,
+	ScopeBalanceDebit,
+	ScopeAdmin,
+}
+
+// HasScope tells whether the key grants `scope`.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Owner is the owner of wallets, as identified by a bearer token. Owners only
+// get to the routes that make sure they own the wallet.
+type Owner struct {
+	ID     string
+	Scopes []string
+}
+
+// HasScope tells whether the token grants `scope`.
+func (o *Owner) HasScope(scope string) bool {
+	for _, s := range o.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyAuthenticator interface {
+	Authenticate(context.Context, string) (*APIKey, error)
+}
+
+type TokenAuthenticator interface {
+	Validate(string) (*Owner, error)
+}
+
+type RequestAuthenticator interface {
+	Verify(*http.Request) (*APIKey, error)
+}
+
+type apiKeyContextKey struct{}
+
+type ownerContextKey struct{}
+
+// ContextWithAPIKey returns a copy of `ctx` carrying the key the request was
+// authenticated with.
+func ContextWithAPIKey(ctx context.Context, k *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, k)
+}
+
+// APIKeyFromContext returns the key the request was authenticated with, or
+// nil if the work wasn't started by a request authenticated with a key.
+func APIKeyFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// ContextWithOwner returns a copy of `ctx` carrying the owner the request's
+// bearer token was issued to.
+func ContextWithOwner(ctx context.Context, o *Owner) context.Context {
+	return context.WithValue(ctx, ownerContextKey{}, o)
+}
+
+// OwnerFromContext returns the owner the request's bearer token was issued
+// to, or nil if it wasn't authenticated with a token.
+func OwnerFromContext(ctx context.Context) *Owner {
+	o, _ := ctx.Value(ownerContextKey{}).(*Owner)
+	return o
+}
+
+// NewAuthMiddleware rejects the requests without a valid key in the X-API-Key
+// header, a valid signature in the X-Signature ones, or a valid bearer token
+// in the Authorization one. Tokens are only accepted if `tokens` isn't nil.
+// Whoever the request was authenticated as is made available to the handlers,
+// and to the services they call, through the request's context.
+func NewAuthMiddleware(keys APIKeyAuthenticator, signatures RequestAuthenticator, tokens TokenAuthenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+
+			if key := c.Request().Header.Get(HeaderAPIKey); key != "" {
+				k, err := keys.Authenticate(ctx, key)
+				if err != nil {
+					var errKey *ErrInvalidAPIKey
+					if errors.As(err, &errKey) {
+						return echo.NewHTTPError(http.StatusUnauthorized, errKey.Error())
+					}
+					return internalError(c, err)
+				}
+				addLogField(c, "api_key_id", k.ID)
+				ctx = ContextWithAPIKey(ctx, k)
+			} else if c.Request().Header.Get(signing.HeaderSignature) != "" {
+				k, err := signatures.Verify(c.Request())
+				if err != nil {
+					var errSig *ErrInvalidSignature
+					if errors.As(err, &errSig) {
+						return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("%s: %s", errSig.Error(), errSig.Inner))
+					}
+					var errTooLarge *ErrBodyTooLarge
+					if errors.As(err, &errTooLarge) {
+						return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errTooLarge.Error())
+					}
+					return internalError(c, err)
+				}
+				addLogField(c, "api_key_id", k.ID)
+				addLogField(c, "signed", true)
+				ctx = ContextWithAPIKey(ctx, k)
+			} else if token, ok := bearerToken(c.Request()); ok && tokens != nil {
+				o, err := tokens.Validate(token)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+				}
+				addLogField(c, "owner_id", o.ID)
+				ctx = ContextWithOwner(ctx, o)
+			} else {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Missing API key or bearer token")
+			}
+
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get(echo.HeaderAuthorization)
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// RequireScope rejects the requests whose API key grants none of `scopes`.
+// Bearer tokens are rejected: the route doesn't check who owns the wallets.
+func RequireScope(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			k := APIKeyFromContext(c.Request().Context())
+			for _, scope := range scopes {
+				if k != nil && k.HasScope(scope) {
+					return next(c)
+				}
+			}
+			return echo.NewHTTPError(http.StatusForbidden, missingScopeMessage)
+		}
+	}
+}
+
+// RequireScopeOrOwner is RequireScope for routes that also take bearer
+// tokens granting any of `scopes`. Their handlers must make sure the owner
+// owns the wallet, with authorizeWallet.
+func RequireScopeOrOwner(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, scope := range scopes {
+				if hasScope(c, scope) {
+					return next(c)
+				}
+			}
+			return echo.NewHTTPError(http.StatusForbidden, missingScopeMessage)
+		}
+	}
+}
+
+func hasScope(c echo.Context, scope string) bool {
+	ctx := c.Request().Context()
+	if k := APIKeyFromContext(ctx); k != nil {
+		return k.HasScope(scope)
+	}
+	if o := OwnerFromContext(ctx); o != nil {
+		return o.HasScope(scope)
+	}
+	return false
+}
+
+// authorizeWallet fails with a 403 when the request was made by an owner, and
+// the wallet isn't theirs. API keys get to every wallet.
+func authorizeWallet(c echo.Context, w *Wallet) error {
+	o := OwnerFromContext(c.Request().Context())
+	if o == nil || (w.OwnerID != nil && *w.OwnerID == o.ID) {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "Wallet belongs to someone else")
+}
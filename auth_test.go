@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lalvarezguillen/bluelabs-wallets-service/signing"
+)
+
+// withAPIKey authenticates `req` with a key granting `scopes`.
+func withAPIKey(req *http.Request, scopes ...string) *http.Request {
+	return req.WithContext(ContextWithAPIKey(req.Context(), &APIKey{ID: 1, Scopes: scopes}))
+}
+
+type DummyAPIKeyAuthenticator struct {
+	Keys map[string]*APIKey
+	Err  error
+}
+
+func (a *DummyAPIKeyAuthenticator) Authenticate(ctx context.Context, key string) (*APIKey, error) {
+	if a.Err != nil {
+		return nil, a.Err
+	}
+	k, ok := a.Keys[key]
+	if !ok {
+		return nil, &ErrInvalidAPIKey{}
+	}
+	return k, nil
+}
+
+func TestAPIKeyHasScope(t *testing.T) {
+	k := APIKey{Scopes: []string{ScopeWalletsRead, ScopeBalanceCredit}}
+	assert.True(t, k.HasScope(ScopeWalletsRead))
+	assert.True(t, k.HasScope(ScopeBalanceCredit))
+	assert.False(t, k.HasScope(ScopeBalanceDebit))
+
+	admin := APIKey{Scopes: []string{ScopeAdmin}}
+	for _, scope := range Scopes {
+		assert.True(t, admin.HasScope(scope), scope)
+	}
+}
+
+type DummyTokenAuthenticator struct {
+	Owners map[string]*Owner
+}
+
+func (a *DummyTokenAuthenticator) Validate(token string) (*Owner, error) {
+	o, ok := a.Owners[token]
+	if !ok {
+		return nil, &ErrInvalidToken{Reason: "bad signature"}
+	}
+	return o, nil
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := DummyAPIKeyAuthenticator{Keys: map[string]*APIKey{
+		"wsk_reader": {ID: 3, Scopes: []string{ScopeWalletsRead}},
+	}}
+	tokens := DummyTokenAuthenticator{Owners: map[string]*Owner{
+		"player-token": {ID: "player-1", Scopes: []string{ScopeWalletsRead}},
+	}}
+
+	secret := "wss_secret"
+	signatures := NewRequestVerifier(DummySigningKeyFinder{
+		4: {ID: 4, Scopes: []string{ScopeWalletsRead}, SigningSecret: &secret},
+	}, NewMemoryNonceStore(), time.Minute)
+
+	serveRequest := func(keys APIKeyAuthenticator, tokens TokenAuthenticator, req *http.Request) (int, context.Context) {
+		var seen context.Context
+		e := echo.New()
+		e.Use(NewAuthMiddleware(keys, signatures, tokens))
+		e.GET("/wallets/:id", func(c echo.Context) error {
+			seen = c.Request().Context()
+			return c.NoContent(http.StatusOK)
+		}, RequireScopeOrOwner(ScopeWalletsRead))
+
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		return resp.Code, seen
+	}
+	serve := func(keys APIKeyAuthenticator, tokens TokenAuthenticator, header, value string) (int, context.Context) {
+		req := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return serveRequest(keys, tokens, req)
+	}
+	signed := func(keyID, secret string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+		assert.NoError(t, (&signing.Signer{KeyID: keyID, Secret: secret}).Sign(req))
+		return req
+	}
+
+	t.Run("Succeeds with an API key, passing it along", func(t *testing.T) {
+		code, ctx := serve(&keys, &tokens, HeaderAPIKey, "wsk_reader")
+		assert.Equal(t, http.StatusOK, code)
+		if k := APIKeyFromContext(ctx); assert.NotNil(t, k) {
+			assert.Equal(t, uint(3), k.ID)
+		}
+	})
+
+	t.Run("Succeeds with a signed request, passing its key along", func(t *testing.T) {
+		code, ctx := serveRequest(&keys, &tokens, signed("4", secret))
+		assert.Equal(t, http.StatusOK, code)
+		if k := APIKeyFromContext(ctx); assert.NotNil(t, k) {
+			assert.Equal(t, uint(4), k.ID)
+		}
+	})
+
+	t.Run("HTTP 401 if the signature is invalid", func(t *testing.T) {
+		for _, req := range []*http.Request{signed("4", "wss_forged"), signed("5", secret)} {
+			code, _ := serveRequest(&keys, &tokens, req)
+			assert.Equal(t, http.StatusUnauthorized, code)
+		}
+	})
+
+	t.Run("Succeeds with a bearer token, passing the owner along", func(t *testing.T) {
+		code, ctx := serve(&keys, &tokens, echo.HeaderAuthorization, "Bearer player-token")
+		assert.Equal(t, http.StatusOK, code)
+		if o := OwnerFromContext(ctx); assert.NotNil(t, o) {
+			assert.Equal(t, "player-1", o.ID)
+		}
+		assert.Nil(t, APIKeyFromContext(ctx))
+	})
+
+	t.Run("HTTP 401 if the key or token are missing or invalid", func(t *testing.T) {
+		cases := [][2]string{
+			{"", ""},
+			{HeaderAPIKey, "wsk_unknown"},
+			{echo.HeaderAuthorization, "Bearer forged-token"},
+			{echo.HeaderAuthorization, "Basic cGxheWVyOnB3"},
+		}
+		for _, tc := range cases {
+			code, _ := serve(&keys, &tokens, tc[0], tc[1])
+			assert.Equal(t, http.StatusUnauthorized, code, tc)
+		}
+	})
+
+	t.Run("HTTP 401 for bearer tokens if they're disabled", func(t *testing.T) {
+		code, _ := serve(&keys, nil, echo.HeaderAuthorization, "Bearer player-token")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("HTTP 500 if the key can't be checked", func(t *testing.T) {
+		code, _ := serve(&DummyAPIKeyAuthenticator{Err: errors.New("connection refused")}, &tokens, HeaderAPIKey, "wsk_reader")
+		assert.Equal(t, http.StatusInternalServerError, code)
+	})
+}
+
+func TestRequireScope(t *testing.T) {
+	handler := RequireScope(ScopeBalanceCredit, ScopeBalanceDebit)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	cases := map[string]struct {
+		req  *http.Request
+		code int
+	}{
+		"any of the scopes": {withAPIKey(httptest.NewRequest(http.MethodPost, "/", nil), ScopeBalanceDebit), http.StatusOK},
+		"admin":             {withAPIKey(httptest.NewRequest(http.MethodPost, "/", nil), ScopeAdmin), http.StatusOK},
+		"none of them":      {withAPIKey(httptest.NewRequest(http.MethodPost, "/", nil), ScopeWalletsRead), http.StatusForbidden},
+		"no key":            {httptest.NewRequest(http.MethodPost, "/", nil), http.StatusForbidden},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			err := handler(echo.New().NewContext(tc.req, resp))
+			if tc.code == http.StatusOK {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.code, resp.Code)
+				return
+			}
+			var httpErr *echo.HTTPError
+			assert.True(t, errors.As(err, &httpErr))
+			assert.Equal(t, tc.code, httpErr.Code)
+		})
+	}
+}
+
+func TestRequireScopeRejectsOwners(t *testing.T) {
+	handler := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(ContextWithOwner(req.Context(), &Owner{ID: "player-1", Scopes: []string{ScopeWalletsRead}}))
+
+	err := RequireScope(ScopeWalletsRead)(handler)(echo.New().NewContext(req, httptest.NewRecorder()))
+	var httpErr *echo.HTTPError
+	assert.True(t, errors.As(err, &httpErr))
+	assert.Equal(t, http.StatusForbidden, httpErr.Code)
+
+	resp := httptest.NewRecorder()
+	assert.NoError(t, RequireScopeOrOwner(ScopeWalletsRead)(handler)(echo.New().NewContext(req, resp)))
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestAuthorizeWallet(t *testing.T) {
+	owner := "player-1"
+	someoneElse := "player-2"
+	ownerReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	ownerReq = ownerReq.WithContext(ContextWithOwner(ownerReq.Context(), &Owner{ID: owner}))
+	keyReq := withAPIKey(httptest.NewRequest(http.MethodGet, "/", nil), ScopeWalletsRead)
+
+	cases := map[string]struct {
+		req     *http.Request
+		wallet  Wallet
+		allowed bool
+	}{
+		"owner's wallet":             {ownerReq, Wallet{OwnerID: &owner}, true},
+		"someone else's wallet":      {ownerReq, Wallet{OwnerID: &someoneElse}, false},
+		"wallet without an owner":    {ownerReq, Wallet{}, false},
+		"API keys get to any wallet": {keyReq, Wallet{OwnerID: &someoneElse}, true},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := authorizeWallet(echo.New().NewContext(tc.req, httptest.NewRecorder()), &tc.wallet)
+			if tc.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			var httpErr *echo.HTTPError
+			assert.True(t, errors.As(err, &httpErr))
+			assert.Equal(t, http.StatusForbidden, httpErr.Code)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CallbackServiceProvider interface {
+	Handle(context.Context, string, http.Header, []byte) (bool, error)
+}
+
+type CallbackController struct {
+	callbackService CallbackServiceProvider
+}
+
+func (h *CallbackController) HandleCallback(c echo.Context) error {
+	// Signatures are computed over the raw body, so it can't go through Bind.
+	// It's read before the signature is checked, so it's bounded like the
+	// bodies of signed requests.
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxSignedBodySize+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+	if len(body) > maxSignedBodySize {
+		errTooLarge := &ErrBodyTooLarge{Limit: maxSignedBodySize}
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errTooLarge.Error())
+	}
+
+	duplicate, err := h.callbackService.Handle(c.Request().Context(), c.Param("provider"), c.Request().Header, body)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		var errSig *ErrInvalidSignature
+		if errors.As(err, &errSig) {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+
+		var errTransition *ErrInvalidTransition
+		if errors.As(err, &errTransition) {
+			return echo.NewHTTPError(http.StatusConflict, errTransition.Error())
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]bool{"duplicate": duplicate})
+}
+
+func (h *CallbackController) Register(r *echo.Group) {
+	r.POST("/:provider", h.HandleCallback)
+}
+
+func NewCallbackController(cs CallbackServiceProvider) *CallbackController {
+	return &CallbackController{
+		callbackService: cs,
+	}
+}
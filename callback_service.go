@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type CallbackStorer interface {
+	BeginTx(context.Context) (TxExecutor, error)
+	// Record stores the callback within `tx`, returning false if it was
+	// already recorded.
+	Record(string, *ProviderCallback, TxExecutor) (bool, error)
+}
+
+type DepositTransitioner interface {
+	TransitionTx(context.Context, TxExecutor, uint, string) (*Deposit, error)
+}
+
+type WithdrawalOutcomeApplier interface {
+	ApplyPayoutOutcomeTx(context.Context, TxExecutor, uint, string) (*Withdrawal, error)
+}
+
+// CallbackService turns verified provider callbacks into deposit and
+// withdrawal state transitions. Callbacks are recorded in the same transaction
+// that applies them, so a provider retrying a callback we failed to apply gets
+// another go, while the ones already applied are acknowledged without touching
+// anything, even if they're delivered concurrently.
+type CallbackService struct {
+	adapters    map[string]ProviderAdapter
+	store       CallbackStorer
+	deposits    DepositTransitioner
+	withdrawals WithdrawalOutcomeApplier
+}
+
+// Handle verifies, deduplicates and applies a callback from `provider`. It
+// returns whether the callback was a duplicate.
+func (s *CallbackService) Handle(ctx context.Context, provider string, h http.Header, body []byte) (bool, error) {
+	adapter, ok := s.adapters[provider]
+	if !ok {
+		return false, &ErrNotFound{}
+	}
+
+	if err := adapter.VerifySignature(h, body); err != nil {
+		return false, err
+	}
+
+	cb, err := adapter.ParseCallback(body)
+	if err != nil {
+		ve := NewValidationErrors()
+		ve.Add("body", err.Error())
+		return false, &ve
+	}
+
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	recorded, err := s.store.Record(provider, cb, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return false, rbErr
+		}
+		return false, err
+	}
+	if !recorded {
+		return true, tx.Rollback()
+	}
+
+	switch cb.Kind {
+	case CallbackDeposit:
+		_, err = s.deposits.TransitionTx(ctx, tx, cb.TargetID, cb.State)
+	case CallbackWithdrawal:
+		_, err = s.withdrawals.ApplyPayoutOutcomeTx(ctx, tx, cb.TargetID, cb.State)
+	}
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return false, rbErr
+		}
+		return false, err
+	}
+
+	return false, tx.Commit()
+}
+
+func NewCallbackService(store CallbackStorer, deposits DepositTransitioner, withdrawals WithdrawalOutcomeApplier, adapters ...ProviderAdapter) *CallbackService {
+	s := &CallbackService{
+		adapters:    make(map[string]ProviderAdapter),
+		store:       store,
+		deposits:    deposits,
+		withdrawals: withdrawals,
+	}
+	for _, a := range adapters {
+		s.adapters[a.Name()] = a
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyCallbackStore struct {
+	Tx          DummyTx
+	Seen        bool
+	RecordCalls []ProviderCallback
+}
+
+func (s *DummyCallbackStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	return &s.Tx, nil
+}
+
+func (s *DummyCallbackStore) Record(provider string, cb *ProviderCallback, tx TxExecutor) (bool, error) {
+	s.RecordCalls = append(s.RecordCalls, *cb)
+	return !s.Seen, nil
+}
+
+type DummyDepositTransitioner struct {
+	TransitionCalls  []string
+	TransitionResult error
+}
+
+func (d *DummyDepositTransitioner) TransitionTx(ctx context.Context, tx TxExecutor, id uint, to string) (*Deposit, error) {
+	d.TransitionCalls = append(d.TransitionCalls, to)
+	if d.TransitionResult != nil {
+		return nil, d.TransitionResult
+	}
+	return &Deposit{ID: id, State: to}, nil
+}
+
+type DummyWithdrawalOutcomeApplier struct {
+	ApplyPayoutOutcomeCalls []string
+}
+
+func (w *DummyWithdrawalOutcomeApplier) ApplyPayoutOutcomeTx(ctx context.Context, tx TxExecutor, id uint, outcome string) (*Withdrawal, error) {
+	w.ApplyPayoutOutcomeCalls = append(w.ApplyPayoutOutcomeCalls, outcome)
+	return &Withdrawal{ID: id, State: outcome}, nil
+}
+
+func signLocal(secret string, body []byte) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	h := http.Header{}
+	h.Set(HeaderLocalSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func TestCallbackServiceHandle(t *testing.T) {
+	body := []byte(`{"event_id":"evt_1","kind":"deposit","id":1,"state":"cleared"}`)
+
+	t.Run("applies deposit callbacks", func(t *testing.T) {
+		store := DummyCallbackStore{}
+		deposits := DummyDepositTransitioner{}
+		withdrawals := DummyWithdrawalOutcomeApplier{}
+		service := NewCallbackService(&store, &deposits, &withdrawals, NewLocalProviderAdapter("s3cr3t"))
+
+		duplicate, err := service.Handle(context.Background(), "local", signLocal("s3cr3t", body), body)
+		assert.NoError(t, err)
+		assert.False(t, duplicate)
+		assert.Equal(t, []string{DepositCleared}, deposits.TransitionCalls)
+		assert.Equal(t, 1, len(store.RecordCalls))
+		assert.Equal(t, "evt_1", store.RecordCalls[0].EventID)
+		assert.Len(t, store.Tx.CommitCalls, 1)
+	})
+
+	t.Run("applies withdrawal callbacks", func(t *testing.T) {
+		body := []byte(`{"event_id":"evt_2","kind":"withdrawal","id":1,"state":"failed"}`)
+		store := DummyCallbackStore{}
+		deposits := DummyDepositTransitioner{}
+		withdrawals := DummyWithdrawalOutcomeApplier{}
+		service := NewCallbackService(&store, &deposits, &withdrawals, NewLocalProviderAdapter("s3cr3t"))
+
+		_, err := service.Handle(context.Background(), "local", signLocal("s3cr3t", body), body)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{WithdrawalFailed}, withdrawals.ApplyPayoutOutcomeCalls)
+		assert.Empty(t, deposits.TransitionCalls)
+	})
+
+	t.Run("acknowledges duplicates without applying them", func(t *testing.T) {
+		store := DummyCallbackStore{Seen: true}
+		deposits := DummyDepositTransitioner{}
+		service := NewCallbackService(&store, &deposits, &DummyWithdrawalOutcomeApplier{}, NewLocalProviderAdapter("s3cr3t"))
+
+		duplicate, err := service.Handle(context.Background(), "local", signLocal("s3cr3t", body), body)
+		assert.NoError(t, err)
+		assert.True(t, duplicate)
+		assert.Empty(t, deposits.TransitionCalls)
+		assert.Len(t, store.Tx.RollbackCalls, 1)
+		assert.Empty(t, store.Tx.CommitCalls)
+	})
+
+	t.Run("rolls the record back if the callback can't be applied", func(t *testing.T) {
+		store := DummyCallbackStore{}
+		deposits := DummyDepositTransitioner{TransitionResult: &ErrInvalidTransition{From: DepositFailed, To: DepositCleared}}
+		service := NewCallbackService(&store, &deposits, &DummyWithdrawalOutcomeApplier{}, NewLocalProviderAdapter("s3cr3t"))
+
+		_, err := service.Handle(context.Background(), "local", signLocal("s3cr3t", body), body)
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+		assert.Len(t, store.Tx.RollbackCalls, 1)
+		assert.Empty(t, store.Tx.CommitCalls)
+	})
+
+	t.Run("fails: ErrInvalidSignature", func(t *testing.T) {
+		store := DummyCallbackStore{}
+		deposits := DummyDepositTransitioner{}
+		service := NewCallbackService(&store, &deposits, &DummyWithdrawalOutcomeApplier{}, NewLocalProviderAdapter("s3cr3t"))
+
+		for _, h := range []http.Header{{}, signLocal("wrong", body)} {
+			_, err := service.Handle(context.Background(), "local", h, body)
+			var errSig *ErrInvalidSignature
+			assert.True(t, errors.As(err, &errSig))
+		}
+		assert.Empty(t, deposits.TransitionCalls)
+	})
+
+	t.Run("fails: ErrNotFound for unknown providers", func(t *testing.T) {
+		service := NewCallbackService(&DummyCallbackStore{}, &DummyDepositTransitioner{}, &DummyWithdrawalOutcomeApplier{})
+
+		_, err := service.Handle(context.Background(), "local", signLocal("s3cr3t", body), body)
+		var err404 *ErrNotFound
+		assert.True(t, errors.As(err, &err404))
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import "context"
+
+type CallbackStore struct {
+	db DbExecutor
+}
+
+func (s *CallbackStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	span := startStoreSpan(ctx, "CallbackStore.BeginTx", "begin")
+	defer span.End()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, failSpan(span, err)
+	}
+	return tx, nil
+}
+
+// Record inserts the callback, unless it was already recorded, in which case
+// it waits for whoever is recording it to commit or roll back.
+func (s *CallbackStore) Record(provider string, cb *ProviderCallback, tx TxExecutor) (bool, error) {
+	insertCallback := `INSERT INTO provider_callbacks
+		(provider, event_id, kind, target_id, state)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (provider, event_id) DO NOTHING`
+	res, err := tx.Exec(insertCallback, provider, cb.EventID, cb.Kind, cb.TargetID, cb.State)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func NewCallbackStore(db DbExecutor) *CallbackStore {
+	return &CallbackStore{
+		db: db,
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	ListenOn        string        `yaml:"listen_on"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// DrainDelay is how long /readyz reports the service as draining, once
+	// asked to stop, before it stops taking requests.
+	DrainDelay time.Duration `yaml:"drain_delay"`
+	// WorkersShutdownTimeout is how long each background worker gets to
+	// wrap up on shutdown.
+	WorkersShutdownTimeout time.Duration `yaml:"workers_shutdown_timeout"`
+	AutoMigrate            bool          `yaml:"auto_migrate"`
+	LogLevel               string        `yaml:"log_level"`
+	// TrustedProxies is a comma-separated list of the CIDR ranges of the
+	// proxies in front of the service, the only ones trusted to report the
+	// client's IP through X-Forwarded-For. Without them, it's the IP of the
+	// connection.
+	TrustedProxies string `yaml:"trusted_proxies"`
+
+	TLS         TLSConfig         `yaml:"tls"`
+	DB          DBConfig          `yaml:"db"`
+	Wallets     WalletsConfig     `yaml:"wallets"`
+	Withdrawals WithdrawalsConfig `yaml:"withdrawals"`
+	Callbacks   CallbacksConfig   `yaml:"callbacks"`
+	Outbox      OutboxConfig      `yaml:"outbox"`
+	Webhooks    WebhooksConfig    `yaml:"webhooks"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Signing     SigningConfig     `yaml:"signing"`
+	RateLimits  RateLimitsConfig  `yaml:"rate_limits"`
+	Features    FeaturesConfig    `yaml:"features"`
+}
+
+// TLSConfig makes the service serve HTTPS, if CertFile and KeyFile are set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile is a PEM bundle of the CAs client certificates must be
+	// issued by. Clients without one are turned away, unless it's empty.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// MinVersion is 1.2 or 1.3.
+	MinVersion string `yaml:"min_version"`
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// Enabled tells whether the service serves HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type DBConfig struct {
+	Host           string        `yaml:"host"`
+	Port           int           `yaml:"port"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	Name           string        `yaml:"name"`
+	SSLMode        string        `yaml:"sslmode"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	MaxOpenConns   int           `yaml:"max_open_conns"`
+	MaxIdleConns   int           `yaml:"max_idle_conns"`
+	// ConnMaxLifetime and ConnMaxIdleTime close connections once they get
+	// that old, or stay idle that long. 0 keeps them open.
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// MaxPoolWait is how long requests may wait, on average, for a pool
+	// connection before new requests are turned away. 0 never turns them away.
+	MaxPoolWait time.Duration `yaml:"max_pool_wait"`
+	// CloseTimeout is how long the queries running on shutdown get to finish
+	// before the pool is left behind.
+	CloseTimeout time.Duration `yaml:"close_timeout"`
+}
+
+type WalletsConfig struct {
+	LowBalanceThreshold uint64 `yaml:"low_balance_threshold"`
+}
+
+type WithdrawalsConfig struct {
+	PayoutProvider string `yaml:"payout_provider"`
+	MaxAttempts    int    `yaml:"max_attempts"`
+}
+
+type CallbacksConfig struct {
+	LocalSecret string `yaml:"local_secret"`
+}
+
+type OutboxConfig struct {
+	Publisher  string `yaml:"publisher"`
+	FilePath   string `yaml:"file_path"`
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+type WebhooksConfig struct {
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans go: none, stdout or otlp.
+	Exporter     string `yaml:"exporter"`
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	OTLPInsecure bool   `yaml:"otlp_insecure"`
+	// FlushTimeout is how long the spans left get to be exported on shutdown.
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+// AuthConfig sets up the bearer tokens player-facing apps authenticate with.
+// They're only accepted if JWKSFile or JWKSURL is set.
+type AuthConfig struct {
+	JWKSFile string `yaml:"jwks_file"`
+	JWKSURL  string `yaml:"jwks_url"`
+	// JWKSRefreshInterval is how often the keys are reloaded, so they can be
+	// rotated.
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+	// Issuer and Audience are checked against the tokens' iss and aud
+	// claims, unless empty.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// OwnerClaim is the claim holding the ID of the wallets' owner.
+	OwnerClaim string `yaml:"owner_claim"`
+}
+
+// TokensEnabled tells whether bearer tokens are accepted.
+func (c AuthConfig) TokensEnabled() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+// SigningConfig sets up how signed requests are checked.
+type SigningConfig struct {
+	// MaxSkew is how far off the service's clock a request's timestamp may
+	// be. Nonces are remembered for as long.
+	MaxSkew time.Duration `yaml:"max_skew"`
+	// NonceStore is where used nonces are remembered: memory or postgres.
+	// Only postgres blocks replays across replicas.
+	NonceStore string `yaml:"nonce_store"`
+}
+
+// RateLimitsConfig sets up the token buckets limiting each client's requests,
+// the changes to each wallet, and the unauthenticated requests of each IP. A 0
+// rate disables a limit.
+type RateLimitsConfig struct {
+	// Store is where buckets are kept: memory or postgres. Only postgres
+	// enforces the limits across replicas.
+	Store           string `yaml:"store"`
+	ClientPerMinute int    `yaml:"client_per_minute"`
+	ClientBurst     int    `yaml:"client_burst"`
+	WalletPerMinute int    `yaml:"wallet_per_minute"`
+	WalletBurst     int    `yaml:"wallet_burst"`
+	IPPerMinute     int    `yaml:"ip_per_minute"`
+	IPBurst         int    `yaml:"ip_burst"`
+}
+
+func (c RateLimitsConfig) PerClient() RateLimit {
+	return RateLimit{PerMinute: c.ClientPerMinute, Burst: c.ClientBurst}
+}
+
+func (c RateLimitsConfig) PerWallet() RateLimit {
+	return RateLimit{PerMinute: c.WalletPerMinute, Burst: c.WalletBurst}
+}
+
+func (c RateLimitsConfig) PerIP() RateLimit {
+	return RateLimit{PerMinute: c.IPPerMinute, Burst: c.IPBurst}
+}
+
+// FeaturesConfig turns optional parts of the service on and off.
+type FeaturesConfig struct {
+	Streaming bool `yaml:"streaming"`
+	Webhooks  bool `yaml:"webhooks"`
+	Snapshots bool `yaml:"snapshots"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenOn:               ":9000",
+		ReadTimeout:            30 * time.Second,
+		IdleTimeout:            2 * time.Minute,
+		ShutdownTimeout:        12 * time.Second,
+		DrainDelay:             5 * time.Second,
+		WorkersShutdownTimeout: 10 * time.Second,
+		LogLevel:               "info",
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ReloadInterval: 30 * time.Second,
+		},
+		DB: DBConfig{
+			Host:            "localhost",
+			Port:            5432,
+			Username:        "postgres",
+			Name:            "postgres",
+			SSLMode:         "require",
+			ConnectTimeout:  5 * time.Second,
+			MaxOpenConns:    20,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			MaxPoolWait:     time.Second,
+			CloseTimeout:    5 * time.Second,
+		},
+		Withdrawals: WithdrawalsConfig{
+			PayoutProvider: "fake",
+			MaxAttempts:    3,
+		},
+		Outbox: OutboxConfig{
+			Publisher: "stdout",
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts: 8,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "localhost:4318",
+			FlushTimeout: 5 * time.Second,
+		},
+		Auth: AuthConfig{
+			JWKSRefreshInterval: 15 * time.Minute,
+			OwnerClaim:          "sub",
+		},
+		Signing: SigningConfig{
+			MaxSkew:    5 * time.Minute,
+			NonceStore: "memory",
+		},
+		RateLimits: RateLimitsConfig{
+			Store:           "memory",
+			ClientPerMinute: 600,
+			ClientBurst:     100,
+			WalletPerMinute: 60,
+			WalletBurst:     10,
+			IPPerMinute:     120,
+			IPBurst:         30,
+		},
+		Features: FeaturesConfig{
+			Streaming: true,
+			Webhooks:  true,
+			Snapshots: true,
+		},
+	}
+}
+
+// configVar binds a setting to its environment variable and flag. Settings
+// can also be read from the file named by `<env>_FILE`, e.g. a mounted secret.
+// Secret ones are hidden from redacted output.
+type configVar struct {
+	Env    string
+	Flag   string
+	Usage  string
+	Secret bool
+	Value  flag.Value
+}
+
+func (c *Config) vars() []configVar {
+	return []configVar{
+		{Env: "LISTEN_ON", Flag: "listen-on", Usage: "address to listen on, host:port", Value: (*stringValue)(&c.ListenOn)},
+		{Env: "HTTP_READ_TIMEOUT", Flag: "read-timeout", Usage: "max time to read a request", Value: (*durationValue)(&c.ReadTimeout)},
+		{Env: "HTTP_IDLE_TIMEOUT", Flag: "idle-timeout", Usage: "max time to keep idle connections open", Value: (*durationValue)(&c.IdleTimeout)},
+		{Env: "SHUTDOWN_TIMEOUT", Flag: "shutdown-timeout", Usage: "max time to wait for requests on shutdown", Value: (*durationValue)(&c.ShutdownTimeout)},
+		{Env: "SHUTDOWN_DRAIN_DELAY", Flag: "drain-delay", Usage: "time to report not ready before shutting down", Value: (*durationValue)(&c.DrainDelay)},
+		{Env: "SHUTDOWN_WORKERS_TIMEOUT", Flag: "workers-shutdown-timeout", Usage: "max time for each background worker to stop on shutdown", Value: (*durationValue)(&c.WorkersShutdownTimeout)},
+		{Env: "AUTO_MIGRATE", Flag: "auto-migrate", Usage: "apply pending schema migrations before starting", Value: (*boolValue)(&c.AutoMigrate)},
+		{Env: "LOG_LEVEL", Flag: "log-level", Usage: "debug, info, warn or error", Value: (*stringValue)(&c.LogLevel)},
+		{Env: "TRUSTED_PROXIES", Flag: "trusted-proxies", Usage: "comma-separated CIDR ranges of the proxies allowed to set X-Forwarded-For", Value: (*stringValue)(&c.TrustedProxies)},
+
+		{Env: "TLS_CERT_FILE", Flag: "tls-cert-file", Usage: "PEM certificate to serve HTTPS with", Value: (*stringValue)(&c.TLS.CertFile)},
+		{Env: "TLS_KEY_FILE", Flag: "tls-key-file", Usage: "PEM key of the certificate", Value: (*stringValue)(&c.TLS.KeyFile)},
+		{Env: "TLS_CLIENT_CA_FILE", Flag: "tls-client-ca-file", Usage: "PEM bundle of the CAs client certificates are required from", Value: (*stringValue)(&c.TLS.ClientCAFile)},
+		{Env: "TLS_MIN_VERSION", Flag: "tls-min-version", Usage: "1.2 or 1.3", Value: (*stringValue)(&c.TLS.MinVersion)},
+		{Env: "TLS_RELOAD_INTERVAL", Flag: "tls-reload-interval", Usage: "how often to check the certificates for changes", Value: (*durationValue)(&c.TLS.ReloadInterval)},
+
+		{Env: "DB_HOST", Flag: "db-host", Value: (*stringValue)(&c.DB.Host)},
+		{Env: "DB_PORT", Flag: "db-port", Value: (*intValue)(&c.DB.Port)},
+		{Env: "DB_USERNAME", Flag: "db-username", Value: (*stringValue)(&c.DB.Username)},
+		{Env: "DB_PASSWORD", Flag: "db-password", Secret: true, Value: (*stringValue)(&c.DB.Password)},
+		{Env: "DB_NAME", Flag: "db-name", Value: (*stringValue)(&c.DB.Name)},
+		{Env: "DB_SSLMODE", Flag: "db-sslmode", Value: (*stringValue)(&c.DB.SSLMode)},
+		{Env: "DB_CONNECT_TIMEOUT", Flag: "db-connect-timeout", Value: (*durationValue)(&c.DB.ConnectTimeout)},
+		{Env: "DB_MAX_OPEN_CONNS", Flag: "db-max-open-conns", Usage: "0 means unlimited", Value: (*intValue)(&c.DB.MaxOpenConns)},
+		{Env: "DB_MAX_IDLE_CONNS", Flag: "db-max-idle-conns", Value: (*intValue)(&c.DB.MaxIdleConns)},
+		{Env: "DB_CONN_MAX_LIFETIME", Flag: "db-conn-max-lifetime", Usage: "0 means forever", Value: (*durationValue)(&c.DB.ConnMaxLifetime)},
+		{Env: "DB_CONN_MAX_IDLE_TIME", Flag: "db-conn-max-idle-time", Usage: "0 means forever", Value: (*durationValue)(&c.DB.ConnMaxIdleTime)},
+		{Env: "DB_MAX_POOL_WAIT", Flag: "db-max-pool-wait", Usage: "average pool wait above which requests get 503, 0 disables it", Value: (*durationValue)(&c.DB.MaxPoolWait)},
+		{Env: "DB_CLOSE_TIMEOUT", Flag: "db-close-timeout", Usage: "max time to wait for running queries on shutdown", Value: (*durationValue)(&c.DB.CloseTimeout)},
+
+		{Env: "LOW_BALANCE_THRESHOLD", Flag: "low-balance-threshold", Usage: "0 disables low balance events", Value: (*uintValue)(&c.Wallets.LowBalanceThreshold)},
+		{Env: "PAYOUT_PROVIDER", Flag: "payout-provider", Value: (*stringValue)(&c.Withdrawals.PayoutProvider)},
+		{Env: "WITHDRAWAL_MAX_ATTEMPTS", Flag: "withdrawal-max-attempts", Value: (*intValue)(&c.Withdrawals.MaxAttempts)},
+		{Env: "CALLBACK_LOCAL_SECRET", Flag: "callback-local-secret", Secret: true, Value: (*stringValue)(&c.Callbacks.LocalSecret)},
+		{Env: "OUTBOX_PUBLISHER", Flag: "outbox-publisher", Usage: "stdout, file or webhook", Value: (*stringValue)(&c.Outbox.Publisher)},
+		{Env: "OUTBOX_FILE_PATH", Flag: "outbox-file-path", Value: (*stringValue)(&c.Outbox.FilePath)},
+		{Env: "OUTBOX_WEBHOOK_URL", Flag: "outbox-webhook-url", Secret: true, Value: (*stringValue)(&c.Outbox.WebhookURL)},
+		{Env: "WEBHOOK_MAX_ATTEMPTS", Flag: "webhook-max-attempts", Value: (*intValue)(&c.Webhooks.MaxAttempts)},
+		{Env: "TRACING_EXPORTER", Flag: "tracing-exporter", Usage: "none, stdout or otlp", Value: (*stringValue)(&c.Tracing.Exporter)},
+		{Env: "TRACING_OTLP_ENDPOINT", Flag: "tracing-otlp-endpoint", Usage: "OTLP/HTTP collector, host:port", Value: (*stringValue)(&c.Tracing.OTLPEndpoint)},
+		{Env: "TRACING_OTLP_INSECURE", Flag: "tracing-otlp-insecure", Usage: "send spans to the collector over plain HTTP", Value: (*boolValue)(&c.Tracing.OTLPInsecure)},
+		{Env: "TRACING_FLUSH_TIMEOUT", Flag: "tracing-flush-timeout", Usage: "max time to export the spans left on shutdown", Value: (*durationValue)(&c.Tracing.FlushTimeout)},
+		{Env: "AUTH_JWKS_FILE", Flag: "auth-jwks-file", Usage: "JWKS to check bearer tokens against", Value: (*stringValue)(&c.Auth.JWKSFile)},
+		{Env: "AUTH_JWKS_URL", Flag: "auth-jwks-url", Usage: "URL of the JWKS to check bearer tokens against", Value: (*stringValue)(&c.Auth.JWKSURL)},
+		{Env: "AUTH_JWKS_REFRESH_INTERVAL", Flag: "auth-jwks-refresh-interval", Usage: "how often to reload the JWKS", Value: (*durationValue)(&c.Auth.JWKSRefreshInterval)},
+		{Env: "AUTH_JWT_ISSUER", Flag: "auth-jwt-issuer", Usage: "required iss of bearer tokens, if set", Value: (*stringValue)(&c.Auth.Issuer)},
+		{Env: "AUTH_JWT_AUDIENCE", Flag: "auth-jwt-audience", Usage: "required aud of bearer tokens, if set", Value: (*stringValue)(&c.Auth.Audience)},
+		{Env: "AUTH_OWNER_CLAIM", Flag: "auth-owner-claim", Usage: "bearer token claim holding the wallets' owner ID", Value: (*stringValue)(&c.Auth.OwnerClaim)},
+		{Env: "SIGNING_MAX_SKEW", Flag: "signing-max-skew", Usage: "max age of signed requests", Value: (*durationValue)(&c.Signing.MaxSkew)},
+		{Env: "SIGNING_NONCE_STORE", Flag: "signing-nonce-store", Usage: "memory or postgres", Value: (*stringValue)(&c.Signing.NonceStore)},
+		{Env: "RATE_LIMIT_STORE", Flag: "rate-limit-store", Usage: "memory or postgres", Value: (*stringValue)(&c.RateLimits.Store)},
+		{Env: "RATE_LIMIT_CLIENT_PER_MINUTE", Flag: "rate-limit-client-per-minute", Usage: "requests each API key or owner may make per minute, 0 disables it", Value: (*intValue)(&c.RateLimits.ClientPerMinute)},
+		{Env: "RATE_LIMIT_CLIENT_BURST", Flag: "rate-limit-client-burst", Usage: "requests each API key or owner may make at once", Value: (*intValue)(&c.RateLimits.ClientBurst)},
+		{Env: "RATE_LIMIT_WALLET_PER_MINUTE", Flag: "rate-limit-wallet-per-minute", Usage: "changes each wallet may get per minute, 0 disables it", Value: (*intValue)(&c.RateLimits.WalletPerMinute)},
+		{Env: "RATE_LIMIT_WALLET_BURST", Flag: "rate-limit-wallet-burst", Usage: "changes each wallet may get at once", Value: (*intValue)(&c.RateLimits.WalletBurst)},
+		{Env: "RATE_LIMIT_IP_PER_MINUTE", Flag: "rate-limit-ip-per-minute", Usage: "provider callbacks each IP may send per minute, 0 disables it", Value: (*intValue)(&c.RateLimits.IPPerMinute)},
+		{Env: "RATE_LIMIT_IP_BURST", Flag: "rate-limit-ip-burst", Usage: "provider callbacks each IP may send at once", Value: (*intValue)(&c.RateLimits.IPBurst)},
+
+		{Env: "FEATURE_STREAMING", Flag: "feature-streaming", Value: (*boolValue)(&c.Features.Streaming)},
+		{Env: "FEATURE_WEBHOOKS", Flag: "feature-webhooks", Value: (*boolValue)(&c.Features.Webhooks)},
+		{Env: "FEATURE_SNAPSHOTS", Flag: "feature-snapshots", Value: (*boolValue)(&c.Features.Snapshots)},
+	}
+}
+
+// LoadConfig builds the config out of, from lowest to highest precedence: the
+// defaults, the YAML file given by --config or CONFIG_FILE, the environment,
+// and the flags in `args`. It returns the arguments left after the flags.
+func LoadConfig(args []string, getenv func(string) string) (*Config, []string, error) {
+	cfg := DefaultConfig()
+	vars := cfg.vars()
+
+	// Flags are parsed first, to find the config file, but only applied last.
+	fs := flag.NewFlagSet("wallets-service", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("CONFIG_FILE"), "path to a YAML config file")
+	for _, v := range vars {
+		usage := v.Usage
+		if usage == "" {
+			usage = strings.ReplaceAll(v.Flag, "-", " ")
+		}
+		fs.Var(&deferredValue{target: v.Value}, v.Flag, fmt.Sprintf("%s (env %s)", usage, v.Env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		raw, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading config file: %w", err)
+		}
+		// Unknown keys are most likely typos, which would otherwise leave
+		// the setting at its default without a word.
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, v := range vars {
+		raw, ok, err := lookupEnv(getenv, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err := v.Value.Set(raw); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %w", v.Env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if d, ok := f.Value.(*deferredValue); ok && flagErr == nil {
+			if err := d.apply(); err != nil {
+				flagErr = fmt.Errorf("invalid -%s: %w", f.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// lookupEnv reads the variable's value from the environment, or from the file
+// `<env>_FILE` points to, e.g. a mounted secret.
+func lookupEnv(getenv func(string) string, v configVar) (string, bool, error) {
+	if path := getenv(v.Env + "_FILE"); path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("reading %s_FILE: %w", v.Env, err)
+		}
+		return strings.TrimRight(string(raw), "\r\n"), true, nil
+	}
+	if raw := getenv(v.Env); raw != "" {
+		return raw, true, nil
+	}
+	return "", false, nil
+}
+
+// TrustedProxyRanges parses TrustedProxies.
+func (c *Config) TrustedProxyRanges() ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, s := range strings.Split(c.TrustedProxies, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies should be a list of CIDR ranges, got %q", s)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, nil
+}
+
+// Validate checks the whole config, reporting every problem at once.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+
+	if _, port, err := net.SplitHostPort(c.ListenOn); err != nil {
+		errs = append(errs, fmt.Sprintf("listen_on should be host:port, got %q", c.ListenOn))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Sprintf("listen_on has an invalid port: %q", port))
+	}
+	if c.ReadTimeout <= 0 {
+		errs = append(errs, "read_timeout should be positive")
+	}
+	if c.IdleTimeout <= 0 {
+		errs = append(errs, "idle_timeout should be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown_timeout should be positive")
+	}
+	if c.DrainDelay < 0 {
+		errs = append(errs, "drain_delay can't be negative")
+	}
+	if c.WorkersShutdownTimeout <= 0 {
+		errs = append(errs, "workers_shutdown_timeout should be positive")
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("log_level should be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	if _, err := c.TrustedProxyRanges(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, "tls.cert_file and tls.key_file should be both set, or neither")
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		errs = append(errs, "tls.client_ca_file requires tls.cert_file and tls.key_file")
+	}
+	if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+		errs = append(errs, fmt.Sprintf("tls.min_version should be 1.2 or 1.3, got %q", c.TLS.MinVersion))
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		errs = append(errs, "tls.reload_interval should be positive")
+	}
+
+	if c.DB.Host == "" {
+		errs = append(errs, "db.host can't be empty")
+	}
+	if c.DB.Port < 1 || c.DB.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("db.port should be between 1 and 65535, got %d", c.DB.Port))
+	}
+	if c.DB.Username == "" {
+		errs = append(errs, "db.username can't be empty")
+	}
+	if c.DB.Name == "" {
+		errs = append(errs, "db.name can't be empty")
+	}
+	switch c.DB.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, fmt.Sprintf("db.sslmode is not a valid sslmode: %q", c.DB.SSLMode))
+	}
+	if c.DB.ConnectTimeout < time.Second {
+		errs = append(errs, "db.connect_timeout should be at least 1s")
+	}
+	if c.DB.MaxOpenConns < 0 {
+		errs = append(errs, "db.max_open_conns can't be negative")
+	}
+	if c.DB.MaxIdleConns < 0 {
+		errs = append(errs, "db.max_idle_conns can't be negative")
+	}
+	if c.DB.MaxOpenConns > 0 && c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		errs = append(errs, "db.max_idle_conns can't be greater than db.max_open_conns")
+	}
+	if c.DB.ConnMaxLifetime < 0 {
+		errs = append(errs, "db.conn_max_lifetime can't be negative")
+	}
+	if c.DB.ConnMaxIdleTime < 0 {
+		errs = append(errs, "db.conn_max_idle_time can't be negative")
+	}
+	if c.DB.MaxPoolWait < 0 {
+		errs = append(errs, "db.max_pool_wait can't be negative")
+	}
+	if c.DB.CloseTimeout <= 0 {
+		errs = append(errs, "db.close_timeout should be positive")
+	}
+
+	if c.Withdrawals.PayoutProvider != "fake" {
+		errs = append(errs, fmt.Sprintf("withdrawals.payout_provider is unknown: %q", c.Withdrawals.PayoutProvider))
+	}
+	if c.Withdrawals.MaxAttempts < 1 {
+		errs = append(errs, "withdrawals.max_attempts should be at least 1")
+	}
+
+	switch c.Outbox.Publisher {
+	case "stdout":
+	case "file":
+		if c.Outbox.FilePath == "" {
+			errs = append(errs, "outbox.file_path is required by the file publisher")
+		}
+	case "webhook":
+		if c.Outbox.WebhookURL == "" {
+			errs = append(errs, "outbox.webhook_url is required by the webhook publisher")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("outbox.publisher is unknown: %q", c.Outbox.Publisher))
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, "webhooks.max_attempts should be at least 1")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.OTLPEndpoint == "" {
+			errs = append(errs, "tracing.otlp_endpoint is required by the otlp exporter")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter is unknown: %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.FlushTimeout <= 0 {
+		errs = append(errs, "tracing.flush_timeout should be positive")
+	}
+
+	if c.Auth.JWKSFile != "" && c.Auth.JWKSURL != "" {
+		errs = append(errs, "auth.jwks_file and auth.jwks_url can't be both set")
+	}
+	if c.Auth.JWKSURL != "" {
+		if u, err := url.Parse(c.Auth.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("auth.jwks_url should be an absolute HTTP(S) URL, got %q", c.Auth.JWKSURL))
+		}
+	}
+	if c.Auth.JWKSRefreshInterval <= 0 {
+		errs = append(errs, "auth.jwks_refresh_interval should be positive")
+	}
+	if c.Auth.OwnerClaim == "" {
+		errs = append(errs, "auth.owner_claim can't be empty")
+	}
+
+	if c.Signing.MaxSkew <= 0 {
+		errs = append(errs, "signing.max_skew should be positive")
+	}
+	if c.Signing.NonceStore != "memory" && c.Signing.NonceStore != "postgres" {
+		errs = append(errs, fmt.Sprintf("signing.nonce_store should be memory or postgres, got %q", c.Signing.NonceStore))
+	}
+
+	if c.RateLimits.Store != "memory" && c.RateLimits.Store != "postgres" {
+		errs = append(errs, fmt.Sprintf("rate_limits.store should be memory or postgres, got %q", c.RateLimits.Store))
+	}
+	if c.RateLimits.ClientPerMinute < 0 {
+		errs = append(errs, "rate_limits.client_per_minute can't be negative")
+	} else if c.RateLimits.ClientPerMinute > 0 && c.RateLimits.ClientBurst < 1 {
+		errs = append(errs, "rate_limits.client_burst should be at least 1")
+	}
+	if c.RateLimits.WalletPerMinute < 0 {
+		errs = append(errs, "rate_limits.wallet_per_minute can't be negative")
+	} else if c.RateLimits.WalletPerMinute > 0 && c.RateLimits.WalletBurst < 1 {
+		errs = append(errs, "rate_limits.wallet_burst should be at least 1")
+	}
+	if c.RateLimits.IPPerMinute < 0 {
+		errs = append(errs, "rate_limits.ip_per_minute can't be negative")
+	} else if c.RateLimits.IPPerMinute > 0 && c.RateLimits.IPBurst < 1 {
+		errs = append(errs, "rate_limits.ip_burst should be at least 1")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with its secrets masked.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, v := range redacted.vars() {
+		if v.Secret && v.Value.String() != "" {
+			v.Value.Set("[REDACTED]")
+		}
+	}
+	return &redacted
+}
+
+func (c DBConfig) ConnString() string {
+	return ConnString(c.Host, strconv.Itoa(c.Port), c.Username, c.Password, c.Name, c.SSLMode) +
+		fmt.Sprintf(" connect_timeout=%d", int(c.ConnectTimeout.Seconds()))
+}
+
+const configUsage = `usage: config print [--redacted]`
+
+// RunConfig runs the `config` subcommand described by `args`.
+func RunConfig(cfg *Config, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New(configUsage)
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	redacted := fs.Bool("redacted", false, "mask secret values")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *redacted {
+		cfg = cfg.Redacted()
+	}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(cfg)
+}
+
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// deferredValue holds a flag's value until it's applied to its target.
+type deferredValue struct {
+	target flag.Value
+	raw    *string
+}
+
+func (d *deferredValue) String() string {
+	if d.raw == nil {
+		return ""
+	}
+	return *d.raw
+}
+
+func (d *deferredValue) Set(raw string) error {
+	d.raw = &raw
+	return nil
+}
+
+func (d *deferredValue) IsBoolFlag() bool {
+	_, ok := d.target.(*boolValue)
+	return ok
+}
+
+func (d *deferredValue) apply() error {
+	if d.raw == nil {
+		return nil
+	}
+	return d.target.Set(*d.raw)
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("should be an integer, got %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type uintValue uint64
+
+func (v *uintValue) String() string { return strconv.FormatUint(uint64(*v), 10) }
+func (v *uintValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("should be a non-negative integer, got %q", s)
+	}
+	*v = uintValue(n)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("should be true or false, got %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("should be a duration like 5s, got %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envFrom(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg, args, err := LoadConfig(nil, envFrom(nil))
+		assert.NoError(t, err)
+		assert.Empty(t, args)
+		assert.Equal(t, DefaultConfig(), cfg)
+	})
+
+	t.Run("flags over env over file over defaults", func(t *testing.T) {
+		path := writeTempFile(t, "config.yaml", `
+db:
+  host: from-file
+  port: 6000
+  name: from-file
+read_timeout: 10s
+`)
+		env := envFrom(map[string]string{
+			"CONFIG_FILE": path,
+			"DB_PORT":     "6001",
+			"DB_NAME":     "from-env",
+		})
+
+		cfg, args, err := LoadConfig([]string{"--db-name", "from-flag", "--auto-migrate", "migrate", "up"}, env)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"migrate", "up"}, args)
+		assert.Equal(t, "from-file", cfg.DB.Host)
+		assert.Equal(t, 6001, cfg.DB.Port)
+		assert.Equal(t, "from-flag", cfg.DB.Name)
+		assert.Equal(t, 10*time.Second, cfg.ReadTimeout)
+		assert.Equal(t, "postgres", cfg.DB.Username)
+		assert.True(t, cfg.AutoMigrate)
+	})
+
+	t.Run("reads secrets from _FILE paths", func(t *testing.T) {
+		path := writeTempFile(t, "password", "s3cr3t\n")
+		cfg, _, err := LoadConfig(nil, envFrom(map[string]string{
+			"DB_PASSWORD":      "ignored",
+			"DB_PASSWORD_FILE": path,
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, "s3cr3t", cfg.DB.Password)
+	})
+
+	t.Run("fails: unknown keys in the file", func(t *testing.T) {
+		path := writeTempFile(t, "config.yaml", `
+db:
+  max_pool_wiat: 2s
+rate_limit:
+  store: postgres
+`)
+		_, _, err := LoadConfig(nil, envFrom(map[string]string{"CONFIG_FILE": path}))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "field max_pool_wiat not found")
+			assert.Contains(t, err.Error(), "field rate_limit not found")
+		}
+	})
+
+	t.Run("an empty file leaves the defaults", func(t *testing.T) {
+		path := writeTempFile(t, "config.yaml", "")
+		cfg, _, err := LoadConfig(nil, envFrom(map[string]string{"CONFIG_FILE": path}))
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), cfg)
+	})
+
+	t.Run("fails: malformed values", func(t *testing.T) {
+		_, _, err := LoadConfig(nil, envFrom(map[string]string{"DB_PORT": "abc"}))
+		assert.EqualError(t, err, `invalid DB_PORT: should be an integer, got "abc"`)
+
+		_, _, err = LoadConfig([]string{"--shutdown-timeout", "12"}, envFrom(nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("fails: reports every invalid setting", func(t *testing.T) {
+		_, _, err := LoadConfig(nil, envFrom(map[string]string{
+			"LISTEN_ON":                "9000",
+			"LOG_LEVEL":                "verbose",
+			"SHUTDOWN_WORKERS_TIMEOUT": "0s",
+			"TLS_CLIENT_CA_FILE":       "/etc/wallets/ca.pem",
+			"TLS_MIN_VERSION":          "1.1",
+			"DB_SSLMODE":               "maybe",
+			"DB_MAX_OPEN_CONNS":        "5",
+			"OUTBOX_PUBLISHER":         "webhook",
+			"AUTH_JWKS_FILE":           "/etc/wallets/jwks.json",
+			"AUTH_JWKS_URL":            "jwks.json",
+			"SIGNING_NONCE_STORE":      "redis",
+			"RATE_LIMIT_WALLET_BURST":  "0",
+			"TRUSTED_PROXIES":          "10.0.0.0/8, proxy",
+		}))
+		var errs ConfigErrors
+		assert.True(t, errors.As(err, &errs))
+		assert.Equal(t, ConfigErrors{
+			`listen_on should be host:port, got "9000"`,
+			"workers_shutdown_timeout should be positive",
+			`log_level should be debug, info, warn or error, got "verbose"`,
+			`trusted_proxies should be a list of CIDR ranges, got "proxy"`,
+			"tls.client_ca_file requires tls.cert_file and tls.key_file",
+			`tls.min_version should be 1.2 or 1.3, got "1.1"`,
+			`db.sslmode is not a valid sslmode: "maybe"`,
+			"db.max_idle_conns can't be greater than db.max_open_conns",
+			"outbox.webhook_url is required by the webhook publisher",
+			"auth.jwks_file and auth.jwks_url can't be both set",
+			`auth.jwks_url should be an absolute HTTP(S) URL, got "jwks.json"`,
+			`signing.nonce_store should be memory or postgres, got "redis"`,
+			"rate_limits.wallet_burst should be at least 1",
+		}, errs)
+	})
+}
+
+func TestRunConfigPrint(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DB.Password = "s3cr3t"
+	cfg.Callbacks.LocalSecret = "local-s3cr3t"
+
+	var out bytes.Buffer
+	assert.NoError(t, RunConfig(cfg, []string{"print", "--redacted"}, &out))
+	assert.Contains(t, out.String(), "password: '[REDACTED]'")
+	assert.NotContains(t, out.String(), "s3cr3t")
+	assert.Contains(t, out.String(), `webhook_url: ""`)
+	assert.Equal(t, "s3cr3t", cfg.DB.Password)
+
+	out.Reset()
+	assert.NoError(t, RunConfig(cfg, []string{"print"}, &out))
+	assert.Contains(t, out.String(), "password: s3cr3t")
+
+	assert.Error(t, RunConfig(cfg, nil, &out))
+}
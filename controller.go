@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WalletServiceProvider interface {
-	Create(*Wallet) error
-	GetByID(uint) (*Wallet, error)
-	ChangeBalance(uint, *BalanceChange) error
+	Create(context.Context, *Wallet) error
+	GetByID(context.Context, uint) (*Wallet, error)
+	ChangeBalance(context.Context, uint, *BalanceChange) error
+	GetBalanceAt(context.Context, uint, time.Time) (*WalletBalance, error)
+	SetCreditLimit(context.Context, uint, uint64) (*Wallet, error)
 }
 
 type WalletController struct {
@@ -18,6 +23,9 @@ type WalletController struct {
 }
 
 func (h *WalletController) CreateWallet(c echo.Context) error {
+	ctx, span := startSpan(c.Request().Context(), "WalletController.CreateWallet")
+	defer span.End()
+
 	var req CreateWalletRequest
 	var w Wallet
 	if err := req.Bind(c, &w); err != nil {
@@ -28,9 +36,11 @@ func (h *WalletController) CreateWallet(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, err)
 	}
 
-	if err := h.walletService.Create(&w); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	if err := h.walletService.Create(ctx, &w); err != nil {
+		return internalError(c, err)
 	}
+	addLogField(c, "wallet_id", w.ID)
+	requestLogger(c).Info().Object("wallet", &w).Msg("wallet created")
 
 	return c.JSON(http.StatusCreated, w)
 }
@@ -38,14 +48,20 @@ func (h *WalletController) CreateWallet(c echo.Context) error {
 func (h *WalletController) GetWalletById(c echo.Context) error {
 	var id uint
 	echo.PathParamsBinder(c).Uint("id", &id)
+	addLogField(c, "wallet_id", id)
+	ctx, span := startSpan(c.Request().Context(), "WalletController.GetWalletById", trace.WithAttributes(walletIDAttribute(id)))
+	defer span.End()
 
-	w, err := h.walletService.GetByID(id)
+	w, err := h.walletService.GetByID(ctx, id)
 	if err != nil {
 		var err404 *ErrNotFound
 		if errors.As(err, &err404) {
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		return internalError(c, err)
+	}
+	if err := authorizeWallet(c, w); err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, w)
@@ -54,6 +70,9 @@ func (h *WalletController) GetWalletById(c echo.Context) error {
 func (h *WalletController) ChangeBalance(c echo.Context) error {
 	var id uint
 	echo.PathParamsBinder(c).Uint("id", &id)
+	addLogField(c, "wallet_id", id)
+	ctx, span := startSpan(c.Request().Context(), "WalletController.ChangeBalance", trace.WithAttributes(walletIDAttribute(id)))
+	defer span.End()
 
 	var req ChangeBalanceRequest
 	var bc BalanceChange
@@ -64,8 +83,24 @@ func (h *WalletController) ChangeBalance(c echo.Context) error {
 		}
 		return c.JSON(http.StatusBadRequest, err)
 	}
+	if !hasScope(c, balanceChangeScopes[bc.Operation]) {
+		return echo.NewHTTPError(http.StatusForbidden, missingScopeMessage)
+	}
+	if OwnerFromContext(ctx) != nil {
+		w, err := h.walletService.GetByID(ctx, id)
+		if err != nil {
+			var err404 *ErrNotFound
+			if errors.As(err, &err404) {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+			return internalError(c, err)
+		}
+		if err := authorizeWallet(c, w); err != nil {
+			return err
+		}
+	}
 
-	if err := h.walletService.ChangeBalance(id, &bc); err != nil {
+	if err := h.walletService.ChangeBalance(ctx, id, &bc); err != nil {
 		var err404 *ErrNotFound
 		if errors.As(err, &err404) {
 			return echo.NewHTTPError(http.StatusNotFound)
@@ -77,16 +112,93 @@ func (h *WalletController) ChangeBalance(c echo.Context) error {
 			valErr.Add("amount", "Insufficient balance to cover the deducted amount")
 			return c.JSON(http.StatusBadRequest, valErr.GetRespError())
 		}
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		return internalError(c, err)
 	}
+	addLogField(c, "balance_change_id", bc.ID)
 
 	return c.JSON(http.StatusCreated, bc)
 }
 
+func (h *WalletController) GetBalanceAt(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+	addLogField(c, "wallet_id", id)
+	ctx, span := startSpan(c.Request().Context(), "WalletController.GetBalanceAt", trace.WithAttributes(walletIDAttribute(id)))
+	defer span.End()
+
+	var req BalanceAtRequest
+	if err := req.Bind(c); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	wb, err := h.walletService.GetBalanceAt(ctx, id, req.At)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, wb)
+}
+
+func (h *WalletController) SetCreditLimit(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+	addLogField(c, "wallet_id", id)
+	ctx, span := startSpan(c.Request().Context(), "WalletController.SetCreditLimit", trace.WithAttributes(walletIDAttribute(id)))
+	defer span.End()
+
+	var req CreditLimitRequest
+	if err := req.Bind(c); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	w, err := h.walletService.SetCreditLimit(ctx, id, *req.CreditLimit)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		var errOverdraft *ErrCreditLimitBelowOverdraft
+		if errors.As(err, &errOverdraft) {
+			valErr := NewValidationErrors()
+			valErr.Add("credit_limit", errOverdraft.Error())
+			return c.JSON(http.StatusBadRequest, valErr.GetRespError())
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, w)
+}
+
+// balanceChangeScopes are the scopes each balance change operation needs.
+var balanceChangeScopes = map[string]string{
+	AddBalance:       ScopeBalanceCredit,
+	SubstractBalance: ScopeBalanceDebit,
+}
+
+// Register adds the routes, along with the scope each one needs. Balance
+// changes let in keys that can credit or debit, and the handler checks the
+// operation is allowed once the body is read. Credit limits let wallets spend
+// money they don't have, so only admins set them. Bearer tokens only get to
+// the wallets their owner owns.
 func (h *WalletController) Register(r *echo.Group) {
-	r.POST("", h.CreateWallet)
-	r.GET("/:id", h.GetWalletById)
-	r.POST("/:id/balance-changes", h.ChangeBalance)
+	r.POST("", h.CreateWallet, RequireScope(ScopeWalletsWrite))
+	r.GET("/:id", h.GetWalletById, RequireScopeOrOwner(ScopeWalletsRead))
+	r.POST("/:id/balance-changes", h.ChangeBalance, RequireScopeOrOwner(ScopeBalanceCredit, ScopeBalanceDebit))
+	r.GET("/:id/balance", h.GetBalanceAt, RequireScope(ScopeWalletsRead))
+	r.PUT("/:id/credit-limit", h.SetCreditLimit, RequireScope(ScopeAdmin))
 }
 
 func NewWalletController(ws WalletServiceProvider) *WalletController {
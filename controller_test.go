@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,25 +9,33 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
 type DummyWalletService struct {
-	ChangeBalanceCallsResults []error
+	ChangeBalanceCallsResults  []error
+	SetCreditLimitCallsResults []error
+	// Owners holds the owner of each wallet that has one.
+	Owners map[uint]string
 }
 
-func (s *DummyWalletService) Create(w *Wallet) error {
+func (s *DummyWalletService) Create(ctx context.Context, w *Wallet) error {
 	w.ID = 1
 	return nil
 }
 
-func (s *DummyWalletService) GetByID(id uint) (*Wallet, error) {
-	return &Wallet{ID: id}, nil
+func (s *DummyWalletService) GetByID(ctx context.Context, id uint) (*Wallet, error) {
+	w := Wallet{ID: id}
+	if owner, ok := s.Owners[id]; ok {
+		w.OwnerID = &owner
+	}
+	return &w, nil
 }
 
-func (s *DummyWalletService) ChangeBalance(wID uint, bc *BalanceChange) error {
+func (s *DummyWalletService) ChangeBalance(ctx context.Context, wID uint, bc *BalanceChange) error {
 	w := Wallet{ID: wID}
 	bc.Wallet = &w
 	bc.WalletID = w.ID
@@ -37,6 +46,19 @@ func (s *DummyWalletService) ChangeBalance(wID uint, bc *BalanceChange) error {
 	return err
 }
 
+func (s *DummyWalletService) GetBalanceAt(ctx context.Context, wID uint, at time.Time) (*WalletBalance, error) {
+	return &WalletBalance{WalletID: wID, At: at, Balance: 300}, nil
+}
+
+func (s *DummyWalletService) SetCreditLimit(ctx context.Context, wID uint, limit uint64) (*Wallet, error) {
+	err := s.SetCreditLimitCallsResults[0]
+	s.SetCreditLimitCallsResults = s.SetCreditLimitCallsResults[1:]
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{ID: wID, CreditLimit: limit}, nil
+}
+
 func TestWalletControllerCreate(t *testing.T) {
 	t.Run("Succeeds", func(t *testing.T) {
 		service := DummyWalletService{}
@@ -84,6 +106,49 @@ func TestWalletControllerCreate(t *testing.T) {
 	})
 }
 
+// asOwner authenticates `req` with a bearer token issued to `owner`,
+// granting `scopes`.
+func asOwner(req *http.Request, owner string, scopes ...string) *http.Request {
+	return req.WithContext(ContextWithOwner(req.Context(), &Owner{ID: owner, Scopes: scopes}))
+}
+
+func TestWalletControllerOwners(t *testing.T) {
+	service := DummyWalletService{
+		ChangeBalanceCallsResults: []error{nil},
+		Owners:                    map[uint]string{1: "player-1", 2: "player-2"},
+	}
+	e := echo.New()
+	NewWalletController(&service).Register(e.Group("/wallets"))
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		scopes []string
+		code   int
+	}{
+		{"reads own wallet", http.MethodGet, "/wallets/1", "", []string{ScopeWalletsRead}, http.StatusOK},
+		{"can't read someone else's wallet", http.MethodGet, "/wallets/2", "", []string{ScopeWalletsRead}, http.StatusForbidden},
+		{"can't read a wallet without owner", http.MethodGet, "/wallets/3", "", []string{ScopeWalletsRead}, http.StatusForbidden},
+		{"changes own wallet's balance", http.MethodPost, "/wallets/1/balance-changes", `{"operation": "SUBSTRACT", "amount": 100}`, []string{ScopeBalanceDebit}, http.StatusCreated},
+		{"can't change someone else's balance", http.MethodPost, "/wallets/2/balance-changes", `{"operation": "SUBSTRACT", "amount": 100}`, []string{ScopeBalanceDebit}, http.StatusForbidden},
+		{"can't credit without the scope", http.MethodPost, "/wallets/1/balance-changes", `{"operation": "ADD", "amount": 100}`, []string{ScopeBalanceDebit}, http.StatusForbidden},
+		{"can't set the credit limit", http.MethodPut, "/wallets/1/credit-limit", `{"credit_limit": 100}`, []string{ScopeWalletsRead, ScopeBalanceDebit}, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req = asOwner(req, "player-1", tc.scopes...)
+
+			resp := httptest.NewRecorder()
+			e.ServeHTTP(resp, req)
+			assert.Equal(t, tc.code, resp.Code)
+		})
+	}
+}
+
 func TestWalletControllerChangeBalance(t *testing.T) {
 	t.Run("Succeeds", func(t *testing.T) {
 		service := DummyWalletService{
@@ -101,6 +166,7 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, url,
 			strings.NewReader(string(jsonBc)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = withAPIKey(req, ScopeBalanceCredit)
 
 		e := echo.New()
 		resp := httptest.NewRecorder()
@@ -140,6 +206,7 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 				req := httptest.NewRequest(http.MethodPost, url,
 					strings.NewReader(string(jsonBc)))
 				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+				req = withAPIKey(req, ScopeBalanceCredit)
 
 				e := echo.New()
 				resp := httptest.NewRecorder()
@@ -151,6 +218,29 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		}
 	})
 
+	t.Run("HTTP 403 if the key can't make the operation", func(t *testing.T) {
+		service := DummyWalletService{}
+		ctrl := WalletController{walletService: &service}
+
+		cbr := ChangeBalanceRequest{Operation: "SUBSTRACT", Amount: 200}
+		jsonBc, err := json.Marshal(&cbr)
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/wallets/1/balance-changes",
+			strings.NewReader(string(jsonBc)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = withAPIKey(req, ScopeBalanceCredit)
+
+		e := echo.New()
+		resp := httptest.NewRecorder()
+		ctx := e.NewContext(req, resp)
+
+		err = ctrl.ChangeBalance(ctx)
+		var httpErr *echo.HTTPError
+		assert.True(t, errors.As(err, &httpErr))
+		assert.Equal(t, http.StatusForbidden, httpErr.Code)
+	})
+
 	t.Run("HTTP 400 if Wallet has insufficient balance", func(t *testing.T) {
 		service := DummyWalletService{
 			ChangeBalanceCallsResults: []error{&ErrInsufficientBalance{}},
@@ -167,6 +257,7 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, url,
 			strings.NewReader(string(jsonBc)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = withAPIKey(req, ScopeBalanceCredit)
 
 		e := echo.New()
 		resp := httptest.NewRecorder()
@@ -193,6 +284,7 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, url,
 			strings.NewReader(string(jsonBc)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = withAPIKey(req, ScopeBalanceCredit)
 
 		e := echo.New()
 		resp := httptest.NewRecorder()
@@ -221,6 +313,7 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, url,
 			strings.NewReader(string(jsonBc)))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = withAPIKey(req, ScopeBalanceCredit)
 
 		e := echo.New()
 		resp := httptest.NewRecorder()
@@ -233,3 +326,101 @@ func TestWalletControllerChangeBalance(t *testing.T) {
 		assert.Equal(t, http.StatusInternalServerError, httpErr.Code)
 	})
 }
+
+func TestWalletControllerGetBalanceAt(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		service := DummyWalletService{}
+		ctrl := WalletController{walletService: &service}
+
+		req := httptest.NewRequest(http.MethodGet, "/wallets/1/balance?at=2021-09-12T17:00:00Z", nil)
+
+		e := echo.New()
+		resp := httptest.NewRecorder()
+		ctx := e.NewContext(req, resp)
+		ctx.SetParamNames("id")
+		ctx.SetParamValues("1")
+
+		assert.NoError(t, ctrl.GetBalanceAt(ctx))
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var wb WalletBalance
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &wb))
+		assert.Equal(t, uint(1), wb.WalletID)
+		assert.Equal(t, int64(300), wb.Balance)
+		assert.True(t, wb.At.Equal(time.Date(2021, 9, 12, 17, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("HTTP 400 if at is missing or invalid", func(t *testing.T) {
+		for _, url := range []string{"/wallets/1/balance", "/wallets/1/balance?at=yesterday"} {
+			t.Run(url, func(t *testing.T) {
+				service := DummyWalletService{}
+				ctrl := WalletController{walletService: &service}
+
+				req := httptest.NewRequest(http.MethodGet, url, nil)
+
+				e := echo.New()
+				resp := httptest.NewRecorder()
+				ctx := e.NewContext(req, resp)
+				ctx.SetParamNames("id")
+				ctx.SetParamValues("1")
+
+				assert.NoError(t, ctrl.GetBalanceAt(ctx))
+				assert.Equal(t, http.StatusBadRequest, resp.Code)
+			})
+		}
+	})
+}
+
+func TestWalletControllerSetCreditLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   string
+		err    error
+		status int
+	}{
+		{"Succeeds", `{"credit_limit": 500}`, nil, http.StatusOK},
+		{"Succeeds removing the limit", `{"credit_limit": 0}`, nil, http.StatusOK},
+		{"HTTP 400 if credit_limit is missing", `{}`, nil, http.StatusBadRequest},
+		{"HTTP 400 if credit_limit doesn't fit a balance", `{"credit_limit": 9223372036854775808}`, nil, http.StatusBadRequest},
+		{"HTTP 400 if below the overdraft", `{"credit_limit": 10}`, &ErrCreditLimitBelowOverdraft{Overdraft: 20}, http.StatusBadRequest},
+		{"HTTP 404 if Wallet doesn't exist", `{"credit_limit": 500}`, &ErrNotFound{}, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			service := DummyWalletService{SetCreditLimitCallsResults: []error{tc.err}}
+			ctrl := WalletController{walletService: &service}
+
+			req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tc.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+			e := echo.New()
+			resp := httptest.NewRecorder()
+			ctx := e.NewContext(req, resp)
+			ctx.SetParamNames("id")
+			ctx.SetParamValues("1")
+
+			err := ctrl.SetCreditLimit(ctx)
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				assert.Equal(t, tc.status, httpErr.Code)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, resp.Code)
+		})
+	}
+
+	t.Run("HTTP 403 without the admin scope", func(t *testing.T) {
+		e := echo.New()
+		NewWalletController(&DummyWalletService{SetCreditLimitCallsResults: []error{nil}}).Register(e.Group("/wallets"))
+
+		for scope, status := range map[string]int{ScopeWalletsWrite: http.StatusForbidden, ScopeAdmin: http.StatusOK} {
+			req := httptest.NewRequest(http.MethodPut, "/wallets/1/credit-limit", strings.NewReader(`{"credit_limit": 500}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req = withAPIKey(req, scope)
+
+			resp := httptest.NewRecorder()
+			e.ServeHTTP(resp, req)
+			assert.Equal(t, status, resp.Code, scope)
+		}
+	})
+}
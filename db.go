@@ -7,18 +7,25 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func NewDB(host, port, username, password, dbname, sslmode string) (*sqlx.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+func ConnString(host, port, username, password, dbname, sslmode string) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		host, port, username, password, dbname, sslmode,
 	)
+}
 
+func NewDB(cfg DBConfig) (*sqlx.DB, error) {
 	db, err := sqlx.Connect(
 		"postgres",
-		connStr,
+		cfg.ConnString(),
 	)
 
 	if err != nil {
 		return nil, err
 	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 	return db, nil
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type DepositServiceProvider interface {
+	Create(context.Context, *Deposit) error
+	GetByID(uint) (*Deposit, error)
+	Transition(context.Context, uint, string) (*Deposit, error)
+	OpenDispute(context.Context, uint, *Dispute) error
+	ListDisputes(uint) ([]Dispute, error)
+	ResolveDispute(context.Context, uint, uint, string) (*Dispute, error)
+}
+
+type DepositController struct {
+	depositService DepositServiceProvider
+}
+
+func (h *DepositController) CreateDeposit(c echo.Context) error {
+	var req CreateDepositRequest
+	var d Deposit
+	if err := req.Bind(c, &d); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	addLogField(c, "wallet_id", d.WalletID)
+
+	if err := h.depositService.Create(c.Request().Context(), &d); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, d)
+}
+
+func (h *DepositController) GetDeposit(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	d, err := h.depositService.GetByID(id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, d)
+}
+
+func (h *DepositController) TransitionDeposit(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	var req DepositTransitionRequest
+	if err := req.Bind(c); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	d, err := h.depositService.Transition(c.Request().Context(), id, req.State)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		var errTransition *ErrInvalidTransition
+		if errors.As(err, &errTransition) {
+			return echo.NewHTTPError(http.StatusConflict, errTransition.Error())
+		}
+
+		var errInsBal *ErrInsufficientBalance
+		if errors.As(err, &errInsBal) {
+			valErr := NewValidationErrors()
+			valErr.Add("amount", "Insufficient balance to cover the deducted amount")
+			return c.JSON(http.StatusBadRequest, valErr.GetRespError())
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, d)
+}
+
+func (h *DepositController) OpenDispute(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	var req OpenDisputeRequest
+	var ds Dispute
+	if err := req.Bind(c, &ds); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	if err := h.depositService.OpenDispute(c.Request().Context(), id, &ds); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		var errTransition *ErrInvalidTransition
+		if errors.As(err, &errTransition) {
+			return echo.NewHTTPError(http.StatusConflict, errTransition.Error())
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, ds)
+}
+
+func (h *DepositController) ListDisputes(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	disputes, err := h.depositService.ListDisputes(id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, disputes)
+}
+
+func (h *DepositController) ResolveDispute(c echo.Context) error {
+	var id, disputeID uint
+	echo.PathParamsBinder(c).Uint("id", &id).Uint("dispute_id", &disputeID)
+
+	var req ResolveDisputeRequest
+	if err := req.Bind(c); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	ds, err := h.depositService.ResolveDispute(c.Request().Context(), id, disputeID, req.Outcome)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		var errTransition *ErrInvalidTransition
+		if errors.As(err, &errTransition) {
+			return echo.NewHTTPError(http.StatusConflict, errTransition.Error())
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, ds)
+}
+
+func (h *DepositController) Register(r *echo.Group) {
+	r.POST("", h.CreateDeposit, RequireScope(ScopeBalanceCredit))
+	r.GET("/:id", h.GetDeposit, RequireScope(ScopeWalletsRead))
+	r.POST("/:id/transitions", h.TransitionDeposit, RequireScope(ScopeBalanceCredit))
+	r.POST("/:id/disputes", h.OpenDispute, RequireScope(ScopeBalanceDebit))
+	r.GET("/:id/disputes", h.ListDisputes, RequireScope(ScopeWalletsRead))
+	r.POST("/:id/disputes/:dispute_id/resolve", h.ResolveDispute, RequireScope(ScopeBalanceDebit))
+}
+
+func NewDepositController(ds DepositServiceProvider) *DepositController {
+	return &DepositController{
+		depositService: ds,
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type DepositStorer interface {
+	Create(*Deposit, TxExecutor) error
+	GetByID(uint) (*Deposit, error)
+	LockAndGetByID(uint, TxExecutor) (*Deposit, error)
+	Update(*Deposit, TxExecutor) error
+	CreateDispute(*Dispute, TxExecutor) error
+	ListDisputes(uint) ([]Dispute, error)
+	LockAndGetDisputeByID(uint, TxExecutor) (*Dispute, error)
+	UpdateDispute(*Dispute, TxExecutor) error
+	CreateAuditEvent(context.Context, *AuditEvent, TxExecutor) error
+}
+
+type DepositWallets interface {
+	BeginTx(context.Context) (TxExecutor, error)
+	GetByID(context.Context, uint) (*Wallet, error)
+	ChangeBalanceTx(context.Context, TxExecutor, uint, *BalanceChange) error
+	ForceDebitTx(context.Context, TxExecutor, uint, *BalanceChange) error
+	AdjustPendingBalance(context.Context, TxExecutor, uint, int64) error
+}
+
+// depositTransitions lists the states every deposit state can move to.
+// Disputed deposits only move on when their dispute is resolved.
+var depositTransitions = map[string][]string{
+	DepositInitiated: {DepositPending, DepositCleared, DepositFailed},
+	DepositPending:   {DepositCleared, DepositFailed},
+	DepositCleared:   {DepositChargedBack},
+}
+
+// DepositService tracks funds coming into wallets from external providers.
+// Pending deposits show on the wallet's pending balance, and only become
+// spendable once they clear.
+type DepositService struct {
+	store   DepositStorer
+	wallets DepositWallets
+}
+
+func (s *DepositService) Create(ctx context.Context, d *Deposit) error {
+	if _, err := s.wallets.GetByID(ctx, d.WalletID); err != nil {
+		return err
+	}
+
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.State = DepositInitiated
+	if err := s.store.Create(d, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditDepositCreated, "deposit", d.ID, nil, d, ""); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *DepositService) GetByID(id uint) (*Deposit, error) {
+	d, err := s.store.GetByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// Transition moves the deposit to the `to` state, applying its effects on the
+// wallet. Moving a deposit to the state it's already in is a no-op.
+func (s *DepositService) Transition(ctx context.Context, id uint, to string) (*Deposit, error) {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := s.TransitionTx(ctx, tx, id, to)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// TransitionTx is Transition within `tx`, which keeps the deposit locked until
+// it's committed.
+func (s *DepositService) TransitionTx(ctx context.Context, tx TxExecutor, id uint, to string) (*Deposit, error) {
+	d, err := s.store.LockAndGetByID(id, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+
+	if err := s.transitionTx(ctx, tx, d, to); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (s *DepositService) transitionTx(ctx context.Context, tx TxExecutor, d *Deposit, to string) error {
+	if d.State == to {
+		return nil
+	}
+	if !canTransition(depositTransitions, d.State, to) {
+		return &ErrInvalidTransition{From: d.State, To: to}
+	}
+	before := *d
+
+	switch to {
+	case DepositPending:
+		if err := s.wallets.AdjustPendingBalance(ctx, tx, d.WalletID, int64(d.Amount)); err != nil {
+			return err
+		}
+
+	case DepositCleared:
+		if d.State == DepositPending {
+			if err := s.wallets.AdjustPendingBalance(ctx, tx, d.WalletID, -int64(d.Amount)); err != nil {
+				return err
+			}
+		}
+		bc := BalanceChange{
+			Operation: AddBalance,
+			Amount:    d.Amount,
+			Reference: fmt.Sprintf("deposit:%d", d.ID),
+		}
+		if err := s.wallets.ChangeBalanceTx(ctx, tx, d.WalletID, &bc); err != nil {
+			return err
+		}
+		d.ClearChangeID = &bc.ID
+
+	case DepositFailed:
+		if d.State == DepositPending {
+			if err := s.wallets.AdjustPendingBalance(ctx, tx, d.WalletID, -int64(d.Amount)); err != nil {
+				return err
+			}
+		}
+
+	case DepositChargedBack:
+		if err := s.chargeBackTx(ctx, tx, d); err != nil {
+			return err
+		}
+	}
+
+	d.State = to
+	if err := s.store.Update(d, tx); err != nil {
+		return err
+	}
+	return s.audit(ctx, tx, AuditDepositStateChanged, "deposit", d.ID, &before, d, "")
+}
+
+// audit records the change of the deposit, or dispute, `entityID` within
+// `tx`.
+func (s *DepositService) audit(ctx context.Context, tx TxExecutor, action, entityType string, entityID uint, before, after interface{}, reason string) error {
+	ev, err := NewAuditEvent(ctx, action, entityType, entityID, before, after, reason)
+	if err != nil {
+		return err
+	}
+	return s.store.CreateAuditEvent(ctx, ev, tx)
+}
+
+// chargeBackTx takes the deposited funds back. The customer may have spent
+// them already, so whatever the balance can't cover becomes debt.
+func (s *DepositService) chargeBackTx(ctx context.Context, tx TxExecutor, d *Deposit) error {
+	bc := BalanceChange{
+		Amount:    d.Amount,
+		Reference: fmt.Sprintf("deposit-chargeback:%d", d.ID),
+	}
+	if err := s.wallets.ForceDebitTx(ctx, tx, d.WalletID, &bc); err != nil {
+		return err
+	}
+	d.ChargebackChangeID = &bc.ID
+	return nil
+}
+
+// OpenDispute records that the payer disputed a cleared deposit. The funds
+// stay in the wallet until the dispute is resolved.
+func (s *DepositService) OpenDispute(ctx context.Context, depositID uint, ds *Dispute) error {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.openDisputeTx(ctx, tx, depositID, ds); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *DepositService) openDisputeTx(ctx context.Context, tx TxExecutor, depositID uint, ds *Dispute) error {
+	d, err := s.store.LockAndGetByID(depositID, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ErrNotFound{Inner: err}
+		}
+		return err
+	}
+
+	if d.State != DepositCleared {
+		return &ErrInvalidTransition{From: d.State, To: DepositDisputed}
+	}
+	before := *d
+	d.State = DepositDisputed
+	if err := s.store.Update(d, tx); err != nil {
+		return err
+	}
+	if err := s.audit(ctx, tx, AuditDepositStateChanged, "deposit", d.ID, &before, d, ""); err != nil {
+		return err
+	}
+
+	ds.DepositID = d.ID
+	ds.State = DisputeOpen
+	if err := s.store.CreateDispute(ds, tx); err != nil {
+		return err
+	}
+	return s.audit(ctx, tx, AuditDisputeOpened, "dispute", ds.ID, nil, ds, ds.Reason)
+}
+
+func (s *DepositService) ListDisputes(depositID uint) ([]Dispute, error) {
+	if _, err := s.GetByID(depositID); err != nil {
+		return nil, err
+	}
+	return s.store.ListDisputes(depositID)
+}
+
+// ResolveDispute closes an open dispute. A won dispute clears the deposit
+// again, while a lost one charges it back. Resolving a dispute with the
+// outcome it already has is a no-op.
+func (s *DepositService) ResolveDispute(ctx context.Context, depositID, disputeID uint, outcome string) (*Dispute, error) {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := s.resolveDisputeTx(ctx, tx, depositID, disputeID, outcome)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+func (s *DepositService) resolveDisputeTx(ctx context.Context, tx TxExecutor, depositID, disputeID uint, outcome string) (*Dispute, error) {
+	d, err := s.store.LockAndGetByID(depositID, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+
+	ds, err := s.store.LockAndGetDisputeByID(disputeID, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+	if ds.DepositID != d.ID {
+		return nil, &ErrNotFound{}
+	}
+
+	if ds.State == outcome {
+		return ds, nil
+	}
+	if ds.State != DisputeOpen {
+		return nil, &ErrInvalidTransition{From: ds.State, To: outcome}
+	}
+	before, dsBefore := *d, *ds
+
+	switch outcome {
+	case DisputeWon:
+		d.State = DepositCleared
+	case DisputeLost:
+		if err := s.chargeBackTx(ctx, tx, d); err != nil {
+			return nil, err
+		}
+		d.State = DepositChargedBack
+		ds.ChargebackChangeID = d.ChargebackChangeID
+	default:
+		return nil, &ErrInvalidTransition{From: ds.State, To: outcome}
+	}
+
+	if err := s.store.Update(d, tx); err != nil {
+		return nil, err
+	}
+	if err := s.audit(ctx, tx, AuditDepositStateChanged, "deposit", d.ID, &before, d, ""); err != nil {
+		return nil, err
+	}
+
+	ds.State = outcome
+	if err := s.store.UpdateDispute(ds, tx); err != nil {
+		return nil, err
+	}
+	if err := s.audit(ctx, tx, AuditDisputeResolved, "dispute", ds.ID, &dsBefore, ds, ""); err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+func NewDepositService(store DepositStorer, wallets DepositWallets) *DepositService {
+	return &DepositService{
+		store:   store,
+		wallets: wallets,
+	}
+}
+
+func canTransition(transitions map[string][]string, from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+type ErrInvalidTransition struct {
+	From string
+	To   string
+}
+
+func (e *ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("Can't transition from %s to %s", e.From, e.To)
+}
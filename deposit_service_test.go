@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyDepositStore struct {
+	Deposit            *Deposit
+	Dispute            *Dispute
+	UpdateCalls        []Deposit
+	UpdateDisputeCalls []Dispute
+	AuditEvents        []*AuditEvent
+}
+
+func (s *DummyDepositStore) Create(d *Deposit, tx TxExecutor) error {
+	d.ID = 1
+	return nil
+}
+
+func (s *DummyDepositStore) GetByID(id uint) (*Deposit, error) {
+	return s.Deposit, nil
+}
+
+func (s *DummyDepositStore) LockAndGetByID(id uint, tx TxExecutor) (*Deposit, error) {
+	return s.Deposit, nil
+}
+
+func (s *DummyDepositStore) Update(d *Deposit, tx TxExecutor) error {
+	s.UpdateCalls = append(s.UpdateCalls, *d)
+	return nil
+}
+
+func (s *DummyDepositStore) CreateDispute(ds *Dispute, tx TxExecutor) error {
+	ds.ID = 1
+	return nil
+}
+
+func (s *DummyDepositStore) ListDisputes(depositID uint) ([]Dispute, error) {
+	return nil, nil
+}
+
+func (s *DummyDepositStore) LockAndGetDisputeByID(id uint, tx TxExecutor) (*Dispute, error) {
+	return s.Dispute, nil
+}
+
+func (s *DummyDepositStore) UpdateDispute(ds *Dispute, tx TxExecutor) error {
+	s.UpdateDisputeCalls = append(s.UpdateDisputeCalls, *ds)
+	return nil
+}
+
+func (s *DummyDepositStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	s.AuditEvents = append(s.AuditEvents, ev)
+	return nil
+}
+
+type DummyDepositWallets struct {
+	Tx                        *DummyTx
+	ChangeBalanceTxCalls      []BalanceChange
+	ForceDebitTxCalls         []BalanceChange
+	AdjustPendingBalanceCalls []int64
+}
+
+func (w *DummyDepositWallets) BeginTx(ctx context.Context) (TxExecutor, error) {
+	return w.Tx, nil
+}
+
+func (w *DummyDepositWallets) GetByID(ctx context.Context, id uint) (*Wallet, error) {
+	return &Wallet{ID: id}, nil
+}
+
+func (w *DummyDepositWallets) ChangeBalanceTx(ctx context.Context, tx TxExecutor, wID uint, bc *BalanceChange) error {
+	bc.ID = 7
+	w.ChangeBalanceTxCalls = append(w.ChangeBalanceTxCalls, *bc)
+	return nil
+}
+
+func (w *DummyDepositWallets) ForceDebitTx(ctx context.Context, tx TxExecutor, wID uint, bc *BalanceChange) error {
+	bc.ID = 8
+	bc.Operation = SubstractBalance
+	w.ForceDebitTxCalls = append(w.ForceDebitTxCalls, *bc)
+	return nil
+}
+
+func (w *DummyDepositWallets) AdjustPendingBalance(ctx context.Context, tx TxExecutor, wID uint, delta int64) error {
+	w.AdjustPendingBalanceCalls = append(w.AdjustPendingBalanceCalls, delta)
+	return nil
+}
+
+func TestDepositServiceCreate(t *testing.T) {
+	tx := DummyTx{}
+	store := DummyDepositStore{}
+	wallets := DummyDepositWallets{Tx: &tx}
+	service := NewDepositService(&store, &wallets)
+
+	d := Deposit{WalletID: 1, Amount: 300}
+	assert.NoError(t, service.Create(context.Background(), &d))
+	assert.Equal(t, DepositInitiated, d.State)
+	assert.Equal(t, len(tx.CommitCalls), 1)
+
+	if assert.Len(t, store.AuditEvents, 1) {
+		ev := store.AuditEvents[0]
+		assert.Equal(t, AuditDepositCreated, ev.Action)
+		assert.Equal(t, uint(1), ev.EntityID)
+	}
+}
+
+func TestDepositServiceTransition(t *testing.T) {
+	t.Run("pending adds to the pending balance", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositInitiated}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		d, err := service.Transition(context.Background(), 1, DepositPending)
+		assert.NoError(t, err)
+		assert.Equal(t, DepositPending, d.State)
+		assert.Equal(t, []int64{300}, wallets.AdjustPendingBalanceCalls)
+		assert.Empty(t, wallets.ChangeBalanceTxCalls)
+		assert.Equal(t, len(tx.CommitCalls), 1)
+
+		if assert.Len(t, store.AuditEvents, 1) {
+			ev := store.AuditEvents[0]
+			assert.Equal(t, AuditDepositStateChanged, ev.Action)
+			assert.JSONEq(t, `{"state":{"before":"initiated","after":"pending"}}`, string(ev.Diff))
+		}
+	})
+
+	t.Run("cleared moves the pending funds to the balance", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositPending}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		d, err := service.Transition(context.Background(), 1, DepositCleared)
+		assert.NoError(t, err)
+		assert.Equal(t, DepositCleared, d.State)
+		assert.Equal(t, []int64{-300}, wallets.AdjustPendingBalanceCalls)
+		assert.Equal(t, 1, len(wallets.ChangeBalanceTxCalls))
+		assert.Equal(t, AddBalance, wallets.ChangeBalanceTxCalls[0].Operation)
+		assert.Equal(t, "deposit:1", wallets.ChangeBalanceTxCalls[0].Reference)
+		assert.Equal(t, uint(7), *d.ClearChangeID)
+		assert.Equal(t, len(tx.CommitCalls), 1)
+	})
+
+	t.Run("failed releases the pending funds", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositPending}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		d, err := service.Transition(context.Background(), 1, DepositFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, DepositFailed, d.State)
+		assert.Equal(t, []int64{-300}, wallets.AdjustPendingBalanceCalls)
+		assert.Empty(t, wallets.ChangeBalanceTxCalls)
+	})
+
+	t.Run("charged_back debits the wallet, even into debt", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositCleared}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		d, err := service.Transition(context.Background(), 1, DepositChargedBack)
+		assert.NoError(t, err)
+		assert.Equal(t, DepositChargedBack, d.State)
+		assert.Empty(t, wallets.ChangeBalanceTxCalls)
+		assert.Equal(t, 1, len(wallets.ForceDebitTxCalls))
+		assert.Equal(t, "deposit-chargeback:1", wallets.ForceDebitTxCalls[0].Reference)
+		assert.Equal(t, uint(8), *d.ChargebackChangeID)
+	})
+
+	t.Run("moving to the current state is a no-op", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositCleared}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		_, err := service.Transition(context.Background(), 1, DepositCleared)
+		assert.NoError(t, err)
+		assert.Empty(t, wallets.ChangeBalanceTxCalls)
+		assert.Empty(t, store.UpdateCalls)
+		assert.Empty(t, store.AuditEvents)
+	})
+
+	t.Run("fails: ErrInvalidTransition", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositCleared}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		_, err := service.Transition(context.Background(), 1, DepositPending)
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+		assert.Empty(t, wallets.AdjustPendingBalanceCalls)
+		assert.Equal(t, len(tx.CommitCalls), 0)
+		assert.Equal(t, len(tx.RollbackCalls), 1)
+	})
+}
+
+func TestDepositServiceDisputes(t *testing.T) {
+	t.Run("opening a dispute marks the deposit as disputed", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositCleared}}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		ds := Dispute{Reason: "fraudulent"}
+		assert.NoError(t, service.OpenDispute(context.Background(), 1, &ds))
+		assert.Equal(t, DisputeOpen, ds.State)
+		assert.Equal(t, uint(1), ds.DepositID)
+		assert.Equal(t, DepositDisputed, store.UpdateCalls[0].State)
+		assert.Equal(t, len(tx.CommitCalls), 1)
+
+		if assert.Len(t, store.AuditEvents, 2) {
+			assert.Equal(t, AuditDepositStateChanged, store.AuditEvents[0].Action)
+			assert.Equal(t, AuditDisputeOpened, store.AuditEvents[1].Action)
+			assert.Equal(t, "fraudulent", *store.AuditEvents[1].Reason)
+		}
+	})
+
+	t.Run("fails: ErrInvalidTransition if the deposit isn't cleared", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositPending}}
+		service := NewDepositService(&store, &DummyDepositWallets{Tx: &tx})
+
+		err := service.OpenDispute(context.Background(), 1, &Dispute{Reason: "fraudulent"})
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+		assert.Equal(t, len(tx.RollbackCalls), 1)
+	})
+
+	t.Run("disputed deposits can't be transitioned directly", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositDisputed}}
+		service := NewDepositService(&store, &DummyDepositWallets{Tx: &tx})
+
+		_, err := service.Transition(context.Background(), 1, DepositCleared)
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+	})
+
+	t.Run("a won dispute clears the deposit again", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{
+			Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositDisputed},
+			Dispute: &Dispute{ID: 2, DepositID: 1, State: DisputeOpen},
+		}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		ds, err := service.ResolveDispute(context.Background(), 1, 2, DisputeWon)
+		assert.NoError(t, err)
+		assert.Equal(t, DisputeWon, ds.State)
+		assert.Equal(t, DepositCleared, store.UpdateCalls[0].State)
+		assert.Empty(t, wallets.ForceDebitTxCalls)
+	})
+
+	t.Run("a lost dispute charges the deposit back", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{
+			Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositDisputed},
+			Dispute: &Dispute{ID: 2, DepositID: 1, State: DisputeOpen},
+		}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		ds, err := service.ResolveDispute(context.Background(), 1, 2, DisputeLost)
+		assert.NoError(t, err)
+		assert.Equal(t, DisputeLost, ds.State)
+		assert.Equal(t, uint(8), *ds.ChargebackChangeID)
+		assert.Equal(t, DepositChargedBack, store.UpdateCalls[0].State)
+		assert.Equal(t, 1, len(wallets.ForceDebitTxCalls))
+		assert.Equal(t, uint64(300), wallets.ForceDebitTxCalls[0].Amount)
+	})
+
+	t.Run("resolving with the current outcome is a no-op", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{
+			Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositChargedBack},
+			Dispute: &Dispute{ID: 2, DepositID: 1, State: DisputeLost},
+		}
+		wallets := DummyDepositWallets{Tx: &tx}
+		service := NewDepositService(&store, &wallets)
+
+		_, err := service.ResolveDispute(context.Background(), 1, 2, DisputeLost)
+		assert.NoError(t, err)
+		assert.Empty(t, wallets.ForceDebitTxCalls)
+		assert.Empty(t, store.UpdateDisputeCalls)
+
+		_, err = service.ResolveDispute(context.Background(), 1, 2, DisputeWon)
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+	})
+
+	t.Run("fails: ErrNotFound if the dispute is for another deposit", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyDepositStore{
+			Deposit: &Deposit{ID: 1, WalletID: 1, Amount: 300, State: DepositDisputed},
+			Dispute: &Dispute{ID: 2, DepositID: 5, State: DisputeOpen},
+		}
+		service := NewDepositService(&store, &DummyDepositWallets{Tx: &tx})
+
+		_, err := service.ResolveDispute(context.Background(), 1, 2, DisputeLost)
+		var err404 *ErrNotFound
+		assert.True(t, errors.As(err, &err404))
+	})
+}
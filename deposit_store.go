@@ -0,0 +1,132 @@
+package main
+
+import "context"
+
+type DepositStore struct {
+	db DbExecutor
+}
+
+func (s *DepositStore) Create(d *Deposit, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`INSERT INTO deposits
+		(wallet_id, amount, state, provider_reference)
+		VALUES (:wallet_id,:amount,:state,:provider_reference)
+		RETURNING id, created_at, updated_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(d, d); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DepositStore) GetByID(id uint) (*Deposit, error) {
+	var d Deposit
+	stm := `SELECT * FROM deposits WHERE id=$1`
+	if err := s.db.Get(&d, stm, id); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (s *DepositStore) LockAndGetByID(id uint, tx TxExecutor) (*Deposit, error) {
+	var d Deposit
+	fetchDeposit := `SELECT * FROM deposits WHERE id=$1 FOR UPDATE`
+	if err := tx.Get(&d, fetchDeposit, id); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (s *DepositStore) Update(d *Deposit, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`UPDATE deposits
+		SET state=:state, clear_change_id=:clear_change_id,
+			chargeback_change_id=:chargeback_change_id, updated_at=current_timestamp
+		WHERE id=:id
+		RETURNING updated_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(d, d); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DepositStore) CreateDispute(ds *Dispute, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`INSERT INTO disputes
+		(deposit_id, state, reason)
+		VALUES (:deposit_id,:state,:reason)
+		RETURNING id, created_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(ds, ds); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DepositStore) ListDisputes(depositID uint) ([]Dispute, error) {
+	disputes := []Dispute{}
+	stm := `SELECT * FROM disputes WHERE deposit_id=$1 ORDER BY id`
+	if err := s.db.Select(&disputes, stm, depositID); err != nil {
+		return nil, err
+	}
+
+	return disputes, nil
+}
+
+func (s *DepositStore) LockAndGetDisputeByID(id uint, tx TxExecutor) (*Dispute, error) {
+	var ds Dispute
+	fetchDispute := `SELECT * FROM disputes WHERE id=$1 FOR UPDATE`
+	if err := tx.Get(&ds, fetchDispute, id); err != nil {
+		return nil, err
+	}
+
+	return &ds, nil
+}
+
+func (s *DepositStore) UpdateDispute(ds *Dispute, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`UPDATE disputes
+		SET state=:state, chargeback_change_id=:chargeback_change_id, resolved_at=current_timestamp
+		WHERE id=:id
+		RETURNING resolved_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(ds, ds); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *DepositStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "DepositStore.CreateAuditEvent", "insert_audit_event")
+	defer span.End()
+
+	if err := insertAuditEvent(tx, ev); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func NewDepositStore(db DbExecutor) *DepositStore {
+	return &DepositStore{
+		db: db,
+	}
+}
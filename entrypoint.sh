@@ -1,9 +1,4 @@
 #!/bin/sh
 
-echo "Running schema migrations..."
-go-migrate \
-    -source file://migrations \
-    -database postgres://"$DB_USERNAME":"$DB_PASSWORD"@"$DB_HOST":"$DB_PORT"/"$DB_NAME"?sslmode="$DB_SSLMODE" up
-
 echo "Starting API..."
-exec ./api
\ No newline at end of file
+exec ./api --auto-migrate
\ No newline at end of file
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	CloudEventsContentType = "application/cloudevents+json"
+	EventSource            = "/wallets-service"
+
+	schemaBaseURI = "https://github.com/lalvarezguillen/bluelabs-wallets-service/blob/main/schemas/"
+)
+
+// CloudEvent is the envelope of every event the service emits, following the
+// structured JSON mode of CloudEvents 1.0. `dataschema` points to the JSON
+// Schema, and version, of `data`. Schemas reject unknown properties, so any
+// change to `data` must bump it, and published schemas are never edited.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	DataSchema      string          `json:"dataschema"`
+	Data            json.RawMessage `json:"data"`
+}
+
+type WalletCreatedData struct {
+	WalletID  uint      `json:"wallet_id"`
+	Name      string    `json:"name"`
+	Balance   int64     `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewWalletCreatedData(w *Wallet) *WalletCreatedData {
+	return &WalletCreatedData{
+		WalletID:  w.ID,
+		Name:      w.Name,
+		Balance:   w.Balance,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+type BalanceChangedData struct {
+	BalanceChangeID uint      `json:"balance_change_id"`
+	WalletID        uint      `json:"wallet_id"`
+	Operation       string    `json:"operation"`
+	Amount          uint64    `json:"amount"`
+	BalanceBefore   int64     `json:"balance_before"`
+	BalanceAfter    int64     `json:"balance_after"`
+	DebtBefore      uint64    `json:"debt_before,omitempty"`
+	DebtAfter       uint64    `json:"debt_after,omitempty"`
+	Reference       string    `json:"reference,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func NewBalanceChangedData(bc *BalanceChange) *BalanceChangedData {
+	return &BalanceChangedData{
+		BalanceChangeID: bc.ID,
+		WalletID:        bc.WalletID,
+		Operation:       bc.Operation,
+		Amount:          bc.Amount,
+		BalanceBefore:   bc.BalanceBefore,
+		BalanceAfter:    bc.BalanceAfter,
+		DebtBefore:      bc.DebtBefore,
+		DebtAfter:       bc.DebtAfter,
+		Reference:       bc.Reference,
+		CreatedAt:       bc.CreatedAt,
+	}
+}
+
+type LowBalanceData struct {
+	WalletID  uint   `json:"wallet_id"`
+	Balance   int64  `json:"balance"`
+	Threshold uint64 `json:"threshold"`
+}
+
+type eventSchema struct {
+	Version int
+	Data    interface{}
+}
+
+// eventSchemas maps every event type to the current version of its data.
+var eventSchemas = map[string]eventSchema{
+	EventWalletCreated:  {Version: 2, Data: WalletCreatedData{}},
+	EventBalanceChanged: {Version: 2, Data: BalanceChangedData{}},
+	EventLowBalance:     {Version: 2, Data: LowBalanceData{}},
+}
+
+func DataSchemaURI(eventType string, version int) string {
+	return fmt.Sprintf("%s%s/v%d.json", schemaBaseURI, eventType, version)
+}
+
+func NewCloudEvent(eventType string, walletID uint, data interface{}) (*CloudEvent, error) {
+	schema, ok := eventSchemas[eventType]
+	if !ok {
+		return nil, fmt.Errorf("unknown event type: %s", eventType)
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              id,
+		Source:          EventSource,
+		Type:            eventType,
+		Subject:         fmt.Sprintf("wallets/%d", walletID),
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		DataSchema:      DataSchemaURI(eventType, schema.Version),
+		Data:            encoded,
+	}, nil
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type jsonSchema struct {
+	ID         string `json:"$id"`
+	Properties map[string]struct {
+		Type   string `json:"type"`
+		Format string `json:"format"`
+	} `json:"properties"`
+	Required             []string `json:"required"`
+	AdditionalProperties *bool    `json:"additionalProperties"`
+}
+
+// jsonSchemaType maps a Go type to the JSON Schema type and format it's
+// expected to be published as.
+func jsonSchemaType(t reflect.Type) (string, string) {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "string", "date-time"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string", ""
+	case reflect.Bool:
+		return "boolean", ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer", ""
+	case reflect.Float32, reflect.Float64:
+		return "number", ""
+	}
+	return t.Kind().String(), ""
+}
+
+func TestEventSchemasMatchGoTypes(t *testing.T) {
+	for eventType, schema := range eventSchemas {
+		path := filepath.Join("schemas", eventType, fmt.Sprintf("v%d.json", schema.Version))
+		t.Run(path, func(t *testing.T) {
+			raw, err := ioutil.ReadFile(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var js jsonSchema
+			if !assert.NoError(t, json.Unmarshal(raw, &js)) {
+				return
+			}
+
+			assert.Equal(t, DataSchemaURI(eventType, schema.Version), js.ID)
+			assert.NotNil(t, js.AdditionalProperties)
+			assert.False(t, *js.AdditionalProperties)
+
+			var fields, required []string
+			dataType := reflect.TypeOf(schema.Data)
+			for i := 0; i < dataType.NumField(); i++ {
+				f := dataType.Field(i)
+				tag := strings.Split(f.Tag.Get("json"), ",")
+				fields = append(fields, tag[0])
+				if len(tag) < 2 || tag[1] != "omitempty" {
+					required = append(required, tag[0])
+				}
+
+				prop, ok := js.Properties[tag[0]]
+				if !assert.True(t, ok, "%s is missing from the schema", tag[0]) {
+					continue
+				}
+				typ, format := jsonSchemaType(f.Type)
+				assert.Equal(t, typ, prop.Type, "type of %s", tag[0])
+				assert.Equal(t, format, prop.Format, "format of %s", tag[0])
+			}
+
+			var properties []string
+			for name := range js.Properties {
+				properties = append(properties, name)
+			}
+			sort.Strings(fields)
+			sort.Strings(properties)
+			sort.Strings(required)
+			sort.Strings(js.Required)
+			assert.Equal(t, fields, properties)
+			assert.Equal(t, required, js.Required)
+		})
+	}
+}
+
+func TestNewCloudEvent(t *testing.T) {
+	ce, err := NewCloudEvent(EventBalanceChanged, 1, NewBalanceChangedData(&BalanceChange{ID: 4, WalletID: 1}))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "1.0", ce.SpecVersion)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, ce.ID)
+	assert.Equal(t, EventBalanceChanged, ce.Type)
+	assert.Equal(t, "wallets/1", ce.Subject)
+	assert.Equal(t, DataSchemaURI(EventBalanceChanged, 2), ce.DataSchema)
+
+	var data BalanceChangedData
+	assert.NoError(t, json.Unmarshal(ce.Data, &data))
+	assert.Equal(t, uint(4), data.BalanceChangeID)
+
+	_, err = NewCloudEvent("wallet.unknown", 1, nil)
+	assert.Error(t, err)
+}
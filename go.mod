@@ -1,10 +1,21 @@
 module github.com/lalvarezguillen/bluelabs-wallets-service
 
-go 1.15
+go 1.16
 
 require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/golang-migrate/migrate/v4 v4.15.2
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/labstack/echo/v4 v4.5.0
-	github.com/lib/pq v1.8.0
-	github.com/stretchr/testify v1.6.1
+	github.com/lib/pq v1.10.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/rs/zerolog v1.26.1
+	github.com/stretchr/testify v1.7.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
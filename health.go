@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+type HealthStorer interface {
+	Ping(context.Context) error
+	SchemaVersion(context.Context) (uint, bool, error)
+	PoolStats() sql.DBStats
+}
+
+// HealthController serves the liveness and readiness probes. The service is
+// ready to take traffic while it can reach the DB, the DB schema is at least
+// at the version the binary expects, and it isn't shutting down.
+type HealthController struct {
+	store           HealthStorer
+	requiredVersion uint
+	draining        int32
+}
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type MigrationsCheck struct {
+	HealthCheck
+	Version  uint `json:"version"`
+	Required uint `json:"required"`
+	Dirty    bool `json:"dirty"`
+}
+
+type PoolCheck struct {
+	MaxOpen      int           `json:"max_open"`
+	Open         int           `json:"open"`
+	InUse        int           `json:"in_use"`
+	Idle         int           `json:"idle"`
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration_ns"`
+}
+
+type Readiness struct {
+	Status     string          `json:"status"`
+	Draining   bool            `json:"draining"`
+	Database   HealthCheck     `json:"database"`
+	Migrations MigrationsCheck `json:"migrations"`
+	Pool       PoolCheck       `json:"pool"`
+}
+
+const (
+	HealthOK       = "ok"
+	HealthFailing  = "failing"
+	HealthReady    = "ready"
+	HealthNotReady = "not_ready"
+)
+
+// Liveness only tells the process is up and serving requests. It doesn't
+// depend on the DB, so an unreachable DB doesn't get the process restarted.
+func (h *HealthController) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthCheck{Status: HealthOK})
+}
+
+func (h *HealthController) Readiness(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	r := Readiness{
+		Draining:   h.Draining(),
+		Database:   HealthCheck{Status: HealthOK},
+		Migrations: MigrationsCheck{HealthCheck: HealthCheck{Status: HealthOK}, Required: h.requiredVersion},
+		Pool:       poolCheck(h.store.PoolStats()),
+	}
+
+	if err := h.store.Ping(ctx); err != nil {
+		r.Database = HealthCheck{Status: HealthFailing, Error: err.Error()}
+	} else if err := h.checkMigrations(ctx, &r.Migrations); err != nil {
+		r.Migrations.Status = HealthFailing
+		r.Migrations.Error = err.Error()
+	}
+
+	status := http.StatusOK
+	r.Status = HealthReady
+	if r.Draining || r.Database.Status != HealthOK || r.Migrations.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+		r.Status = HealthNotReady
+	}
+	return c.JSON(status, r)
+}
+
+// checkMigrations fails if the schema is older than the binary expects, or a
+// migration failed halfway. A newer schema is fine, since migrations are
+// applied before the previous release is gone.
+func (h *HealthController) checkMigrations(ctx context.Context, m *MigrationsCheck) error {
+	version, dirty, err := h.store.SchemaVersion(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("no migrations applied")
+	}
+	if err != nil {
+		return err
+	}
+
+	m.Version = version
+	m.Dirty = dirty
+	if dirty {
+		return fmt.Errorf("migration %d failed halfway", version)
+	}
+	if version < h.requiredVersion {
+		return fmt.Errorf("schema is at version %d, but %d is required", version, h.requiredVersion)
+	}
+	return nil
+}
+
+func poolCheck(stats sql.DBStats) PoolCheck {
+	return PoolCheck{
+		MaxOpen:      stats.MaxOpenConnections,
+		Open:         stats.OpenConnections,
+		InUse:        stats.InUse,
+		Idle:         stats.Idle,
+		WaitCount:    stats.WaitCount,
+		WaitDuration: stats.WaitDuration,
+	}
+}
+
+// Drain marks the service as not ready, so load balancers stop sending it new
+// requests before it shuts down.
+func (h *HealthController) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+func (h *HealthController) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+func (h *HealthController) Register(e *echo.Echo) {
+	e.GET("/healthz", h.Liveness)
+	e.GET("/readyz", h.Readiness)
+}
+
+// NewHealthController builds a HealthController. The DB schema needs to be at
+// least at `requiredVersion` for the service to be ready.
+func NewHealthController(store HealthStorer, requiredVersion uint) *HealthController {
+	return &HealthController{
+		store:           store,
+		requiredVersion: requiredVersion,
+	}
+}
+
+type HealthStore struct {
+	db *sqlx.DB
+}
+
+func (s *HealthStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// SchemaVersion reads the version of the last migration applied, from the
+// table golang-migrate keeps it in.
+func (s *HealthStore) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	var v struct {
+		Version uint `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+	if err := s.db.GetContext(ctx, &v, `SELECT version, dirty FROM schema_migrations LIMIT 1`); err != nil {
+		return 0, false, err
+	}
+	return v.Version, v.Dirty, nil
+}
+
+func (s *HealthStore) PoolStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func NewHealthStore(db *sqlx.DB) *HealthStore {
+	return &HealthStore{
+		db: db,
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyHealthStore struct {
+	PingErr       error
+	Version       uint
+	Dirty         bool
+	VersionErr    error
+	Stats         sql.DBStats
+	VersionCalled bool
+}
+
+func (s *DummyHealthStore) Ping(ctx context.Context) error {
+	return s.PingErr
+}
+
+func (s *DummyHealthStore) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	s.VersionCalled = true
+	return s.Version, s.Dirty, s.VersionErr
+}
+
+func (s *DummyHealthStore) PoolStats() sql.DBStats {
+	return s.Stats
+}
+
+func getReadiness(t *testing.T, h *HealthController) (int, Readiness) {
+	e := echo.New()
+	h.Register(e)
+
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var r Readiness
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &r))
+	return resp.Code, r
+}
+
+func TestHealthControllerLiveness(t *testing.T) {
+	e := echo.New()
+	NewHealthController(&DummyHealthStore{PingErr: errors.New("connection refused")}, 1).Register(e)
+
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, resp.Body.String())
+}
+
+func TestHealthControllerReadiness(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		store := DummyHealthStore{
+			Version: 20261019180000,
+			Stats:   sql.DBStats{MaxOpenConnections: 20, OpenConnections: 3, InUse: 1, Idle: 2},
+		}
+		code, r := getReadiness(t, NewHealthController(&store, 20261019180000))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, HealthReady, r.Status)
+		assert.Equal(t, HealthOK, r.Database.Status)
+		assert.Equal(t, HealthOK, r.Migrations.Status)
+		assert.Equal(t, PoolCheck{MaxOpen: 20, Open: 3, InUse: 1, Idle: 2}, r.Pool)
+	})
+
+	t.Run("ready: schema newer than required", func(t *testing.T) {
+		store := DummyHealthStore{Version: 20261019190000}
+		code, _ := getReadiness(t, NewHealthController(&store, 20261019180000))
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("not ready: DB unreachable", func(t *testing.T) {
+		store := DummyHealthStore{PingErr: errors.New("connection refused")}
+		code, r := getReadiness(t, NewHealthController(&store, 1))
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, HealthNotReady, r.Status)
+		assert.Equal(t, HealthCheck{Status: HealthFailing, Error: "connection refused"}, r.Database)
+		assert.False(t, store.VersionCalled)
+	})
+
+	t.Run("not ready: schema", func(t *testing.T) {
+		cases := map[string]struct {
+			store DummyHealthStore
+			err   string
+		}{
+			"behind":      {DummyHealthStore{Version: 1}, "schema is at version 1, but 2 is required"},
+			"dirty":       {DummyHealthStore{Version: 2, Dirty: true}, "migration 2 failed halfway"},
+			"not applied": {DummyHealthStore{VersionErr: sql.ErrNoRows}, "no migrations applied"},
+		}
+		for name, tc := range cases {
+			t.Run(name, func(t *testing.T) {
+				code, r := getReadiness(t, NewHealthController(&tc.store, 2))
+				assert.Equal(t, http.StatusServiceUnavailable, code)
+				assert.Equal(t, HealthFailing, r.Migrations.Status)
+				assert.Equal(t, tc.err, r.Migrations.Error)
+			})
+		}
+	})
+
+	t.Run("not ready: draining", func(t *testing.T) {
+		h := NewHealthController(&DummyHealthStore{Version: 1}, 1)
+		h.Drain()
+
+		code, r := getReadiness(t, h)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, HealthNotReady, r.Status)
+		assert.True(t, r.Draining)
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// JWKS holds the public keys bearer tokens are signed with, by key ID. It's
+// reloaded periodically, so keys can be rotated without restarting.
+type JWKS struct {
+	load     func(context.Context) ([]byte, error)
+	interval time.Duration
+	logger   zerolog.Logger
+
+	mu   sync.RWMutex
+	keys map[string]interface{}
+}
+
+// Key returns the RSA or ECDSA public key with the given ID.
+func (j *JWKS) Key(kid string) (interface{}, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// Load replaces the keys with the ones loaded right now.
+func (j *JWKS) Load(ctx context.Context) error {
+	raw, err := j.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// Run reloads the keys every interval until `ctx` is done. When they fail to
+// load, the ones loaded last are kept.
+func (j *JWKS) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.Load(ctx); err != nil {
+				j.logger.Error().Err(err).Msg("reloading JWKS")
+			}
+		}
+	}
+}
+
+// NewJWKS builds a JWKS reading the keys with `load`, every `interval`. They
+// still need to be loaded for the first time.
+func NewJWKS(load func(context.Context) ([]byte, error), interval time.Duration, logger zerolog.Logger) *JWKS {
+	return &JWKS{
+		load:     load,
+		interval: interval,
+		logger:   logger,
+		keys:     make(map[string]interface{}),
+	}
+}
+
+// JWKSFromFile loads a JWKS from the file at `path`.
+func JWKSFromFile(path string) func(context.Context) ([]byte, error) {
+	return func(context.Context) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}
+}
+
+// JWKSFromURL loads a JWKS from `url`, e.g. the identity provider's
+// jwks_uri.
+func JWKSFromURL(url string, client *http.Client) func(context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching JWKS: HTTP %d", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses the RSA and EC signing keys of a JWK set, by key ID. Keys
+// of other types, or meant for encryption, are skipped.
+func ParseJWKS(raw []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing JWKS key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("parsing JWKS: no signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeJWKInt(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("n: %w", err)
+	}
+	e, err := decodeJWKInt(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("e: %w", err)
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("e is out of range")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := decodeJWKInt(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("x: %w", err)
+	}
+	y, err := decodeJWKInt(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("y: %w", err)
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
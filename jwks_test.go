@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// jwksJSON encodes the public halves of `keys` as a JWK set.
+func jwksJSON(t *testing.T, keys map[string]interface{}) []byte {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			set.Keys = append(set.Keys, jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64(key.N), E: b64(big.NewInt(int64(key.E)))})
+		case *ecdsa.PrivateKey:
+			set.Keys = append(set.Keys, jwk{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name, X: b64(key.X), Y: b64(key.Y)})
+		}
+	}
+	raw, err := json.Marshal(&set)
+	assert.NoError(t, err)
+	return raw
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	t.Run("parses RSA and EC keys", func(t *testing.T) {
+		keys, err := ParseJWKS(jwksJSON(t, map[string]interface{}{"rsa-1": rsaKey, "ec-1": ecKey}))
+		assert.NoError(t, err)
+		assert.Equal(t, &rsaKey.PublicKey, keys["rsa-1"])
+		assert.Equal(t, &ecKey.PublicKey, keys["ec-1"])
+	})
+
+	t.Run("skips encryption keys and unknown types", func(t *testing.T) {
+		keys, err := ParseJWKS([]byte(`{"keys": [
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": "` + b64(ecKey.X) + `", "y": "` + b64(ecKey.Y) + `"}
+		]}`))
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		cases := map[string]string{
+			"malformed":     `{"keys": `,
+			"no keys":       `{"keys": []}`,
+			"missing n":     `{"keys": [{"kty": "RSA", "kid": "1", "e": "AQAB"}]}`,
+			"unknown curve": `{"keys": [{"kty": "EC", "kid": "1", "crv": "P-192", "x": "AQAB", "y": "AQAB"}]}`,
+			"off the curve": `{"keys": [{"kty": "EC", "kid": "1", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`,
+			"tiny exponent": `{"keys": [{"kty": "RSA", "kid": "1", "n": "AQAB", "e": "AQ"}]}`,
+			"bad base64url": `{"keys": [{"kty": "RSA", "kid": "1", "n": "!!", "e": "AQAB"}]}`,
+		}
+		for name, raw := range cases {
+			_, err := ParseJWKS([]byte(raw))
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestJWKSLoad(t *testing.T) {
+	first, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	second, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	served := jwksJSON(t, map[string]interface{}{"1": first})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served == nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(served)
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(JWKSFromURL(srv.URL, srv.Client()), time.Minute, zerolog.Nop())
+	assert.NoError(t, jwks.Load(context.Background()))
+	_, ok := jwks.Key("1")
+	assert.True(t, ok)
+
+	// Rotated keys replace the old ones.
+	served = jwksJSON(t, map[string]interface{}{"2": second})
+	assert.NoError(t, jwks.Load(context.Background()))
+	_, ok = jwks.Key("1")
+	assert.False(t, ok)
+	_, ok = jwks.Key("2")
+	assert.True(t, ok)
+
+	// The keys loaded last are kept when loading fails.
+	served = nil
+	assert.EqualError(t, jwks.Load(context.Background()), "fetching JWKS: HTTP 502")
+	_, ok = jwks.Key("2")
+	assert.True(t, ok)
+}
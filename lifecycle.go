@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+// Hooks start and stop a component of the service. Start shouldn't block, and
+// Stop should return once the component is done, or `ctx` is.
+type Hooks struct {
+	Start func() error
+	Stop  func(ctx context.Context) error
+	// InFlight describes what the component is still busy with. It's logged
+	// when the component takes longer than its timeout to stop.
+	InFlight func() []string
+}
+
+type component struct {
+	name    string
+	hooks   Hooks
+	timeout time.Duration
+}
+
+// Lifecycle starts the components of the service in the order they were
+// registered, and stops them in reverse order. Components should be
+// registered after the ones they depend on, e.g. the HTTP server after the DB
+// pool, so they are stopped before them.
+type Lifecycle struct {
+	logger     zerolog.Logger
+	components []component
+	started    int
+	failed     chan error
+}
+
+// Register adds a component, which is given `timeout` to stop. A timeout of 0
+// leaves it up to the component.
+func (l *Lifecycle) Register(name string, timeout time.Duration, hooks Hooks) {
+	l.components = append(l.components, component{name: name, hooks: hooks, timeout: timeout})
+}
+
+// Fail reports that a component stopped working on its own, e.g. the HTTP
+// server failing to serve. Only the first failure is kept.
+func (l *Lifecycle) Fail(err error) {
+	select {
+	case l.failed <- err:
+	default:
+	}
+}
+
+// Failed receives the first failure reported through Fail. The service should
+// stop, and exit with an error, when it does.
+func (l *Lifecycle) Failed() <-chan error {
+	return l.failed
+}
+
+// Start starts every component. If one fails, the ones already started are
+// stopped.
+func (l *Lifecycle) Start() error {
+	for _, c := range l.components {
+		if c.hooks.Start != nil {
+			if err := c.hooks.Start(); err != nil {
+				l.Stop()
+				return fmt.Errorf("starting %s: %w", c.name, err)
+			}
+		}
+		l.started++
+		l.logger.Debug().Str("component", c.name).Msg("started")
+	}
+	return nil
+}
+
+// Stop stops the started components, last started first. Each one gets its
+// own timeout; when it runs out, what the component was still busy with is
+// logged, and the next one is stopped anyway. It returns the first error.
+func (l *Lifecycle) Stop() error {
+	var firstErr error
+	for ; l.started > 0; l.started-- {
+		c := l.components[l.started-1]
+		if c.hooks.Stop == nil {
+			continue
+		}
+
+		if err := l.stop(c); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping %s: %w", c.name, err)
+		}
+	}
+	return firstErr
+}
+
+func (l *Lifecycle) stop(c component) error {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := c.hooks.Stop(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		ev := l.logger.Warn().Str("component", c.name).Dur("timeout", c.timeout)
+		if c.hooks.InFlight != nil {
+			ev = ev.Strs("in_flight", c.hooks.InFlight())
+		}
+		ev.Msg("timed out stopping")
+		return err
+	}
+	if err != nil {
+		l.logger.Error().Err(err).Str("component", c.name).Msg("stopping")
+		return err
+	}
+
+	l.logger.Info().Str("component", c.name).Dur("duration", time.Since(start)).Msg("stopped")
+	return nil
+}
+
+func NewLifecycle(logger zerolog.Logger) *Lifecycle {
+	return &Lifecycle{
+		logger: logger,
+		failed: make(chan error, 1),
+	}
+}
+
+// ServerHooks serve `e` on `addr`. The address is bound on start, so a taken
+// port fails right away. It's served over TLS if `tlsConfig` isn't nil.
+// Stopping waits for the requests being served, which `inFlight` keeps track
+// of. If serving fails other than by being stopped, the error is passed to
+// `fail`.
+func ServerHooks(e *echo.Echo, addr string, tlsConfig *tls.Config, inFlight *InFlightRequests, fail func(error), logger zerolog.Logger) Hooks {
+	return Hooks{
+		Start: func() error {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			if tlsConfig != nil {
+				ln = tls.NewListener(ln, tlsConfig)
+			}
+			e.Listener = ln
+			go func() {
+				if err := e.Start(addr); err != nil && err != http.ErrServerClosed {
+					fail(fmt.Errorf("serving: %w", err))
+				}
+			}()
+			logger.Info().Str("listen_on", ln.Addr().String()).Bool("tls", tlsConfig != nil).Msg("started server")
+			return nil
+		},
+		Stop: e.Shutdown,
+		InFlight: func() []string {
+			return inFlight.List(time.Now())
+		},
+	}
+}
+
+// WorkerHooks run `w` in the background. Stopping cancels its context, and
+// waits for it to return.
+func WorkerHooks(w Worker) Hooks {
+	var cancel context.CancelFunc
+	done := make(chan struct{})
+	return Hooks{
+		Start: func() error {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			go func() {
+				defer close(done)
+				w.Run(ctx)
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// DBHooks close the DB pool. db.Close doesn't wait for the connections in use,
+// which are closed as they're released, so stopping waits for them to be
+// released first. The ones still in use when it times out are the
+// transactions in flight.
+func DBHooks(db *sql.DB) Hooks {
+	return Hooks{
+		Stop: func(ctx context.Context) error {
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+
+			for db.Stats().InUse > 0 {
+				select {
+				case <-ctx.Done():
+					db.Close()
+					return ctx.Err()
+				case <-ticker.C:
+				}
+			}
+			return db.Close()
+		},
+		InFlight: func() []string {
+			return []string{fmt.Sprintf("%d connections in use", db.Stats().InUse)}
+		},
+	}
+}
+
+// InFlightRequests keeps track of the requests being served.
+type InFlightRequests struct {
+	mu       sync.Mutex
+	next     uint64
+	requests map[uint64]inFlightRequest
+}
+
+type inFlightRequest struct {
+	method string
+	path   string
+	since  time.Time
+}
+
+func (r *InFlightRequests) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r.mu.Lock()
+		id := r.next
+		r.next++
+		r.requests[id] = inFlightRequest{method: c.Request().Method, path: c.Request().URL.Path, since: time.Now()}
+		r.mu.Unlock()
+
+		defer func() {
+			r.mu.Lock()
+			delete(r.requests, id)
+			r.mu.Unlock()
+		}()
+		return next(c)
+	}
+}
+
+// List describes the requests being served, oldest first.
+func (r *InFlightRequests) List(now time.Time) []string {
+	r.mu.Lock()
+	requests := make([]inFlightRequest, 0, len(r.requests))
+	for _, req := range r.requests {
+		requests = append(requests, req)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].since.Before(requests[j].since) })
+	list := make([]string, len(requests))
+	for i, req := range requests {
+		list[i] = fmt.Sprintf("%s %s for %s", req.method, req.path, now.Sub(req.since).Round(time.Millisecond))
+	}
+	return list
+}
+
+func NewInFlightRequests() *InFlightRequests {
+	return &InFlightRequests{
+		requests: make(map[uint64]inFlightRequest),
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHooks logs the components' starts and stops to `calls`.
+func recordingHooks(calls *[]string, name string, startErr error) Hooks {
+	return Hooks{
+		Start: func() error {
+			*calls = append(*calls, "start "+name)
+			return startErr
+		},
+		Stop: func(ctx context.Context) error {
+			*calls = append(*calls, "stop "+name)
+			return nil
+		},
+	}
+}
+
+type blockingWorker struct {
+	stopped chan struct{}
+}
+
+func (w *blockingWorker) Run(ctx context.Context) {
+	<-ctx.Done()
+	close(w.stopped)
+}
+
+func TestLifecycle(t *testing.T) {
+	t.Run("stops the components in reverse order", func(t *testing.T) {
+		var calls []string
+		lc := NewLifecycle(zerolog.Nop())
+		lc.Register("db", time.Second, recordingHooks(&calls, "db", nil))
+		lc.Register("worker", time.Second, recordingHooks(&calls, "worker", nil))
+		lc.Register("server", time.Second, recordingHooks(&calls, "server", nil))
+
+		assert.NoError(t, lc.Start())
+		assert.NoError(t, lc.Stop())
+		assert.Equal(t, []string{
+			"start db", "start worker", "start server",
+			"stop server", "stop worker", "stop db",
+		}, calls)
+	})
+
+	t.Run("stops the components started when one fails to start", func(t *testing.T) {
+		var calls []string
+		lc := NewLifecycle(zerolog.Nop())
+		lc.Register("db", time.Second, recordingHooks(&calls, "db", nil))
+		lc.Register("server", time.Second, recordingHooks(&calls, "server", errors.New("address already in use")))
+		lc.Register("broker", time.Second, recordingHooks(&calls, "broker", nil))
+
+		assert.EqualError(t, lc.Start(), "starting server: address already in use")
+		assert.Equal(t, []string{"start db", "start server", "stop db"}, calls)
+	})
+
+	t.Run("logs what's in flight when a component times out", func(t *testing.T) {
+		var logs bytes.Buffer
+		logger, err := NewLogger(&logs, "info")
+		assert.NoError(t, err)
+
+		var calls []string
+		lc := NewLifecycle(logger)
+		lc.Register("db", time.Second, recordingHooks(&calls, "db", nil))
+		lc.Register("server", time.Millisecond, Hooks{
+			Stop: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			InFlight: func() []string {
+				return []string{"POST /wallets/1/balance-changes for 2s"}
+			},
+		})
+
+		assert.NoError(t, lc.Start())
+		assert.EqualError(t, lc.Stop(), "stopping server: context deadline exceeded")
+		assert.Equal(t, []string{"start db", "stop db"}, calls)
+
+		line := logLines(t, &logs)[0]
+		assert.Equal(t, "warn", line["level"])
+		assert.Equal(t, "server", line["component"])
+		assert.Equal(t, []interface{}{"POST /wallets/1/balance-changes for 2s"}, line["in_flight"])
+	})
+}
+
+func TestServerHooks(t *testing.T) {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	lc := NewLifecycle(zerolog.Nop())
+	hooks := ServerHooks(e, "127.0.0.1:0", nil, NewInFlightRequests(), lc.Fail, zerolog.Nop())
+	assert.NoError(t, hooks.Start())
+
+	t.Run("reports serving failures", func(t *testing.T) {
+		assert.NoError(t, e.Listener.Close())
+		select {
+		case err := <-lc.Failed():
+			assert.Contains(t, err.Error(), "serving:")
+		case <-time.After(time.Second):
+			t.Fatal("the failure wasn't reported")
+		}
+	})
+
+	t.Run("doesn't report being stopped", func(t *testing.T) {
+		e := echo.New()
+		e.HideBanner = true
+		e.HidePort = true
+		lc := NewLifecycle(zerolog.Nop())
+		hooks := ServerHooks(e, "127.0.0.1:0", nil, NewInFlightRequests(), lc.Fail, zerolog.Nop())
+		assert.NoError(t, hooks.Start())
+		assert.NoError(t, hooks.Stop(context.Background()))
+
+		select {
+		case err := <-lc.Failed():
+			t.Fatalf("reported %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestWorkerHooks(t *testing.T) {
+	w := blockingWorker{stopped: make(chan struct{})}
+	hooks := WorkerHooks(&w)
+
+	assert.NoError(t, hooks.Start())
+	assert.NoError(t, hooks.Stop(context.Background()))
+	_, running := <-w.stopped
+	assert.False(t, running)
+}
+
+func TestInFlightRequests(t *testing.T) {
+	inFlight := NewInFlightRequests()
+	release := make(chan struct{})
+	served := make(chan struct{})
+
+	e := echo.New()
+	e.Use(inFlight.Middleware)
+	e.POST("/wallets/:id/balance-changes", func(c echo.Context) error {
+		<-release
+		return c.NoContent(http.StatusCreated)
+	})
+
+	go func() {
+		defer close(served)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/wallets/1/balance-changes", nil))
+	}()
+
+	assert.Eventually(t, func() bool { return len(inFlight.List(time.Now())) == 1 }, time.Second, time.Millisecond)
+	assert.Contains(t, inFlight.List(time.Now())[0], "POST /wallets/1/balance-changes for ")
+
+	close(release)
+	<-served
+	assert.Empty(t, inFlight.List(time.Now()))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger builds the JSON logger the service writes to. `level` is one of
+// debug, info, warn or error.
+func NewLogger(out io.Writer, level string) (zerolog.Logger, error) {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return zerolog.Nop(), err
+	}
+	return zerolog.New(out).Level(lvl).With().Timestamp().Logger(), nil
+}
+
+// maxRequestIDLength bounds the request IDs taken from clients, so they can't
+// flood the logs.
+const maxRequestIDLength = 128
+
+// NewRequestLoggerMiddleware tags every request with an ID, taken from its
+// X-Request-ID header or generated when missing, echoes it back in the
+// response, and gives the request a logger carrying it. Once the request is
+// served, it logs how it went. Requests being traced also log their trace ID.
+func NewRequestLoggerMiddleware(logger zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				var err error
+				if id, err = newUUID(); err != nil {
+					return err
+				}
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+			logCtx := logger.With().Str("request_id", id)
+			if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+				logCtx = logCtx.Str("trace_id", sc.TraceID().String())
+			}
+			reqLogger := logCtx.Logger()
+			c.SetRequest(req.WithContext(reqLogger.WithContext(req.Context())))
+
+			err := next(c)
+			if err != nil {
+				// Let echo write the error response, so its status gets logged.
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			ev := requestLogger(c).Info()
+			if status >= http.StatusInternalServerError {
+				ev = requestLogger(c).Error()
+			}
+			ev.Str("method", req.Method).
+				Str("route", c.Path()).
+				Int("status", status).
+				Dur("duration", time.Since(start)).
+				Msg("request served")
+			return err
+		}
+	}
+}
+
+// validRequestID reports whether a client-given request ID is safe to log:
+// non-empty, reasonably short and printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the logger of the request being served. Outside of
+// NewRequestLoggerMiddleware, it discards everything.
+func requestLogger(c echo.Context) *zerolog.Logger {
+	return zerolog.Ctx(c.Request().Context())
+}
+
+// addLogField attaches `key` to every line logged for the request from now on,
+// including the one logged once it's served.
+func addLogField(c echo.Context, key string, value interface{}) {
+	requestLogger(c).UpdateContext(func(l zerolog.Context) zerolog.Context {
+		return l.Interface(key, value)
+	})
+}
+
+// internalError logs the error behind an unexpected failure, which clients
+// only see as a bare 500.
+func internalError(c echo.Context, err error) error {
+	requestLogger(c).Error().Err(err).Msg("internal error")
+	return echo.NewHTTPError(http.StatusInternalServerError)
+}
+
+const redacted = "[REDACTED]"
+
+// MarshalZerologObject logs the wallet without its name, which may identify
+// its owner.
+func (w *Wallet) MarshalZerologObject(e *zerolog.Event) {
+	e.Uint("id", w.ID).
+		Str("name", redacted).
+		Int64("balance", w.Balance).
+		Uint64("debt", w.Debt)
+}
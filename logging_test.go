@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// logLines decodes the JSON lines written by the logger.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(raw), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestRequestLoggerMiddleware(t *testing.T) {
+	newServer := func(buf *bytes.Buffer) *echo.Echo {
+		logger, err := NewLogger(buf, "info")
+		assert.NoError(t, err)
+
+		e := echo.New()
+		e.Use(NewRequestLoggerMiddleware(logger))
+		e.GET("/wallets/:id", func(c echo.Context) error {
+			addLogField(c, "wallet_id", 7)
+			return c.NoContent(http.StatusOK)
+		})
+		e.POST("/wallets", func(c echo.Context) error {
+			w := Wallet{ID: 3, Name: "Jane Doe's savings", Balance: 10}
+			requestLogger(c).Info().Object("wallet", &w).Msg("wallet created")
+			return internalError(c, errors.New("connection reset"))
+		})
+		return e
+	}
+
+	t.Run("generates a request ID and logs the request", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := newServer(&buf)
+
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/wallets/7", nil))
+		id := resp.Header().Get(echo.HeaderXRequestID)
+		assert.Len(t, id, 36)
+
+		lines := logLines(t, &buf)
+		assert.Len(t, lines, 1)
+		assert.Equal(t, "info", lines[0]["level"])
+		assert.Equal(t, id, lines[0]["request_id"])
+		assert.Equal(t, float64(7), lines[0]["wallet_id"])
+		assert.Equal(t, "/wallets/:id", lines[0]["route"])
+		assert.Equal(t, float64(http.StatusOK), lines[0]["status"])
+	})
+
+	t.Run("keeps the client's request ID", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := newServer(&buf)
+
+		req := httptest.NewRequest(http.MethodGet, "/wallets/7", nil)
+		req.Header.Set(echo.HeaderXRequestID, "abc-123")
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		assert.Equal(t, "abc-123", resp.Header().Get(echo.HeaderXRequestID))
+		assert.Equal(t, "abc-123", logLines(t, &buf)[0]["request_id"])
+	})
+
+	t.Run("replaces malformed request IDs", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := newServer(&buf)
+
+		for _, id := range []string{"has spaces", strings.Repeat("a", maxRequestIDLength+1)} {
+			req := httptest.NewRequest(http.MethodGet, "/wallets/7", nil)
+			req.Header.Set(echo.HeaderXRequestID, id)
+			resp := httptest.NewRecorder()
+			e.ServeHTTP(resp, req)
+			assert.Len(t, resp.Header().Get(echo.HeaderXRequestID), 36)
+		}
+	})
+
+	t.Run("logs internal errors, with wallet names redacted", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := newServer(&buf)
+
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/wallets", nil))
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.NotContains(t, resp.Body.String(), "connection reset")
+		assert.NotContains(t, buf.String(), "Jane Doe")
+
+		lines := logLines(t, &buf)
+		assert.Len(t, lines, 3)
+		assert.Equal(t, map[string]interface{}{
+			"id":      float64(3),
+			"name":    redacted,
+			"balance": float64(10),
+			"debt":    float64(0),
+		}, lines[0]["wallet"])
+		assert.Equal(t, "error", lines[1]["level"])
+		assert.Equal(t, "connection reset", lines[1]["error"])
+		assert.Equal(t, "error", lines[2]["level"])
+		assert.Equal(t, float64(http.StatusInternalServerError), lines[2]["status"])
+		for _, line := range lines {
+			assert.Equal(t, lines[0]["request_id"], line["request_id"])
+		}
+	})
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "warn")
+	assert.NoError(t, err)
+
+	logger.Info().Msg("dropped")
+	logger.Warn().Msg("kept")
+	lines := logLines(t, &buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "kept", lines[0]["message"])
+
+	_, err = NewLogger(&buf, "loud")
+	assert.Error(t, err)
+}
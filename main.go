@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,55 +14,287 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
 )
 
+type Worker interface {
+	Run(context.Context)
+}
+
 func main() {
-	e := initApp()
+	cfg, args, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	go func() {
-		if err := e.Start(os.Getenv("LISTEN_ON")); err != nil && err != http.ErrServerClosed {
-			e.Logger.Fatal(err)
+	if len(args) > 0 {
+		if err := runCommand(cfg, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-	}()
+		return
+	}
+
+	logger, err := NewLogger(os.Stdout, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.AutoMigrate {
+		if err := AutoMigrate(cfg.DB.ConnString()); err != nil {
+			logger.Fatal().Err(err).Msg("applying migrations")
+		}
+	}
+
+	lc := initApp(cfg, logger)
+	if err := lc.Start(); err != nil {
+		logger.Fatal().Err(err).Msg("starting")
+	}
 
 	quit := make(chan os.Signal, 1)
 	// SIGINT to handle ctrl+C
 	// SIGTERM to handle 'docker stop'
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	received := <-quit
-	e.Logger.Errorf("received signal: %+v\n", received)
+	exitCode := 0
+	select {
+	case received := <-quit:
+		logger.Info().Str("signal", received.String()).Msg("shutting down")
+	case err := <-lc.Failed():
+		logger.Error().Err(err).Msg("shutting down")
+		exitCode = 1
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
-	defer cancel()
+	if err := lc.Stop(); err != nil {
+		logger.Error().Err(err).Msg("shutting down")
+		os.Exit(1)
+	}
+	os.Exit(exitCode)
+}
 
-	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+// runCommand runs the `migrate`, `config` and `api-keys` subcommands.
+func runCommand(cfg *Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		m, err := NewMigrator(cfg.DB.ConnString())
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		return RunMigrate(m, args[1:], os.Stdout)
+	case "config":
+		return RunConfig(cfg, args[1:], os.Stdout)
+	case "api-keys":
+		db, err := NewDB(cfg.DB)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return RunAPIKeys(context.Background(), NewAPIKeyService(NewAPIKeyStore(db)), args[1:], os.Stdout)
 	}
+	return fmt.Errorf("unknown command: %s", args[0])
 }
 
-func initApp() *echo.Echo {
-	db, err := NewDB(
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USERNAME"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_SSLMODE"),
-	)
+// initApp wires the service up. Its components are registered in the order
+// they start in, and stop in reverse.
+func initApp(cfg *Config, logger zerolog.Logger) *Lifecycle {
+	lc := NewLifecycle(logger)
+
+	db, err := NewDB(cfg.DB)
 	if err != nil {
 		panic(err)
 	}
+	lc.Register("db pool", cfg.DB.CloseTimeout, DBHooks(db.DB))
+
+	tp, stopTracing, err := NewTracerProvider(cfg.Tracing, os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+	otel.SetTracerProvider(tp)
+	lc.Register("tracing", cfg.Tracing.FlushTimeout, Hooks{Stop: stopTracing})
+
+	metrics := NewMetricsRegistry(db.DB)
 
 	wStore := NewWalletStore(db)
-	wService := NewWalletService(wStore)
+	wService := NewWalletService(wStore, cfg.Wallets.LowBalanceThreshold, NewWalletMetrics(metrics))
 
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Server.ReadTimeout = cfg.ReadTimeout
+	e.Server.IdleTimeout = cfg.IdleTimeout
+	trustedProxies, err := cfg.TrustedProxyRanges()
+	if err != nil {
+		panic(err)
+	}
+	e.IPExtractor = NewIPExtractor(trustedProxies)
+
+	inFlight := NewInFlightRequests()
 
 	e.Pre(middleware.RemoveTrailingSlash())
+	e.Use(inFlight.Middleware)
+	e.Use(NewHTTPMetricsMiddleware(metrics))
+	e.Use(NewTracingMiddleware())
+	e.Use(NewRequestLoggerMiddleware(logger))
+	e.Use(RequestInfoMiddleware)
+	e.Use(ClientCertMiddleware)
+
+	RegisterMetricsEndpoint(e, metrics)
+
+	requiredVersion, err := LatestMigrationVersion()
+	if err != nil {
+		panic(err)
+	}
+	health := NewHealthController(NewHealthStore(db), requiredVersion)
+	health.Register(e)
+
+	poolGuard := NewPoolGuard(db.DB, cfg.DB.MaxPoolWait, metrics)
+
+	akService := NewAPIKeyService(NewAPIKeyStore(db))
+	var tokens TokenAuthenticator
+	if cfg.Auth.TokensEnabled() {
+		load := JWKSFromFile(cfg.Auth.JWKSFile)
+		if cfg.Auth.JWKSURL != "" {
+			load = JWKSFromURL(cfg.Auth.JWKSURL, &http.Client{Timeout: 10 * time.Second})
+		}
+		jwks := NewJWKS(load, cfg.Auth.JWKSRefreshInterval, logger)
+		if err := jwks.Load(context.Background()); err != nil {
+			panic(err)
+		}
+		lc.Register("jwks refresher", cfg.WorkersShutdownTimeout, WorkerHooks(jwks))
+		tokens = NewTokenValidator(jwks, cfg.Auth.Issuer, cfg.Auth.Audience, cfg.Auth.OwnerClaim)
+	}
+
+	var nonces NonceStore
+	if cfg.Signing.NonceStore == "postgres" {
+		pgNonces := NewPostgresNonceStore(db, logger)
+		lc.Register("nonce sweeper", cfg.WorkersShutdownTimeout, WorkerHooks(pgNonces))
+		nonces = pgNonces
+	} else {
+		memNonces := NewMemoryNonceStore()
+		lc.Register("nonce sweeper", cfg.WorkersShutdownTimeout, WorkerHooks(memNonces))
+		nonces = memNonces
+	}
+	signatures := NewRequestVerifier(akService, nonces, cfg.Signing.MaxSkew)
+	authenticate := NewAuthMiddleware(akService, signatures, tokens)
+
+	idle := cfg.RateLimits.PerClient().RefillTime()
+	for _, limit := range []RateLimit{cfg.RateLimits.PerWallet(), cfg.RateLimits.PerIP()} {
+		if t := limit.RefillTime(); t > idle {
+			idle = t
+		}
+	}
+	var limiter RateLimiter
+	if cfg.RateLimits.Store == "postgres" {
+		pgLimiter := NewPostgresRateLimiter(db, idle, logger)
+		lc.Register("rate limit sweeper", cfg.WorkersShutdownTimeout, WorkerHooks(pgLimiter))
+		limiter = pgLimiter
+	} else {
+		memLimiter := NewMemoryRateLimiter(idle)
+		lc.Register("rate limit sweeper", cfg.WorkersShutdownTimeout, WorkerHooks(memLimiter))
+		limiter = memLimiter
+	}
+	limits := NewRateLimits(limiter, cfg.RateLimits.PerClient(), cfg.RateLimits.PerWallet(), cfg.RateLimits.PerIP(), metrics)
+
+	apiKeys := e.Group("/api-keys", poolGuard.Middleware, authenticate, limits.PerClient)
+	akc := NewAPIKeyController(akService)
+	akc.Register(apiKeys)
 
-	wallets := e.Group("/wallets")
+	audit := e.Group("/audit", poolGuard.Middleware, authenticate, limits.PerClient)
+	ac := NewAuditController(NewAuditService(NewAuditStore(db)))
+	ac.Register(audit)
+
+	wallets := e.Group("/wallets", poolGuard.Middleware, authenticate, limits.PerClient, limits.PerWallet)
 	wc := NewWalletController(wService)
 	wc.Register(wallets)
 
-	return e
+	var broker *BalanceChangeBroker
+	if cfg.Features.Streaming {
+		broker = NewBalanceChangeBroker(cfg.DB.ConnString(), logger)
+		sc := NewStreamController(wService, broker)
+		sc.Register(wallets)
+	}
+
+	provider, err := NewPayoutProvider(cfg.Withdrawals.PayoutProvider)
+	if err != nil {
+		panic(err)
+	}
+	wdService := NewWithdrawalService(
+		NewWithdrawalStore(db),
+		wService,
+		provider,
+		cfg.Withdrawals.MaxAttempts,
+	)
+	withdrawals := e.Group("/withdrawals", poolGuard.Middleware, authenticate, limits.PerClient)
+	wdc := NewWithdrawalController(wdService)
+	wdc.Register(withdrawals)
+	lc.Register("withdrawal resumer", cfg.WorkersShutdownTimeout, WorkerHooks(NewWithdrawalResumer(wdService, time.Second, 20, logger)))
+
+	dService := NewDepositService(NewDepositStore(db), wService)
+	deposits := e.Group("/deposits", poolGuard.Middleware, authenticate, limits.PerClient)
+	dc := NewDepositController(dService)
+	dc.Register(deposits)
+
+	var adapters []ProviderAdapter
+	if cfg.Callbacks.LocalSecret != "" {
+		adapters = append(adapters, NewLocalProviderAdapter(cfg.Callbacks.LocalSecret))
+	}
+	callbacks := e.Group("/callbacks", poolGuard.Middleware, limits.PerIP)
+	cbc := NewCallbackController(NewCallbackService(NewCallbackStore(db), dService, wdService, adapters...))
+	cbc.Register(callbacks)
+
+	if cfg.Features.Snapshots {
+		lc.Register("balance snapshotter", cfg.WorkersShutdownTimeout, WorkerHooks(NewBalanceSnapshotter(wStore, time.Hour, logger)))
+	}
+
+	publisher, err := NewPublisher(cfg.Outbox.Publisher, cfg.Outbox.FilePath, cfg.Outbox.WebhookURL)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.Features.Webhooks {
+		whStore := NewWebhookStore(db)
+		webhooks := e.Group("/webhooks", poolGuard.Middleware, authenticate, limits.PerClient)
+		whc := NewWebhookController(NewWebhookService(whStore))
+		whc.Register(webhooks)
+
+		publisher = NewMultiPublisher(publisher, NewWebhookFanout(whStore))
+		lc.Register("webhook dispatcher", cfg.WorkersShutdownTimeout, WorkerHooks(NewWebhookDispatcher(whStore, cfg.Webhooks.MaxAttempts, logger)))
+	}
+
+	lc.Register("outbox relay", cfg.WorkersShutdownTimeout, WorkerHooks(NewOutboxRelay(wStore, publisher, time.Second, 100, logger)))
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		certs := NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile, cfg.TLS.ReloadInterval, logger)
+		if err := certs.Load(); err != nil {
+			panic(err)
+		}
+		lc.Register("tls reloader", cfg.WorkersShutdownTimeout, WorkerHooks(certs))
+		tlsConfig = certs.TLSConfig(tlsVersions[cfg.TLS.MinVersion])
+	}
+	lc.Register("http server", cfg.ShutdownTimeout, ServerHooks(e, cfg.ListenOn, tlsConfig, inFlight, lc.Fail, logger))
+
+	// Stopped before the server, so the streams it feeds end rather than
+	// holding up the server's shutdown.
+	if broker != nil {
+		lc.Register("balance change broker", cfg.WorkersShutdownTimeout, WorkerHooks(broker))
+	}
+
+	// Stopped first: load balancers get a chance to notice the service is no
+	// longer ready, and stop sending it requests, before it stops taking them.
+	lc.Register("readiness", 0, Hooks{
+		Stop: func(ctx context.Context) error {
+			health.Drain()
+			time.Sleep(cfg.DrainDelay)
+			return nil
+		},
+	})
+
+	return lc
 }
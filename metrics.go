@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "wallets"
+
+// NewMetricsRegistry builds the registry served on /metrics. Besides the Go
+// runtime and process metrics, it reports the DB pool's stats: connections in
+// use and idle, and how often and how long requests waited for one.
+func NewMetricsRegistry(db *sql.DB) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, metricsNamespace),
+	)
+	return reg
+}
+
+func RegisterMetricsEndpoint(e *echo.Echo, reg *prometheus.Registry) {
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})))
+}
+
+// NewHTTPMetricsMiddleware counts requests, and times them, by method, route
+// and status.
+func NewHTTPMetricsMiddleware(reg prometheus.Registerer) echo.MiddlewareFunc {
+	labels := []string{"method", "route", "status"}
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by method, route and status.",
+	}, labels)
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+	reg.MustRegister(requests, duration)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				status = http.StatusInternalServerError
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+			}
+			// Label by route template rather than by URL, to keep the
+			// number of series bounded. Echo reports the URL as the path of
+			// requests that match no route.
+			route := c.Path()
+			if route == "" || err == echo.ErrNotFound || err == echo.ErrMethodNotAllowed {
+				route = "unmatched"
+			}
+
+			values := []string{c.Request().Method, route, strconv.Itoa(status)}
+			requests.WithLabelValues(values...).Inc()
+			duration.WithLabelValues(values...).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// WalletMetrics are the metrics reported by the WalletService.
+type WalletMetrics struct {
+	BalanceChanges      *prometheus.CounterVec
+	BalanceChangeAmount *prometheus.CounterVec
+	InsufficientBalance prometheus.Counter
+	Rollbacks           prometheus.Counter
+	CommitDuration      prometheus.Histogram
+	LockWait            prometheus.Histogram
+}
+
+func NewWalletMetrics(reg prometheus.Registerer) *WalletMetrics {
+	m := &WalletMetrics{
+		BalanceChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "balance_changes_total",
+			Help:      "Balance changes applied, by operation.",
+		}, []string{"operation"}),
+		BalanceChangeAmount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "balance_change_amount_total",
+			Help:      "Sum of the amounts of the balance changes applied, by operation.",
+		}, []string{"operation"}),
+		InsufficientBalance: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "insufficient_balance_rejections_total",
+			Help:      "Balance changes rejected because the wallet couldn't cover them.",
+		}),
+		Rollbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_rollbacks_total",
+			Help:      "Wallet transactions rolled back.",
+		}),
+		CommitDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_commit_duration_seconds",
+			Help:      "Time taken to commit wallet transactions.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		LockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "wallet_lock_wait_seconds",
+			Help:      "Time spent waiting to lock a wallet's row.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+	reg.MustRegister(
+		m.BalanceChanges,
+		m.BalanceChangeAmount,
+		m.InsufficientBalance,
+		m.Rollbacks,
+		m.CommitDuration,
+		m.LockWait,
+	)
+	return m
+}
+
+// instrumentedTx reports the commits and rollbacks of a transaction, and
+// traces them within the context the transaction was begun in.
+type instrumentedTx struct {
+	TxExecutor
+	ctx     context.Context
+	metrics *WalletMetrics
+}
+
+func (tx *instrumentedTx) Commit() error {
+	span := startStoreSpan(tx.ctx, "Tx.Commit", "commit")
+	defer span.End()
+
+	start := time.Now()
+	err := tx.TxExecutor.Commit()
+	tx.metrics.CommitDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func (tx *instrumentedTx) Rollback() error {
+	span := startStoreSpan(tx.ctx, "Tx.Rollback", "rollback")
+	defer span.End()
+
+	tx.metrics.Rollbacks.Inc()
+	if err := tx.TxExecutor.Rollback(); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	db, err := sql.Open("postgres", "host=localhost")
+	assert.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+
+	e := echo.New()
+	RegisterMetricsEndpoint(e, NewMetricsRegistry(db))
+
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	body := resp.Body.String()
+	for _, metric := range []string{
+		`go_sql_max_open_connections{db_name="wallets"} 7`,
+		`go_sql_in_use_connections{db_name="wallets"} 0`,
+		`go_sql_wait_count_total{db_name="wallets"} 0`,
+		`go_sql_wait_duration_seconds_total{db_name="wallets"} 0`,
+	} {
+		assert.True(t, strings.Contains(body, metric), "missing %s", metric)
+	}
+}
+
+func TestHTTPMetricsMiddleware(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	e := echo.New()
+	e.Use(NewHTTPMetricsMiddleware(reg))
+	e.GET("/wallets/:id", func(c echo.Context) error {
+		if c.Param("id") == "2" {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, url := range []string{"/wallets/1", "/wallets/1", "/wallets/2", "/nowhere"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP wallets_http_requests_total HTTP requests handled, by method, route and status.
+# TYPE wallets_http_requests_total counter
+wallets_http_requests_total{method="GET",route="/wallets/:id",status="200"} 2
+wallets_http_requests_total{method="GET",route="/wallets/:id",status="404"} 1
+wallets_http_requests_total{method="GET",route="unmatched",status="404"} 1
+`), "wallets_http_requests_total"))
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() == "wallets_http_request_duration_seconds" {
+			assert.Equal(t, 3, len(mf.GetMetric()))
+		}
+	}
+}
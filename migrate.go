@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// NewMigrator builds a migrate.Migrate that applies the migrations embedded
+// in the binary. It keeps track of them in the same `schema_migrations` table
+// the go-migrate CLI uses, and holds a Postgres advisory lock while migrating,
+// so replicas starting side by side don't race each other.
+func NewMigrator(connStr string) (*migrate.Migrate, error) {
+	src, err := iofs.New(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("iofs", src, "postgres", driver)
+}
+
+const migrateUsage = `usage: migrate <command>
+
+commands:
+  up        apply every pending migration
+  down [N]  revert the last N migrations (1 by default)
+  to N      migrate up or down to version N
+  status    list the migrations, and whether they're applied`
+
+// RunMigrate runs the `migrate` subcommand described by `args`.
+func RunMigrate(m *migrate.Migrate, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = m.Up()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("N should be a positive integer: %s", args[1])
+			}
+		}
+		err = m.Steps(-steps)
+	case "to":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, parseErr := strconv.ParseUint(args[1], 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("N should be a migration version: %s", args[1])
+		}
+		err = m.Migrate(uint(version))
+	case "status":
+		return printMigrationStatus(m, out)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		fmt.Fprintln(out, "no change")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return printMigrationStatus(m, out)
+}
+
+type migrationFile struct {
+	Version uint
+	Name    string
+}
+
+// embeddedMigrations lists the embedded migrations, oldest first.
+func embeddedMigrations() ([]migrationFile, error) {
+	files, err := fs.Glob(migrationsFS, "migrations/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migrationFile, 0, len(files))
+	for _, f := range files {
+		base := strings.TrimSuffix(strings.TrimPrefix(f, "migrations/"), ".up.sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration file name %s: %w", f, err)
+		}
+		mf := migrationFile{Version: uint(version)}
+		if len(parts) > 1 {
+			mf.Name = parts[1]
+		}
+		migrations = append(migrations, mf)
+	}
+	return migrations, nil
+}
+
+// LatestMigrationVersion is the version of the newest embedded migration, the
+// one the code expects the schema to be at.
+func LatestMigrationVersion() (uint, error) {
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+func printMigrationStatus(m *migrate.Migrate, out io.Writer) error {
+	current, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range migrations {
+		status := "pending"
+		if mf.Version <= current {
+			status = "applied"
+		}
+		if mf.Version == current && dirty {
+			status = "dirty"
+		}
+		fmt.Fprintf(out, "%-8s %d %s\n", status, mf.Version, mf.Name)
+	}
+	return nil
+}
+
+// AutoMigrate applies every pending migration.
+func AutoMigrate(connStr string) error {
+	m, err := NewMigrator(connStr)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := embeddedMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	assert.Equal(t, uint(20210911175124), migrations[0].Version)
+	assert.Equal(t, "first", migrations[0].Name)
+
+	for i, mf := range migrations {
+		if i > 0 {
+			assert.Greater(t, mf.Version, migrations[i-1].Version)
+		}
+		down := fmt.Sprintf("migrations/%d_%s.down.sql", mf.Version, mf.Name)
+		_, err := fs.Stat(migrationsFS, down)
+		assert.NoError(t, err, "%s is missing", down)
+	}
+	latest, err := LatestMigrationVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].Version, latest)
+}
+
+func TestRunMigrateUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"sideways"}, {"to"}, {"to", "latest"}, {"down", "0"}} {
+		t.Run(fmt.Sprintf("%v", args), func(t *testing.T) {
+			var out bytes.Buffer
+			assert.Error(t, RunMigrate(nil, args, &out))
+			assert.Empty(t, out.String())
+		})
+	}
+}
@@ -1,2 +1,2 @@
-DROP TABLE public.balance_changes IF EXISTS;
-DROP TABLE public.wallets IF EXISTS;
\ No newline at end of file
+DROP TABLE IF EXISTS public.balance_changes;
+DROP TABLE IF EXISTS public.wallets;
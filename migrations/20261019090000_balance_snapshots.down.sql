@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.balance_snapshots;
+DROP INDEX IF EXISTS public.balance_changes_wallet_id_created_at_idx;
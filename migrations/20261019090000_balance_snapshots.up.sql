@@ -0,0 +1,10 @@
+CREATE INDEX balance_changes_wallet_id_created_at_idx ON public.balance_changes (wallet_id, created_at);
+
+CREATE TABLE public.balance_snapshots (
+	wallet_id int8 NOT NULL,
+	day date NOT NULL,
+	balance int8 NOT NULL,
+	created_at timestamptz default current_timestamp,
+	CONSTRAINT balance_snapshots_pkey PRIMARY KEY (wallet_id, day),
+	CONSTRAINT fk_balance_snapshots_wallet FOREIGN KEY (wallet_id) REFERENCES wallets(id)
+);
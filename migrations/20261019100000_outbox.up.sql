@@ -0,0 +1,11 @@
+CREATE TABLE public.outbox (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	event_type text NOT NULL,
+	aggregate_id int8 NOT NULL,
+	payload jsonb NOT NULL,
+	published_at timestamptz NULL,
+	CONSTRAINT outbox_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX outbox_unpublished_idx ON public.outbox (id) WHERE published_at IS NULL;
@@ -0,0 +1,28 @@
+CREATE TABLE public.webhook_subscriptions (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	url text NOT NULL,
+	event_types text[] NOT NULL,
+	secret text NOT NULL,
+	active boolean NOT NULL DEFAULT true,
+	CONSTRAINT webhook_subscriptions_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE public.webhook_deliveries (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	subscription_id int8 NOT NULL,
+	event_id int8 NOT NULL,
+	event_type text NOT NULL,
+	payload jsonb NOT NULL,
+	status text NOT NULL DEFAULT 'pending',
+	attempts int4 NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz NOT NULL DEFAULT current_timestamp,
+	last_error text NULL,
+	delivered_at timestamptz NULL,
+	CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (id),
+	CONSTRAINT webhook_deliveries_subscription_event_key UNIQUE (subscription_id, event_id),
+	CONSTRAINT fk_webhook_deliveries_subscription FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON public.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS balance_changes_notify ON public.balance_changes;
+DROP FUNCTION IF EXISTS public.notify_balance_change();
@@ -0,0 +1,12 @@
+-- NOTIFY is only delivered once the inserting transaction commits, so
+-- listeners never see balance changes that end up rolled back.
+CREATE FUNCTION public.notify_balance_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('balance_changes', row_to_json(NEW)::text);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER balance_changes_notify
+	AFTER INSERT ON public.balance_changes
+	FOR EACH ROW EXECUTE PROCEDURE public.notify_balance_change();
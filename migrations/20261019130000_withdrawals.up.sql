@@ -0,0 +1,20 @@
+CREATE TABLE public.withdrawals (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	updated_at timestamptz default current_timestamp,
+	wallet_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	destination text NOT NULL,
+	state text NOT NULL,
+	attempts int4 NOT NULL DEFAULT 0,
+	idempotency_key text NOT NULL,
+	debit_change_id int8 NULL,
+	refund_change_id int8 NULL,
+	provider_reference text NULL,
+	last_error text NULL,
+	CONSTRAINT withdrawals_pkey PRIMARY KEY (id),
+	CONSTRAINT withdrawals_idempotency_key_key UNIQUE (idempotency_key),
+	CONSTRAINT fk_withdrawals_wallet FOREIGN KEY (wallet_id) REFERENCES wallets(id),
+	CONSTRAINT fk_withdrawals_debit_change FOREIGN KEY (debit_change_id) REFERENCES balance_changes(id),
+	CONSTRAINT fk_withdrawals_refund_change FOREIGN KEY (refund_change_id) REFERENCES balance_changes(id)
+);
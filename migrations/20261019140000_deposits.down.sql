@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.deposits;
+ALTER TABLE public.wallets DROP COLUMN IF EXISTS pending_balance;
@@ -0,0 +1,17 @@
+ALTER TABLE public.wallets ADD COLUMN pending_balance int8 NOT NULL DEFAULT 0;
+
+CREATE TABLE public.deposits (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	updated_at timestamptz default current_timestamp,
+	wallet_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	state text NOT NULL,
+	provider_reference text NULL,
+	clear_change_id int8 NULL,
+	chargeback_change_id int8 NULL,
+	CONSTRAINT deposits_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_deposits_wallet FOREIGN KEY (wallet_id) REFERENCES wallets(id),
+	CONSTRAINT fk_deposits_clear_change FOREIGN KEY (clear_change_id) REFERENCES balance_changes(id),
+	CONSTRAINT fk_deposits_chargeback_change FOREIGN KEY (chargeback_change_id) REFERENCES balance_changes(id)
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.provider_callbacks;
@@ -0,0 +1,9 @@
+CREATE TABLE public.provider_callbacks (
+	provider text NOT NULL,
+	event_id text NOT NULL,
+	received_at timestamptz default current_timestamp,
+	kind text NOT NULL,
+	target_id int8 NOT NULL,
+	state text NOT NULL,
+	CONSTRAINT provider_callbacks_pkey PRIMARY KEY (provider, event_id)
+);
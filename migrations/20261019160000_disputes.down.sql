@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public.disputes;
+
+ALTER TABLE public.balance_changes DROP COLUMN IF EXISTS debt_after;
+ALTER TABLE public.balance_changes DROP COLUMN IF EXISTS debt_before;
+
+ALTER TABLE public.wallets DROP COLUMN IF EXISTS debt;
@@ -0,0 +1,19 @@
+ALTER TABLE public.wallets ADD COLUMN debt int8 NOT NULL DEFAULT 0;
+
+ALTER TABLE public.balance_changes ADD COLUMN debt_before int8 NOT NULL DEFAULT 0;
+ALTER TABLE public.balance_changes ADD COLUMN debt_after int8 NOT NULL DEFAULT 0;
+
+CREATE TABLE public.disputes (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	resolved_at timestamptz NULL,
+	deposit_id int8 NOT NULL,
+	state text NOT NULL,
+	reason text NOT NULL,
+	chargeback_change_id int8 NULL,
+	CONSTRAINT disputes_pkey PRIMARY KEY (id),
+	CONSTRAINT fk_disputes_deposit FOREIGN KEY (deposit_id) REFERENCES deposits(id),
+	CONSTRAINT fk_disputes_chargeback_change FOREIGN KEY (chargeback_change_id) REFERENCES balance_changes(id)
+);
+
+CREATE INDEX disputes_deposit_id_idx ON public.disputes (deposit_id);
@@ -0,0 +1 @@
+ALTER TABLE public.wallets DROP COLUMN IF EXISTS credit_limit;
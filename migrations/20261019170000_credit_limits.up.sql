@@ -0,0 +1,3 @@
+-- Balances were already stored as signed integers, so existing rows are left
+-- as they are. Every wallet starts without credit.
+ALTER TABLE public.wallets ADD COLUMN credit_limit int8 NOT NULL DEFAULT 0;
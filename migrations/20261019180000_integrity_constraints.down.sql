@@ -0,0 +1,20 @@
+DROP INDEX IF EXISTS public.balance_changes_wallet_id_id_idx;
+
+ALTER TABLE public.balance_changes
+	DROP CONSTRAINT IF EXISTS balance_changes_balance_after_check,
+	DROP CONSTRAINT IF EXISTS balance_changes_debt_check,
+	DROP CONSTRAINT IF EXISTS balance_changes_operation_check,
+	DROP CONSTRAINT IF EXISTS balance_changes_amount_check,
+	ALTER COLUMN wallet_id DROP NOT NULL,
+	ALTER COLUMN balance_after DROP NOT NULL,
+	ALTER COLUMN balance_before DROP NOT NULL,
+	ALTER COLUMN operation DROP NOT NULL,
+	ALTER COLUMN amount DROP NOT NULL;
+
+ALTER TABLE public.wallets
+	DROP CONSTRAINT IF EXISTS wallets_debt_check,
+	DROP CONSTRAINT IF EXISTS wallets_pending_balance_check,
+	DROP CONSTRAINT IF EXISTS wallets_balance_check,
+	DROP CONSTRAINT IF EXISTS wallets_credit_limit_check,
+	ALTER COLUMN balance DROP NOT NULL,
+	ALTER COLUMN name DROP NOT NULL;
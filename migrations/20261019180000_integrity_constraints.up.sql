@@ -0,0 +1,29 @@
+-- Wallets were always created with a name, but nothing enforced it.
+UPDATE public.wallets SET name = '' WHERE name IS NULL;
+UPDATE public.wallets SET balance = 0 WHERE balance IS NULL;
+
+ALTER TABLE public.wallets
+	ALTER COLUMN name SET NOT NULL,
+	ALTER COLUMN balance SET NOT NULL,
+	ADD CONSTRAINT wallets_credit_limit_check CHECK (credit_limit >= 0),
+	ADD CONSTRAINT wallets_balance_check CHECK (balance >= -credit_limit),
+	ADD CONSTRAINT wallets_pending_balance_check CHECK (pending_balance >= 0),
+	ADD CONSTRAINT wallets_debt_check CHECK (debt >= 0);
+
+-- Debt is repaid before crediting the balance, so it's the balance net of
+-- debt that moves by exactly `amount`.
+ALTER TABLE public.balance_changes
+	ALTER COLUMN amount SET NOT NULL,
+	ALTER COLUMN operation SET NOT NULL,
+	ALTER COLUMN balance_before SET NOT NULL,
+	ALTER COLUMN balance_after SET NOT NULL,
+	ALTER COLUMN wallet_id SET NOT NULL,
+	ADD CONSTRAINT balance_changes_amount_check CHECK (amount > 0),
+	ADD CONSTRAINT balance_changes_operation_check CHECK (operation IN ('ADD', 'SUBSTRACT')),
+	ADD CONSTRAINT balance_changes_debt_check CHECK (debt_before >= 0 AND debt_after >= 0),
+	ADD CONSTRAINT balance_changes_balance_after_check CHECK (
+		(operation = 'ADD' AND balance_after - debt_after = balance_before - debt_before + amount) OR
+		(operation = 'SUBSTRACT' AND balance_after - debt_after = balance_before - debt_before - amount)
+	);
+
+CREATE INDEX balance_changes_wallet_id_id_idx ON public.balance_changes (wallet_id, id);
@@ -0,0 +1,2 @@
+ALTER TABLE public.balance_changes DROP COLUMN IF EXISTS api_key_id;
+DROP TABLE IF EXISTS public.api_keys;
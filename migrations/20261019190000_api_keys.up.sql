@@ -0,0 +1,17 @@
+CREATE TABLE public.api_keys (
+	id bigserial NOT NULL,
+	created_at timestamptz default current_timestamp,
+	name text NOT NULL,
+	prefix text NOT NULL,
+	key_hash text NOT NULL,
+	scopes text[] NOT NULL,
+	revoked_at timestamptz NULL,
+	CONSTRAINT api_keys_pkey PRIMARY KEY (id),
+	CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash)
+);
+
+-- Changes made by the service itself, e.g. refunds of failed withdrawals,
+-- have no key.
+ALTER TABLE public.balance_changes
+	ADD COLUMN api_key_id int8 NULL,
+	ADD CONSTRAINT fk_balance_changes_api_key FOREIGN KEY (api_key_id) REFERENCES api_keys(id);
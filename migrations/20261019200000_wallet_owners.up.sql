@@ -0,0 +1,3 @@
+ALTER TABLE public.wallets ADD COLUMN owner_id text NULL;
+
+CREATE INDEX wallets_owner_id_idx ON public.wallets (owner_id);
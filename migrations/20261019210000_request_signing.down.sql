@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.request_nonces;
+ALTER TABLE public.api_keys DROP COLUMN IF EXISTS signing_secret;
@@ -0,0 +1,13 @@
+-- Kept as is, unlike the keys, since signatures are checked with it. Only
+-- keys created for signing have one.
+ALTER TABLE public.api_keys ADD COLUMN signing_secret text NULL;
+
+CREATE TABLE public.request_nonces (
+	api_key_id int8 NOT NULL,
+	nonce text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	CONSTRAINT request_nonces_pkey PRIMARY KEY (api_key_id, nonce),
+	CONSTRAINT fk_request_nonces_api_key FOREIGN KEY (api_key_id) REFERENCES api_keys(id) ON DELETE CASCADE
+);
+
+CREATE INDEX request_nonces_expires_at_idx ON public.request_nonces (expires_at);
@@ -0,0 +1,11 @@
+-- Token buckets shared by every replica, when rate limits are kept in
+-- Postgres. `allowed` tells whether the last request got a token.
+CREATE UNLOGGED TABLE public.rate_limit_buckets (
+	key text NOT NULL,
+	tokens float8 NOT NULL,
+	allowed bool NOT NULL,
+	updated_at timestamptz NOT NULL,
+	CONSTRAINT rate_limit_buckets_pkey PRIMARY KEY (key)
+);
+
+CREATE INDEX rate_limit_buckets_updated_at_idx ON public.rate_limit_buckets (updated_at);
@@ -0,0 +1,36 @@
+CREATE TABLE public.audit_events (
+	id bigserial NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT current_timestamp,
+	action text NOT NULL,
+	-- api_key, owner or system. System events have no actor_id.
+	actor_type text NOT NULL,
+	actor_id text NULL,
+	-- Events raised outside of a request, e.g. by retries, have neither.
+	source_ip text NULL,
+	request_id text NULL,
+	entity_type text NOT NULL,
+	entity_id int8 NOT NULL,
+	-- {"<field>": {"before": ..., "after": ...}} for every field that changed.
+	diff jsonb NOT NULL,
+	reason text NULL,
+	CONSTRAINT audit_events_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX audit_events_created_at_idx ON public.audit_events (created_at);
+CREATE INDEX audit_events_entity_idx ON public.audit_events (entity_type, entity_id);
+CREATE INDEX audit_events_actor_idx ON public.audit_events (actor_type, actor_id);
+
+-- Events can be added, but never changed or removed.
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update_or_delete
+	BEFORE UPDATE OR DELETE ON public.audit_events
+	FOR EACH ROW EXECUTE PROCEDURE public.audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+	BEFORE TRUNCATE ON public.audit_events
+	FOR EACH STATEMENT EXECUTE PROCEDURE public.audit_events_append_only();
@@ -0,0 +1 @@
+ALTER TABLE public.outbox DROP COLUMN IF EXISTS claimed_until;
@@ -0,0 +1,3 @@
+-- Relays claim events for a while before publishing them, instead of holding
+-- row locks while they're published.
+ALTER TABLE public.outbox ADD COLUMN claimed_until timestamptz NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.withdrawals_unsettled_idx;
+ALTER TABLE public.withdrawals DROP COLUMN IF EXISTS next_attempt_at;
@@ -0,0 +1,6 @@
+-- Withdrawals that aren't settled are picked up again once they're due, be it
+-- to retry their payout, or because whoever was processing them went away.
+ALTER TABLE public.withdrawals ADD COLUMN next_attempt_at timestamptz NOT NULL DEFAULT current_timestamp;
+
+CREATE INDEX withdrawals_unsettled_idx ON public.withdrawals (next_attempt_at)
+	WHERE state IN ('pending', 'debited', 'submitted', 'failed_transient', 'failed');
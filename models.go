@@ -1,14 +1,30 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Wallet struct {
 	ID        uint      `json:"id" db:"id"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	Name      string    `json:"name"`
-	Balance   uint64    `json:"balance"`
+	// Balance goes below zero when the wallet spends its credit.
+	Balance int64 `json:"balance"`
+	// CreditLimit is how far below zero the balance is allowed to go.
+	CreditLimit uint64 `json:"credit_limit" db:"credit_limit"`
+	// PendingBalance are funds on their way to the wallet, which can't be
+	// spent until they clear.
+	PendingBalance uint64 `json:"pending_balance" db:"pending_balance"`
+	// Debt is what the wallet owes after being charged more than its
+	// balance, e.g. by a lost dispute. Funds added later repay it first.
+	Debt uint64 `json:"debt"`
+	// OwnerID is who the wallet belongs to, as identified by the bearer
+	// tokens they authenticate with. Wallets without one are only reachable
+	// with API keys.
+	OwnerID *string `json:"owner_id" db:"owner_id"`
 }
 
 const (
@@ -21,9 +37,213 @@ type BalanceChange struct {
 	CreatedAt     time.Time `json:"created_at" db:"created_at"`
 	Amount        uint64    `json:"amount"`
 	Operation     string    `json:"operation"`
-	BalanceBefore uint64    `json:"balance_before" db:"balance_before"`
-	BalanceAfter  uint64    `json:"balance_after" db:"balance_after"`
+	BalanceBefore int64     `json:"balance_before" db:"balance_before"`
+	BalanceAfter  int64     `json:"balance_after" db:"balance_after"`
+	DebtBefore    uint64    `json:"debt_before" db:"debt_before"`
+	DebtAfter     uint64    `json:"debt_after" db:"debt_after"`
 	Reference     string    `json:"reference"`
 	Wallet        *Wallet   `json:"-"`
 	WalletID      uint      `json:"wallet_id" db:"wallet_id"`
+	// APIKeyID is the key of the request that made the change, if any.
+	APIKeyID *uint `json:"api_key_id" db:"api_key_id"`
+}
+
+type WalletBalance struct {
+	WalletID uint      `json:"wallet_id"`
+	At       time.Time `json:"at"`
+	Balance  int64     `json:"balance"`
+}
+
+type BalanceSnapshot struct {
+	WalletID uint      `json:"wallet_id" db:"wallet_id"`
+	Day      time.Time `json:"day" db:"day"`
+	Balance  int64     `json:"balance"`
+}
+
+const (
+	EventWalletCreated  string = "wallet.created"
+	EventBalanceChanged string = "wallet.balance_changed"
+	EventLowBalance     string = "wallet.low_balance"
+)
+
+var EventTypes = []string{
+	EventWalletCreated,
+	EventBalanceChanged,
+	EventLowBalance,
+}
+
+type OutboxEvent struct {
+	ID          uint            `json:"id" db:"id"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	EventType   string          `json:"event_type" db:"event_type"`
+	AggregateID uint            `json:"aggregate_id" db:"aggregate_id"`
+	Payload     json.RawMessage `json:"payload"`
+	PublishedAt *time.Time      `json:"published_at" db:"published_at"`
+	// ClaimedUntil is when the relay publishing the event gives up on it.
+	ClaimedUntil *time.Time `json:"-" db:"claimed_until"`
+}
+
+type WebhookSubscription struct {
+	ID         uint           `json:"id" db:"id"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+	URL        string         `json:"url" db:"url"`
+	EventTypes pq.StringArray `json:"event_types" db:"event_types"`
+	Secret     string         `json:"secret,omitempty" db:"secret"`
+	Active     bool           `json:"active" db:"active"`
+}
+
+const (
+	DeliveryPending   string = "pending"
+	DeliveryDelivered string = "delivered"
+	DeliveryDead      string = "dead"
+)
+
+type WebhookDelivery struct {
+	ID             uint            `json:"id" db:"id"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+	SubscriptionID uint            `json:"subscription_id" db:"subscription_id"`
+	EventID        uint            `json:"event_id" db:"event_id"`
+	EventType      string          `json:"event_type" db:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError      *string         `json:"last_error" db:"last_error"`
+	DeliveredAt    *time.Time      `json:"delivered_at" db:"delivered_at"`
+}
+
+const (
+	WithdrawalPending         string = "pending"
+	WithdrawalDebited         string = "debited"
+	WithdrawalSubmitted       string = "submitted"
+	WithdrawalFailedTransient string = "failed_transient"
+	WithdrawalCompleted       string = "completed"
+	// WithdrawalUnresolved means the payout ran out of attempts without a
+	// definite answer, so it may or may not have gone through. The funds stay
+	// debited until the provider reports the outcome.
+	WithdrawalUnresolved string = "unresolved"
+	// WithdrawalFailed means the payout failed for good, and the debited
+	// funds are yet to be refunded.
+	WithdrawalFailed   string = "failed"
+	WithdrawalRefunded string = "refunded"
+	// WithdrawalRejected means the wallet couldn't cover the withdrawal, so
+	// nothing was debited.
+	WithdrawalRejected string = "rejected"
+)
+
+type Withdrawal struct {
+	ID                uint      `json:"id" db:"id"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
+	WalletID          uint      `json:"wallet_id" db:"wallet_id"`
+	Amount            uint64    `json:"amount"`
+	Destination       string    `json:"destination"`
+	State             string    `json:"state"`
+	Attempts          int       `json:"attempts"`
+	IdempotencyKey    string    `json:"idempotency_key" db:"idempotency_key"`
+	DebitChangeID     *uint     `json:"debit_change_id" db:"debit_change_id"`
+	RefundChangeID    *uint     `json:"refund_change_id" db:"refund_change_id"`
+	ProviderReference *string   `json:"provider_reference" db:"provider_reference"`
+	LastError         *string   `json:"last_error" db:"last_error"`
+	NextAttemptAt     time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+}
+
+const (
+	DepositInitiated string = "initiated"
+	DepositPending   string = "pending"
+	DepositCleared   string = "cleared"
+	DepositFailed    string = "failed"
+	// DepositDisputed means the payer disputed a cleared deposit. The funds
+	// stay in the wallet until the dispute is resolved.
+	DepositDisputed    string = "disputed"
+	DepositChargedBack string = "charged_back"
+)
+
+type Deposit struct {
+	ID                 uint      `json:"id" db:"id"`
+	CreatedAt          time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+	WalletID           uint      `json:"wallet_id" db:"wallet_id"`
+	Amount             uint64    `json:"amount"`
+	State              string    `json:"state"`
+	ProviderReference  *string   `json:"provider_reference" db:"provider_reference"`
+	ClearChangeID      *uint     `json:"clear_change_id" db:"clear_change_id"`
+	ChargebackChangeID *uint     `json:"chargeback_change_id" db:"chargeback_change_id"`
+}
+
+const (
+	DisputeOpen string = "open"
+	DisputeWon  string = "won"
+	DisputeLost string = "lost"
+)
+
+type Dispute struct {
+	ID                 uint       `json:"id" db:"id"`
+	CreatedAt          time.Time  `json:"created_at" db:"created_at"`
+	ResolvedAt         *time.Time `json:"resolved_at" db:"resolved_at"`
+	DepositID          uint       `json:"deposit_id" db:"deposit_id"`
+	State              string     `json:"state"`
+	Reason             string     `json:"reason"`
+	ChargebackChangeID *uint      `json:"chargeback_change_id" db:"chargeback_change_id"`
+}
+
+type APIKey struct {
+	ID        uint      `json:"id" db:"id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	Name      string    `json:"name"`
+	// Prefix is the start of the key, enough to tell keys apart without
+	// revealing them.
+	Prefix    string         `json:"prefix"`
+	KeyHash   string         `json:"-" db:"key_hash"`
+	Scopes    pq.StringArray `json:"scopes"`
+	RevokedAt *time.Time     `json:"revoked_at" db:"revoked_at"`
+	// Key is only known, and revealed, when the key is created.
+	Key string `json:"key,omitempty" db:"-"`
+	// SigningSecret signs requests made with the key, instead of sending the
+	// key along. It's only revealed when the key is created.
+	SigningSecret *string `json:"signing_secret,omitempty" db:"signing_secret"`
+}
+
+const (
+	AuditWalletCreated          string = "wallet.created"
+	AuditBalanceChanged         string = "wallet.balance_changed"
+	AuditCreditLimitChanged     string = "wallet.credit_limit_changed"
+	AuditPendingBalanceChanged  string = "wallet.pending_balance_changed"
+	AuditDepositCreated         string = "deposit.created"
+	AuditDepositStateChanged    string = "deposit.state_changed"
+	AuditDisputeOpened          string = "dispute.opened"
+	AuditDisputeResolved        string = "dispute.resolved"
+	AuditWithdrawalCreated      string = "withdrawal.created"
+	AuditWithdrawalStateChanged string = "withdrawal.state_changed"
+	AuditAPIKeyCreated          string = "api_key.created"
+	AuditAPIKeyRevoked          string = "api_key.revoked"
+	AuditWebhookCreated         string = "webhook.created"
+	AuditWebhookUpdated         string = "webhook.updated"
+	AuditWebhookDeleted         string = "webhook.deleted"
+	AuditDeliveryReplayed       string = "webhook_delivery.replayed"
+)
+
+const (
+	ActorAPIKey string = "api_key"
+	ActorOwner  string = "owner"
+	// ActorSystem is the service itself, e.g. retrying a withdrawal, or
+	// applying a provider's callback.
+	ActorSystem string = "system"
+)
+
+// AuditEvent records who changed what, and when. They're never updated nor
+// deleted.
+type AuditEvent struct {
+	ID         uint      `json:"id" db:"id"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	Action     string    `json:"action"`
+	ActorType  string    `json:"actor_type" db:"actor_type"`
+	ActorID    *string   `json:"actor_id" db:"actor_id"`
+	SourceIP   *string   `json:"source_ip" db:"source_ip"`
+	RequestID  *string   `json:"request_id" db:"request_id"`
+	EntityType string    `json:"entity_type" db:"entity_type"`
+	EntityID   uint      `json:"entity_id" db:"entity_id"`
+	// Diff holds the before and after values of the fields that changed.
+	Diff   json.RawMessage `json:"diff"`
+	Reason *string         `json:"reason"`
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+// NewOutboxEvent wraps `data` on a CloudEvent, which becomes the payload that
+// is eventually published.
+func NewOutboxEvent(eventType string, aggregateID uint, data interface{}) (*OutboxEvent, error) {
+	ce, err := NewCloudEvent(eventType, aggregateID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(ce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboxEvent{
+		EventType:   eventType,
+		AggregateID: aggregateID,
+		Payload:     payload,
+	}, nil
+}
+
+type Publisher interface {
+	Publish(context.Context, *OutboxEvent) error
+}
+
+type OutboxStorer interface {
+	ClaimUnpublishedEvents(context.Context, int, time.Duration) ([]OutboxEvent, error)
+	MarkEventsPublished(context.Context, []uint) error
+	ReleaseEvents(context.Context, []uint) error
+}
+
+// outboxClaimLease is how long a relay has to publish the events it claimed,
+// before other relays can claim them.
+const outboxClaimLease = 5 * time.Minute
+
+// OutboxRelay publishes the events written to the outbox table. Delivery is
+// at-least-once: an event that was published but couldn't be marked as such
+// will be published again, so consumers should deduplicate by event ID.
+// Several relays can run side by side, and a failed event is retried after
+// newer ones were published, so events may be published out of order.
+type OutboxRelay struct {
+	store     OutboxStorer
+	publisher Publisher
+	interval  time.Duration
+	batchSize int
+	logger    zerolog.Logger
+}
+
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := r.RelayBatch(ctx)
+		if err != nil {
+			r.logger.Error().Err(err).Msg("relaying outbox events")
+		}
+
+		// A full batch means there's likely a backlog, so keep going.
+		if err == nil && n == r.batchSize && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayBatch claims the oldest unpublished events and publishes them, oldest
+// first, stopping at the first one that fails. No transaction is held open
+// while publishing. It returns how many events were published.
+func (r *OutboxRelay) RelayBatch(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "OutboxRelay.RelayBatch")
+	defer span.End()
+
+	events, err := r.store.ClaimUnpublishedEvents(ctx, r.batchSize, outboxClaimLease)
+	if err != nil {
+		return 0, err
+	}
+
+	var published, unpublished []uint
+	var pubErr error
+	for i := range events {
+		if pubErr == nil {
+			pubErr = r.publisher.Publish(ctx, &events[i])
+		}
+		if pubErr != nil {
+			unpublished = append(unpublished, events[i].ID)
+			continue
+		}
+		published = append(published, events[i].ID)
+	}
+
+	if len(published) > 0 {
+		if err := r.store.MarkEventsPublished(ctx, published); err != nil {
+			return 0, err
+		}
+	}
+	if len(unpublished) > 0 {
+		if err := r.store.ReleaseEvents(ctx, unpublished); err != nil {
+			r.logger.Error().Err(err).Msg("releasing outbox events")
+		}
+	}
+
+	return len(published), pubErr
+}
+
+func NewOutboxRelay(store OutboxStorer, publisher Publisher, interval time.Duration, batchSize int, logger zerolog.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		store:     store,
+		publisher: publisher,
+		interval:  interval,
+		batchSize: batchSize,
+		logger:    logger,
+	}
+}
+
+// NDJSONPublisher writes every event as a line of JSON.
+type NDJSONPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *NDJSONPublisher) Publish(ctx context.Context, ev *OutboxEvent) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, ev.Payload); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(line.Bytes())
+	return err
+}
+
+func NewNDJSONPublisher(w io.Writer) *NDJSONPublisher {
+	return &NDJSONPublisher{
+		w: w,
+	}
+}
+
+func NewStdoutPublisher() *NDJSONPublisher {
+	return NewNDJSONPublisher(os.Stdout)
+}
+
+func NewFilePublisher(path string) (*NDJSONPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewNDJSONPublisher(f), nil
+}
+
+// WebhookPublisher POSTs every event, as a structured CloudEvent, to a fixed URL.
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, ev *OutboxEvent) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(ev.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, CloudEventsContentType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &ErrUnexpectedStatus{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+func NewWebhookPublisher(url string, timeout time.Duration) *WebhookPublisher {
+	return &WebhookPublisher{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// MultiPublisher publishes every event through each of its publishers, in
+// order. It fails as soon as one of them does.
+type MultiPublisher struct {
+	publishers []Publisher
+}
+
+func (p *MultiPublisher) Publish(ctx context.Context, ev *OutboxEvent) error {
+	for _, pub := range p.publishers {
+		if err := pub.Publish(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewMultiPublisher(publishers ...Publisher) *MultiPublisher {
+	return &MultiPublisher{
+		publishers: publishers,
+	}
+}
+
+// NewPublisher builds the Publisher named by `kind`: stdout, file or webhook.
+func NewPublisher(kind, filePath, webhookURL string) (Publisher, error) {
+	switch kind {
+	case "", "stdout":
+		return NewStdoutPublisher(), nil
+	case "file":
+		return NewFilePublisher(filePath)
+	case "webhook":
+		return NewWebhookPublisher(webhookURL, 10*time.Second), nil
+	}
+	return nil, fmt.Errorf("unknown outbox publisher: %s", kind)
+}
+
+type ErrUnexpectedStatus struct {
+	Code int
+}
+
+func (e *ErrUnexpectedStatus) Error() string {
+	return fmt.Sprintf("Unexpected HTTP status: %d", e.Code)
+}
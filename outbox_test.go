@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyOutboxStore struct {
+	Events                   []OutboxEvent
+	MarkEventsPublishedCalls [][]uint
+	ReleaseEventsCalls       [][]uint
+}
+
+func (s *DummyOutboxStore) ClaimUnpublishedEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	return s.Events, nil
+}
+
+func (s *DummyOutboxStore) MarkEventsPublished(ctx context.Context, ids []uint) error {
+	s.MarkEventsPublishedCalls = append(s.MarkEventsPublishedCalls, ids)
+	return nil
+}
+
+func (s *DummyOutboxStore) ReleaseEvents(ctx context.Context, ids []uint) error {
+	s.ReleaseEventsCalls = append(s.ReleaseEventsCalls, ids)
+	return nil
+}
+
+type DummyPublisher struct {
+	PublishCalls        []*OutboxEvent
+	PublishCallsResults []error
+}
+
+func (p *DummyPublisher) Publish(ctx context.Context, ev *OutboxEvent) error {
+	p.PublishCalls = append(p.PublishCalls, ev)
+	err := p.PublishCallsResults[0]
+	p.PublishCallsResults = p.PublishCallsResults[1:]
+	return err
+}
+
+func TestOutboxRelayRelayBatch(t *testing.T) {
+	t.Run("publishes and marks every event", func(t *testing.T) {
+		store := DummyOutboxStore{Events: []OutboxEvent{{ID: 1}, {ID: 2}}}
+		publisher := DummyPublisher{PublishCallsResults: []error{nil, nil}}
+		relay := NewOutboxRelay(&store, &publisher, 0, 10, zerolog.Nop())
+
+		n, err := relay.RelayBatch(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, [][]uint{{1, 2}}, store.MarkEventsPublishedCalls)
+		assert.Empty(t, store.ReleaseEventsCalls)
+	})
+
+	t.Run("stops at the first failure, keeping what was published", func(t *testing.T) {
+		store := DummyOutboxStore{Events: []OutboxEvent{{ID: 1}, {ID: 2}, {ID: 3}}}
+		pubErr := errors.New("Dummy Publish Error")
+		publisher := DummyPublisher{PublishCallsResults: []error{nil, pubErr}}
+		relay := NewOutboxRelay(&store, &publisher, 0, 10, zerolog.Nop())
+
+		n, err := relay.RelayBatch(context.Background())
+		assert.True(t, errors.Is(err, pubErr))
+		assert.Equal(t, 1, n)
+		assert.Equal(t, len(publisher.PublishCalls), 2)
+		assert.Equal(t, [][]uint{{1}}, store.MarkEventsPublishedCalls)
+		assert.Equal(t, [][]uint{{2, 3}}, store.ReleaseEventsCalls, "retried on the next batch")
+	})
+
+	t.Run("stops relaying a backlog once cancelled", func(t *testing.T) {
+		events := make([]OutboxEvent, 2)
+		store := DummyOutboxStore{Events: events}
+		publisher := DummyPublisher{PublishCallsResults: []error{nil, nil}}
+		relay := NewOutboxRelay(&store, &publisher, time.Hour, len(events), zerolog.Nop())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			relay.Run(ctx)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("the relay kept going after being cancelled")
+		}
+	})
+}
+
+func TestNDJSONPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := NewNDJSONPublisher(&buf)
+
+	for _, walletID := range []uint{1, 2} {
+		ev, err := NewOutboxEvent(EventWalletCreated, walletID, &WalletCreatedData{WalletID: walletID})
+		assert.NoError(t, err)
+		assert.NoError(t, publisher.Publish(context.Background(), ev))
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Equal(t, 2, len(lines))
+	var ce CloudEvent
+	assert.NoError(t, json.Unmarshal(lines[1], &ce))
+	assert.Equal(t, "wallets/2", ce.Subject)
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		var received CloudEvent
+		var contentType string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &received)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		ev, err := NewOutboxEvent(EventWalletCreated, 7, &WalletCreatedData{WalletID: 7})
+		assert.NoError(t, err)
+
+		publisher := NewWebhookPublisher(srv.URL, 0)
+		assert.NoError(t, publisher.Publish(context.Background(), ev))
+		assert.Equal(t, CloudEventsContentType, contentType)
+		assert.Equal(t, "wallets/7", received.Subject)
+	})
+
+	t.Run("fails on non-2xx responses", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+
+		publisher := NewWebhookPublisher(srv.URL, 0)
+		err := publisher.Publish(context.Background(), &OutboxEvent{ID: 7, Payload: []byte(`{}`)})
+		var errStatus *ErrUnexpectedStatus
+		assert.True(t, errors.As(err, &errStatus))
+		assert.Equal(t, http.StatusBadGateway, errStatus.Code)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type PayoutRequest struct {
+	// IdempotencyKey is the same on every attempt of a withdrawal, so the
+	// provider pays out at most once no matter how many times it's retried.
+	IdempotencyKey string
+	WithdrawalID   uint
+	Amount         uint64
+	Destination    string
+}
+
+type PayoutResult struct {
+	ProviderReference string
+	// Pending is set by providers that settle payouts asynchronously, and
+	// report the outcome through a callback later on.
+	Pending bool
+}
+
+// PayoutProvider sends funds out of the system. Failures that make no sense to
+// retry should be returned as ErrPayoutPermanent; any other error is
+// considered transient.
+type PayoutProvider interface {
+	Payout(context.Context, *PayoutRequest) (*PayoutResult, error)
+}
+
+type ErrPayoutPermanent struct {
+	Inner error
+}
+
+func (e *ErrPayoutPermanent) Error() string {
+	return fmt.Sprintf("Permanent payout failure: %v", e.Inner)
+}
+
+func (e *ErrPayoutPermanent) Unwrap() error {
+	return e.Inner
+}
+
+// FakePayoutProvider is an in-process PayoutProvider, for tests and local
+// runs. Each payout consumes the next of the scripted Results; once they run
+// out, payouts succeed. Retries of an already paid out idempotency key succeed
+// without consuming results, like a real provider would. When Async is set,
+// successful payouts are left pending, for a callback to settle them.
+type FakePayoutProvider struct {
+	mu      sync.Mutex
+	Results []error
+	Calls   []PayoutRequest
+	Async   bool
+	paid    map[string]*PayoutResult
+}
+
+func (p *FakePayoutProvider) Payout(ctx context.Context, req *PayoutRequest) (*PayoutResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Calls = append(p.Calls, *req)
+	if res, ok := p.paid[req.IdempotencyKey]; ok {
+		return res, nil
+	}
+
+	if len(p.Results) > 0 {
+		err := p.Results[0]
+		p.Results = p.Results[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &PayoutResult{
+		ProviderReference: fmt.Sprintf("fake-%s", req.IdempotencyKey),
+		Pending:           p.Async,
+	}
+	p.paid[req.IdempotencyKey] = res
+	return res, nil
+}
+
+func NewFakePayoutProvider(results ...error) *FakePayoutProvider {
+	return &FakePayoutProvider{
+		Results: results,
+		paid:    make(map[string]*PayoutResult),
+	}
+}
+
+func NewPayoutProvider(kind string) (PayoutProvider, error) {
+	switch kind {
+	case "", "fake":
+		return NewFakePayoutProvider(), nil
+	}
+	return nil, fmt.Errorf("unknown payout provider: %s", kind)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolGuard turns requests away with a 503 while the DB pool is saturated,
+// rather than letting them queue up for a connection until they time out.
+// The pool counts as saturated while the connections handed out over the
+// last sampling interval waited longer than maxWait on average.
+type PoolGuard struct {
+	stats    func() sql.DBStats
+	maxWait  time.Duration
+	interval time.Duration
+	rejected prometheus.Counter
+
+	mu        sync.Mutex
+	last      sql.DBStats
+	sampledAt time.Time
+	saturated bool
+}
+
+// Saturated tells whether the pool is saturated, sampling its stats again if
+// the last sample is older than the sampling interval.
+func (g *PoolGuard) Saturated(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.sampledAt) < g.interval {
+		return g.saturated
+	}
+
+	current := g.stats()
+	waits := current.WaitCount - g.last.WaitCount
+	g.saturated = waits > 0 &&
+		(current.WaitDuration-g.last.WaitDuration)/time.Duration(waits) > g.maxWait
+	g.last = current
+	g.sampledAt = now
+	return g.saturated
+}
+
+func (g *PoolGuard) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if g.maxWait <= 0 || !g.Saturated(time.Now()) {
+			return next(c)
+		}
+
+		g.rejected.Inc()
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(g.interval.Seconds())+1))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Database connection pool is saturated")
+	}
+}
+
+func NewPoolGuard(db *sql.DB, maxWait time.Duration, reg prometheus.Registerer) *PoolGuard {
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pool_guard_rejected_requests_total",
+		Help:      "Requests turned away with a 503 because the DB pool was saturated.",
+	})
+	reg.MustRegister(rejected)
+
+	return &PoolGuard{
+		stats:    db.Stats,
+		maxWait:  maxWait,
+		interval: time.Second,
+		rejected: rejected,
+		last:     db.Stats(),
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolGuard(t *testing.T) {
+	var stats sql.DBStats
+	guard := &PoolGuard{
+		stats:    func() sql.DBStats { return stats },
+		maxWait:  100 * time.Millisecond,
+		interval: time.Second,
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{Name: "rejected"}),
+	}
+	start := time.Now()
+
+	t.Run("not saturated without waits", func(t *testing.T) {
+		assert.False(t, guard.Saturated(start))
+	})
+
+	t.Run("saturated while waits average over maxWait", func(t *testing.T) {
+		stats.WaitCount = 10
+		stats.WaitDuration = 2 * time.Second
+		assert.False(t, guard.Saturated(start.Add(500*time.Millisecond)), "samples once per interval")
+		assert.True(t, guard.Saturated(start.Add(time.Second)))
+	})
+
+	t.Run("turns requests away with a 503", func(t *testing.T) {
+		e := echo.New()
+		resp := httptest.NewRecorder()
+		ctx := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), resp)
+
+		called := false
+		err := guard.Middleware(func(c echo.Context) error {
+			called = true
+			return nil
+		})(ctx)
+
+		var httpErr *echo.HTTPError
+		assert.True(t, errors.As(err, &httpErr))
+		assert.Equal(t, http.StatusServiceUnavailable, httpErr.Code)
+		assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+		assert.False(t, called)
+		assert.Equal(t, float64(1), testutil.ToFloat64(guard.rejected))
+	})
+
+	t.Run("recovers once waits go back under maxWait", func(t *testing.T) {
+		stats.WaitCount = 20
+		stats.WaitDuration = 2*time.Second + 500*time.Millisecond
+		assert.False(t, guard.Saturated(start.Add(2*time.Second)))
+	})
+}
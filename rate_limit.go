@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+)
+
+// rateLimitSweepInterval is how often limiters forget the idle buckets.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket holding up to Burst requests, refilled with
+// PerMinute of them every minute.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.PerMinute > 0
+}
+
+// perSecond is how many tokens the bucket is refilled with every second.
+func (l RateLimit) perSecond() float64 {
+	return float64(l.PerMinute) / 60
+}
+
+// RefillTime is how long an empty bucket takes to fill up.
+func (l RateLimit) RefillTime() time.Duration {
+	if !l.Enabled() {
+		return 0
+	}
+	return time.Duration(float64(l.Burst) / l.perSecond() * float64(time.Second))
+}
+
+// RateLimitState is what's left in a bucket after taking a token from it.
+type RateLimitState struct {
+	Allowed bool    `db:"allowed"`
+	Tokens  float64 `db:"tokens"`
+}
+
+type RateLimiter interface {
+	// Take takes a token from the bucket `key`, if there's any.
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitState, error)
+}
+
+// RateLimits turns away the requests of the clients, those for the wallets,
+// and those from the IPs, going over their limit with a 429.
+type RateLimits struct {
+	limiter   RateLimiter
+	perClient RateLimit
+	perWallet RateLimit
+	perIP     RateLimit
+	limited   *prometheus.CounterVec
+}
+
+// PerClient limits the requests of each API key, or owner.
+func (l *RateLimits) PerClient(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !l.perClient.Enabled() {
+			return next(c)
+		}
+
+		ctx := c.Request().Context()
+		var key string
+		if k := APIKeyFromContext(ctx); k != nil {
+			key = fmt.Sprintf("client:key:%d", k.ID)
+		} else if o := OwnerFromContext(ctx); o != nil {
+			key = "client:owner:" + o.ID
+		} else {
+			return next(c)
+		}
+		return l.take(c, next, "client", key, l.perClient)
+	}
+}
+
+// PerWallet limits the requests changing each wallet. Reads aren't limited.
+func (l *RateLimits) PerWallet(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		if !l.perWallet.Enabled() || method == http.MethodGet || method == http.MethodHead || c.Param("id") == "" {
+			return next(c)
+		}
+		return l.take(c, next, "wallet", "wallet:"+c.Param("id"), l.perWallet)
+	}
+}
+
+// PerIP limits the requests of each source IP, for the routes that can't tell
+// clients apart otherwise, like provider callbacks.
+func (l *RateLimits) PerIP(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !l.perIP.Enabled() {
+			return next(c)
+		}
+		return l.take(c, next, "ip", "ip:"+c.RealIP(), l.perIP)
+	}
+}
+
+func (l *RateLimits) take(c echo.Context, next echo.HandlerFunc, name, key string, limit RateLimit) error {
+	state, err := l.limiter.Take(c.Request().Context(), key, limit)
+	if err != nil {
+		// The limits protect the service; they aren't worth failing requests
+		// over.
+		requestLogger(c).Error().Err(err).Str("rate_limit", key).Msg("checking rate limit")
+		return next(c)
+	}
+
+	setRateLimitHeaders(c.Response().Header(), limit, state)
+	if !state.Allowed {
+		l.limited.WithLabelValues(name).Inc()
+		addLogField(c, "rate_limited", key)
+		wait := math.Ceil((1 - state.Tokens) / limit.perSecond())
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Max(wait, 1))))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	return next(c)
+}
+
+// setRateLimitHeaders describes the most restrictive of the limits the
+// request was checked against.
+func setRateLimitHeaders(h http.Header, limit RateLimit, state RateLimitState) {
+	remaining := int(math.Floor(state.Tokens))
+	if prev := h.Get(HeaderRateLimitRemaining); prev != "" {
+		if n, err := strconv.Atoi(prev); err == nil && n <= remaining {
+			return
+		}
+	}
+	reset := math.Ceil((float64(limit.Burst) - state.Tokens) / limit.perSecond())
+	h.Set(HeaderRateLimitLimit, strconv.Itoa(limit.Burst))
+	h.Set(HeaderRateLimitRemaining, strconv.Itoa(remaining))
+	h.Set(HeaderRateLimitReset, strconv.Itoa(int(reset)))
+}
+
+func NewRateLimits(limiter RateLimiter, perClient, perWallet, perIP RateLimit, reg prometheus.Registerer) *RateLimits {
+	limited := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests turned away with a 429, by limit: client, wallet or ip.",
+	}, []string{"limit"})
+	reg.MustRegister(limited)
+
+	return &RateLimits{
+		limiter:   limiter,
+		perClient: perClient,
+		perWallet: perWallet,
+		perIP:     perIP,
+		limited:   limited,
+	}
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimiter is a RateLimiter for single-replica deployments.
+type MemoryRateLimiter struct {
+	// idle is how long buckets are kept after their last request.
+	idle time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateLimitState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updatedAt: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*limit.perSecond())
+	b.updatedAt = now
+
+	if b.tokens < 1 {
+		return RateLimitState{Tokens: b.tokens}, nil
+	}
+	b.tokens--
+	return RateLimitState{Allowed: true, Tokens: b.tokens}, nil
+}
+
+// Sweep forgets the buckets idle long enough to be full again.
+func (l *MemoryRateLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for key, b := range l.buckets {
+		if now.Sub(b.updatedAt) >= l.idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Run sweeps the limiter until `ctx` is done.
+func (l *MemoryRateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Sweep()
+		}
+	}
+}
+
+func NewMemoryRateLimiter(idle time.Duration) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		idle:    idle,
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// PostgresRateLimiter is a RateLimiter shared by every replica. Buckets are
+// refilled by the DB's clock, so the replicas' don't need to agree.
+type PostgresRateLimiter struct {
+	db     DbExecutor
+	idle   time.Duration
+	logger zerolog.Logger
+}
+
+func (l *PostgresRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateLimitState, error) {
+	span := startStoreSpan(ctx, "PostgresRateLimiter.Take", "upsert_rate_limit_bucket")
+	defer span.End()
+
+	// The SET expressions all see the bucket as it was before the request.
+	var state RateLimitState
+	err := l.db.Get(&state, `INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::float8 - 1, true, current_timestamp)
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE
+				WHEN LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM current_timestamp - b.updated_at) * $3::float8) >= 1
+				THEN LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM current_timestamp - b.updated_at) * $3::float8) - 1
+				ELSE LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM current_timestamp - b.updated_at) * $3::float8)
+			END,
+			allowed = LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM current_timestamp - b.updated_at) * $3::float8) >= 1,
+			updated_at = current_timestamp
+		RETURNING allowed, tokens`, key, limit.Burst, limit.perSecond())
+	if err != nil {
+		return RateLimitState{}, failSpan(span, err)
+	}
+
+	return state, nil
+}
+
+// Sweep forgets the buckets idle long enough to be full again.
+func (l *PostgresRateLimiter) Sweep(ctx context.Context) error {
+	span := startStoreSpan(ctx, "PostgresRateLimiter.Sweep", "delete_rate_limit_buckets")
+	defer span.End()
+
+	if _, err := l.db.Exec(`DELETE FROM rate_limit_buckets
+		WHERE updated_at <= current_timestamp - $1::float8 * interval '1 second'`, l.idle.Seconds()); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+// Run sweeps the limiter until `ctx` is done.
+func (l *PostgresRateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Sweep(ctx); err != nil {
+				l.logger.Error().Err(err).Msg("sweeping rate limit buckets")
+			}
+		}
+	}
+}
+
+func NewPostgresRateLimiter(db DbExecutor, idle time.Duration, logger zerolog.Logger) *PostgresRateLimiter {
+	return &PostgresRateLimiter{
+		db:     db,
+		idle:   idle,
+		logger: logger,
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := NewMemoryRateLimiter(time.Minute)
+	l.now = func() time.Time { return now }
+	limit := RateLimit{PerMinute: 60, Burst: 3}
+
+	t.Run("allows bursts up to the limit", func(t *testing.T) {
+		for want := 2; want >= 0; want-- {
+			state, err := l.Take(ctx, "a", limit)
+			assert.NoError(t, err)
+			assert.True(t, state.Allowed)
+			assert.Equal(t, float64(want), state.Tokens)
+		}
+		state, err := l.Take(ctx, "a", limit)
+		assert.NoError(t, err)
+		assert.False(t, state.Allowed)
+
+		// Buckets are per key.
+		state, err = l.Take(ctx, "b", limit)
+		assert.NoError(t, err)
+		assert.True(t, state.Allowed)
+	})
+
+	t.Run("refills buckets over time", func(t *testing.T) {
+		now = now.Add(1500 * time.Millisecond)
+		state, err := l.Take(ctx, "a", limit)
+		assert.NoError(t, err)
+		assert.True(t, state.Allowed)
+		assert.InDelta(t, 0.5, state.Tokens, 0.001)
+
+		now = now.Add(time.Hour)
+		state, err = l.Take(ctx, "a", limit)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(2), state.Tokens, "never over the burst")
+	})
+
+	t.Run("forgets idle buckets", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		l.Take(ctx, "c", limit)
+		l.Sweep()
+		assert.Len(t, l.buckets, 1)
+		assert.Contains(t, l.buckets, "c")
+	})
+}
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateLimitState, error) {
+	return RateLimitState{}, errors.New("connection refused")
+}
+
+func TestRateLimits(t *testing.T) {
+	serve := func(limits *RateLimits, req *http.Request) *httptest.ResponseRecorder {
+		e := echo.New()
+		g := e.Group("/wallets", limits.PerClient, limits.PerWallet)
+		g.GET("/:id", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+		g.POST("/:id/balance-changes", func(c echo.Context) error { return c.NoContent(http.StatusCreated) })
+
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		return resp
+	}
+	post := func(wallet string, scopes ...string) *http.Request {
+		return withAPIKey(httptest.NewRequest(http.MethodPost, "/wallets/"+wallet+"/balance-changes", nil), scopes...)
+	}
+
+	t.Run("HTTP 429 once a wallet's limit is exceeded", func(t *testing.T) {
+		limits := NewRateLimits(NewMemoryRateLimiter(time.Minute), RateLimit{PerMinute: 600, Burst: 100}, RateLimit{PerMinute: 30, Burst: 2}, RateLimit{}, prometheus.NewRegistry())
+
+		resp := serve(limits, post("1"))
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, "2", resp.Header().Get(HeaderRateLimitLimit))
+		assert.Equal(t, "1", resp.Header().Get(HeaderRateLimitRemaining))
+		assert.Equal(t, "2", resp.Header().Get(HeaderRateLimitReset))
+
+		assert.Equal(t, http.StatusCreated, serve(limits, post("1")).Code)
+		resp = serve(limits, post("1"))
+		assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+		assert.Equal(t, "0", resp.Header().Get(HeaderRateLimitRemaining))
+		assert.Equal(t, float64(1), testutil.ToFloat64(limits.limited.WithLabelValues("wallet")))
+
+		// Other wallets, and reads, aren't affected.
+		assert.Equal(t, http.StatusCreated, serve(limits, post("2")).Code)
+		get := withAPIKey(httptest.NewRequest(http.MethodGet, "/wallets/1", nil))
+		assert.Equal(t, http.StatusOK, serve(limits, get).Code)
+	})
+
+	t.Run("HTTP 429 once a client's limit is exceeded", func(t *testing.T) {
+		limits := NewRateLimits(NewMemoryRateLimiter(time.Minute), RateLimit{PerMinute: 60, Burst: 1}, RateLimit{}, RateLimit{}, prometheus.NewRegistry())
+
+		assert.Equal(t, http.StatusCreated, serve(limits, post("1")).Code)
+		resp := serve(limits, post("2"))
+		assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(limits.limited.WithLabelValues("client")))
+
+		// Owners get their own buckets.
+		owner := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+		owner = owner.WithContext(ContextWithOwner(owner.Context(), &Owner{ID: "player-1"}))
+		assert.Equal(t, http.StatusOK, serve(limits, owner).Code)
+	})
+
+	t.Run("reports the most restrictive limit", func(t *testing.T) {
+		limits := NewRateLimits(NewMemoryRateLimiter(time.Minute), RateLimit{PerMinute: 60, Burst: 5}, RateLimit{PerMinute: 60, Burst: 10}, RateLimit{}, prometheus.NewRegistry())
+		resp := serve(limits, post("1"))
+		assert.Equal(t, "5", resp.Header().Get(HeaderRateLimitLimit))
+		assert.Equal(t, "4", resp.Header().Get(HeaderRateLimitRemaining))
+	})
+
+	t.Run("HTTP 429 once an IP's limit is exceeded", func(t *testing.T) {
+		limits := NewRateLimits(NewMemoryRateLimiter(time.Minute), RateLimit{}, RateLimit{}, RateLimit{PerMinute: 60, Burst: 1}, prometheus.NewRegistry())
+		e := echo.New()
+		e.POST("/callbacks/:provider", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, limits.PerIP)
+		callback := func(ip string) int {
+			req := httptest.NewRequest(http.MethodPost, "/callbacks/local", nil)
+			req.RemoteAddr = ip + ":1234"
+			resp := httptest.NewRecorder()
+			e.ServeHTTP(resp, req)
+			return resp.Code
+		}
+
+		assert.Equal(t, http.StatusOK, callback("192.0.2.1"))
+		assert.Equal(t, http.StatusTooManyRequests, callback("192.0.2.1"))
+		assert.Equal(t, float64(1), testutil.ToFloat64(limits.limited.WithLabelValues("ip")))
+		assert.Equal(t, http.StatusOK, callback("192.0.2.2"))
+	})
+
+	t.Run("lets requests through if the limits can't be checked", func(t *testing.T) {
+		limits := NewRateLimits(failingRateLimiter{}, RateLimit{PerMinute: 60, Burst: 1}, RateLimit{PerMinute: 60, Burst: 1}, RateLimit{}, prometheus.NewRegistry())
+		assert.Equal(t, http.StatusCreated, serve(limits, post("1")).Code)
+	})
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 type CreateWalletRequest struct {
-	Name string `json:"name" validate:"required"`
+	Name    string `json:"name" validate:"required"`
+	OwnerID string `json:"owner_id"`
 }
 
 func (r *CreateWalletRequest) Bind(c echo.Context, w *Wallet) error {
@@ -19,6 +24,9 @@ func (r *CreateWalletRequest) Bind(c echo.Context, w *Wallet) error {
 	}
 
 	w.Name = r.Name
+	if r.OwnerID != "" {
+		w.OwnerID = &r.OwnerID
+	}
 	return nil
 }
 
@@ -41,7 +49,6 @@ type ChangeBalanceRequest struct {
 
 func (r *ChangeBalanceRequest) Bind(c echo.Context, bc *BalanceChange) error {
 	if err := c.Bind(r); err != nil {
-		fmt.Println("Bind failed")
 		return err
 	}
 	if err := r.Validate(); err != nil {
@@ -70,6 +77,389 @@ func (r *ChangeBalanceRequest) Validate() *ValidationErrors {
 	return &ve
 }
 
+type CreditLimitRequest struct {
+	CreditLimit *uint64 `json:"credit_limit"`
+}
+
+func (r *CreditLimitRequest) Bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *CreditLimitRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if r.CreditLimit == nil || *r.CreditLimit > math.MaxInt64 {
+		ve.Add("credit_limit", fmt.Sprintf("Should be an integer between 0 and %d", int64(math.MaxInt64)))
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+type BalanceAtRequest struct {
+	At time.Time
+}
+
+func (r *BalanceAtRequest) Bind(c echo.Context) error {
+	err := echo.QueryParamsBinder(c).MustTime("at", &r.At, time.RFC3339).BindError()
+	if err != nil {
+		ve := NewValidationErrors()
+		ve.Add("at", "Should be an RFC3339 timestamp")
+		return &ve
+	}
+	return nil
+}
+
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+func (r *WebhookSubscriptionRequest) Bind(c echo.Context, ws *WebhookSubscription) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	ws.URL = r.URL
+	ws.EventTypes = r.EventTypes
+	if r.Active != nil {
+		ws.Active = *r.Active
+	}
+	return nil
+}
+
+func (r *WebhookSubscriptionRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		ve.Add("url", "Should be an absolute HTTPS URL")
+	}
+
+	if len(r.EventTypes) < 1 {
+		ve.Add("event_types", "Should not be empty")
+	}
+	for _, et := range r.EventTypes {
+		if !isEventType(et) {
+			ve.Add("event_types", fmt.Sprintf("Should be some of: %s", strings.Join(EventTypes, ", ")))
+			break
+		}
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+func isEventType(et string) bool {
+	for _, known := range EventTypes {
+		if et == known {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Signing asks for a secret to sign requests with, too.
+	Signing bool `json:"signing"`
+}
+
+func (r *CreateAPIKeyRequest) Bind(c echo.Context, k *APIKey) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	k.Name = r.Name
+	k.Scopes = r.Scopes
+	return nil
+}
+
+func (r *CreateAPIKeyRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if len(r.Name) < 1 {
+		ve.Add("name", "Should not be empty")
+	}
+
+	if len(r.Scopes) < 1 {
+		ve.Add("scopes", "Should not be empty")
+	}
+	for _, scope := range r.Scopes {
+		if !isScope(scope) {
+			ve.Add("scopes", fmt.Sprintf("Should be some of: %s", strings.Join(Scopes, ", ")))
+			break
+		}
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+func isScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateWithdrawalRequest struct {
+	WalletID       uint   `json:"wallet_id"`
+	Amount         uint64 `json:"amount"`
+	Destination    string `json:"destination"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+func (r *CreateWithdrawalRequest) Bind(c echo.Context, wd *Withdrawal) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	wd.WalletID = r.WalletID
+	wd.Amount = r.Amount
+	wd.Destination = r.Destination
+	wd.IdempotencyKey = r.IdempotencyKey
+	return nil
+}
+
+func (r *CreateWithdrawalRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if r.WalletID < 1 {
+		ve.Add("wallet_id", "Should be a positive integer")
+	}
+	if r.Amount < 1 {
+		ve.Add("amount", "Should be a positive integer")
+	}
+	if len(r.Destination) < 1 {
+		ve.Add("destination", "Should not be empty")
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+type CreateDepositRequest struct {
+	WalletID          uint   `json:"wallet_id"`
+	Amount            uint64 `json:"amount"`
+	ProviderReference string `json:"provider_reference"`
+}
+
+func (r *CreateDepositRequest) Bind(c echo.Context, d *Deposit) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	d.WalletID = r.WalletID
+	d.Amount = r.Amount
+	if r.ProviderReference != "" {
+		d.ProviderReference = &r.ProviderReference
+	}
+	return nil
+}
+
+func (r *CreateDepositRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if r.WalletID < 1 {
+		ve.Add("wallet_id", "Should be a positive integer")
+	}
+	if r.Amount < 1 {
+		ve.Add("amount", "Should be a positive integer")
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+type DepositTransitionRequest struct {
+	State string `json:"state"`
+}
+
+func (r *DepositTransitionRequest) Bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *DepositTransitionRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	switch r.State {
+	case DepositPending, DepositCleared, DepositFailed, DepositChargedBack:
+	default:
+		ve.Add("state", fmt.Sprintf("Should be one of: %s, %s, %s, %s",
+			DepositPending, DepositCleared, DepositFailed, DepositChargedBack))
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+type OpenDisputeRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (r *OpenDisputeRequest) Bind(c echo.Context, ds *Dispute) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	ds.Reason = r.Reason
+	return nil
+}
+
+func (r *OpenDisputeRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if strings.TrimSpace(r.Reason) == "" {
+		ve.Add("reason", "Can't be empty")
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+type ResolveDisputeRequest struct {
+	Outcome string `json:"outcome"`
+}
+
+func (r *ResolveDisputeRequest) Bind(c echo.Context) error {
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *ResolveDisputeRequest) Validate() *ValidationErrors {
+	ve := NewValidationErrors()
+
+	switch r.Outcome {
+	case DisputeWon, DisputeLost:
+	default:
+		ve.Add("outcome", fmt.Sprintf("Should be one of: %s, %s", DisputeWon, DisputeLost))
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
+const (
+	defaultAuditEventsLimit = 100
+	maxAuditEventsLimit     = 1000
+)
+
+type ListAuditEventsRequest struct {
+	Limit int
+}
+
+// Bind reads the filter from the query string. Every filter is optional.
+func (r *ListAuditEventsRequest) Bind(c echo.Context, f *AuditFilter) error {
+	ve := NewValidationErrors()
+
+	b := echo.QueryParamsBinder(c)
+	f.Action = c.QueryParam("action")
+	f.ActorType = c.QueryParam("actor_type")
+	f.ActorID = c.QueryParam("actor_id")
+	f.EntityType = c.QueryParam("entity_type")
+	if err := b.Uint("entity_id", &f.EntityID).BindError(); err != nil {
+		ve.Add("entity_id", "Should be a positive integer")
+	}
+	if err := b.Time("from", &f.From, time.RFC3339).BindError(); err != nil {
+		ve.Add("from", "Should be an RFC3339 timestamp")
+	}
+	if err := b.Time("to", &f.To, time.RFC3339).BindError(); err != nil {
+		ve.Add("to", "Should be an RFC3339 timestamp")
+	}
+	if err := b.Uint("before_id", &f.BeforeID).BindError(); err != nil {
+		ve.Add("before_id", "Should be a positive integer")
+	}
+	r.Limit = defaultAuditEventsLimit
+	if err := b.Int("limit", &r.Limit).BindError(); err != nil {
+		ve.Add("limit", fmt.Sprintf("Should be an integer between 1 and %d", maxAuditEventsLimit))
+	}
+	if ve.HasErrors() {
+		return &ve
+	}
+
+	if err := r.Validate(f); err != nil {
+		return err
+	}
+	f.Limit = r.Limit
+	return nil
+}
+
+func (r *ListAuditEventsRequest) Validate(f *AuditFilter) *ValidationErrors {
+	ve := NewValidationErrors()
+
+	if r.Limit < 1 || r.Limit > maxAuditEventsLimit {
+		ve.Add("limit", fmt.Sprintf("Should be an integer between 1 and %d", maxAuditEventsLimit))
+	}
+
+	switch f.ActorType {
+	case "", ActorAPIKey, ActorOwner, ActorSystem:
+	default:
+		ve.Add("actor_type", fmt.Sprintf("Should be one of: %s, %s, %s", ActorAPIKey, ActorOwner, ActorSystem))
+	}
+
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		ve.Add("to", "Should be after from")
+	}
+
+	if !ve.HasErrors() {
+		return nil
+	}
+	return &ve
+}
+
 type ValidationErrors struct {
 	errors map[string][]string
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/lalvarezguillen/bluelabs-wallets-service/signing"
+)
+
+// nonceSweepInterval is how often nonce stores forget the expired nonces.
+const nonceSweepInterval = time.Minute
+
+// maxSignedBodySize bounds the bodies read to verify signatures, which happens
+// before the request is authenticated.
+const maxSignedBodySize = 1 << 20
+
+type SigningKeyFinder interface {
+	GetSigningKey(context.Context, uint) (*APIKey, error)
+}
+
+// NonceStore remembers the nonces signed requests were sent with, until they
+// expire.
+type NonceStore interface {
+	// Use records the nonce, telling whether it hadn't been used already.
+	Use(ctx context.Context, keyID uint, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// RequestVerifier authenticates signed requests, as described by the signing
+// package.
+type RequestVerifier struct {
+	keys    SigningKeyFinder
+	nonces  NonceStore
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+// Verify returns the key `r` was signed with. `r`'s body is read, and
+// replaced with a copy.
+func (v *RequestVerifier) Verify(r *http.Request) (*APIKey, error) {
+	p, err := signing.ParseHeaders(r.Header)
+	if err != nil {
+		return nil, &ErrInvalidSignature{Inner: err}
+	}
+
+	signedAt := time.Unix(p.Timestamp, 0)
+	if skew := v.now().Sub(signedAt); skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, &ErrInvalidSignature{Inner: errors.New("stale timestamp")}
+	}
+
+	keyID, err := strconv.ParseUint(p.KeyID, 10, 64)
+	if err != nil {
+		return nil, &ErrInvalidSignature{Inner: errors.New("unknown key")}
+	}
+	k, err := v.keys.GetSigningKey(r.Context(), uint(keyID))
+	if err != nil {
+		var errKey *ErrInvalidAPIKey
+		if errors.As(err, &errKey) {
+			return nil, &ErrInvalidSignature{Inner: errors.New("unknown key")}
+		}
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if len(body) > maxSignedBodySize {
+		return nil, &ErrBodyTooLarge{Limit: maxSignedBodySize}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// RequestURI is what the client signed. Requests built in-process, as in
+	// tests, lack it.
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	sts := signing.StringToSign(r.Method, uri, p.Timestamp, p.Nonce, body)
+	if !signing.Verify(*k.SigningSecret, sts, p.Signature) {
+		return nil, &ErrInvalidSignature{Inner: errors.New("signature mismatch")}
+	}
+
+	// Only nonces of genuine requests are recorded, so nobody can burn
+	// someone else's. Past MaxSkew the timestamp check blocks replays.
+	fresh, err := v.nonces.Use(r.Context(), k.ID, p.Nonce, signedAt.Add(v.maxSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, &ErrInvalidSignature{Inner: errors.New("replayed nonce")}
+	}
+
+	return k, nil
+}
+
+// ErrBodyTooLarge means the body of a signed request is larger than what's
+// read to verify its signature.
+type ErrBodyTooLarge struct {
+	Limit int64
+}
+
+func (e *ErrBodyTooLarge) Error() string {
+	return fmt.Sprintf("Request body larger than %d bytes", e.Limit)
+}
+
+func NewRequestVerifier(keys SigningKeyFinder, nonces NonceStore, maxSkew time.Duration) *RequestVerifier {
+	return &RequestVerifier{
+		keys:    keys,
+		nonces:  nonces,
+		maxSkew: maxSkew,
+		now:     time.Now,
+	}
+}
+
+type nonceKey struct {
+	keyID uint
+	nonce string
+}
+
+// MemoryNonceStore is a NonceStore for single-replica deployments.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	nonces map[nonceKey]time.Time
+	now    func() time.Time
+}
+
+func (s *MemoryNonceStore) Use(ctx context.Context, keyID uint, nonce string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := nonceKey{keyID: keyID, nonce: nonce}
+	if exp, ok := s.nonces[k]; ok && exp.After(s.now()) {
+		return false, nil
+	}
+	s.nonces[k] = expiresAt
+	return true, nil
+}
+
+// Sweep forgets the expired nonces.
+func (s *MemoryNonceStore) Sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for k, exp := range s.nonces {
+		if !exp.After(now) {
+			delete(s.nonces, k)
+		}
+	}
+}
+
+// Run sweeps the store until `ctx` is done.
+func (s *MemoryNonceStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(nonceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces: map[nonceKey]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// PostgresNonceStore is a NonceStore shared by every replica.
+type PostgresNonceStore struct {
+	db     DbExecutor
+	logger zerolog.Logger
+}
+
+func (s *PostgresNonceStore) Use(ctx context.Context, keyID uint, nonce string, expiresAt time.Time) (bool, error) {
+	span := startStoreSpan(ctx, "PostgresNonceStore.Use", "insert_request_nonce")
+	defer span.End()
+
+	// An expired nonce may linger until swept; it's taken over, since the
+	// timestamp check already rejects requests that old.
+	res, err := s.db.Exec(`INSERT INTO request_nonces (api_key_id, nonce, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (api_key_id, nonce) DO UPDATE
+		SET expires_at = EXCLUDED.expires_at
+		WHERE request_nonces.expires_at <= current_timestamp`, keyID, nonce, expiresAt)
+	if err != nil {
+		return false, failSpan(span, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, failSpan(span, err)
+	}
+	return n == 1, nil
+}
+
+// Sweep forgets the expired nonces.
+func (s *PostgresNonceStore) Sweep(ctx context.Context) error {
+	span := startStoreSpan(ctx, "PostgresNonceStore.Sweep", "delete_request_nonces")
+	defer span.End()
+
+	if _, err := s.db.Exec(`DELETE FROM request_nonces WHERE expires_at <= current_timestamp`); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+// Run sweeps the store until `ctx` is done.
+func (s *PostgresNonceStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(nonceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sweep(ctx); err != nil {
+				s.logger.Error().Err(err).Msg("sweeping request nonces")
+			}
+		}
+	}
+}
+
+func NewPostgresNonceStore(db DbExecutor, logger zerolog.Logger) *PostgresNonceStore {
+	return &PostgresNonceStore{
+		db:     db,
+		logger: logger,
+	}
+}
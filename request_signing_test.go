@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lalvarezguillen/bluelabs-wallets-service/signing"
+)
+
+type DummySigningKeyFinder map[uint]*APIKey
+
+func (f DummySigningKeyFinder) GetSigningKey(ctx context.Context, id uint) (*APIKey, error) {
+	k, ok := f[id]
+	if !ok {
+		return nil, &ErrInvalidAPIKey{}
+	}
+	return k, nil
+}
+
+func TestRequestVerifier(t *testing.T) {
+	secret := "wss_secret"
+	keys := DummySigningKeyFinder{7: {ID: 7, Scopes: []string{ScopeBalanceCredit}, SigningSecret: &secret}}
+	now := time.Now()
+
+	newVerifier := func() *RequestVerifier {
+		v := NewRequestVerifier(keys, NewMemoryNonceStore(), 5*time.Minute)
+		v.now = func() time.Time { return now }
+		return v
+	}
+	sign := func(signer signing.Signer, method, target, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if signer.Now == nil {
+			signer.Now = func() time.Time { return now }
+		}
+		assert.NoError(t, signer.Sign(req))
+		return req
+	}
+	signer := signing.Signer{KeyID: "7", Secret: secret}
+
+	t.Run("returns the key the request was signed with", func(t *testing.T) {
+		req := sign(signer, http.MethodPost, "/wallets/1/balance-changes?dry=1", `{"amount": 10}`)
+		k, err := newVerifier().Verify(req)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(7), k.ID)
+
+		// The body is still there for the handler.
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"amount": 10}`, string(body))
+	})
+
+	t.Run("fails: replayed request", func(t *testing.T) {
+		v := newVerifier()
+		req := sign(signer, http.MethodPost, "/wallets/1/balance-changes", `{"amount": 10}`)
+		replay := req.Clone(context.Background())
+		replay.Body = ioutil.NopCloser(strings.NewReader(`{"amount": 10}`))
+
+		_, err := v.Verify(req)
+		assert.NoError(t, err)
+		_, err = v.Verify(replay)
+		var errSig *ErrInvalidSignature
+		if assert.True(t, errors.As(err, &errSig)) {
+			assert.EqualError(t, errSig.Inner, "replayed nonce")
+		}
+	})
+
+	t.Run("fails: body too large", func(t *testing.T) {
+		req := sign(signer, http.MethodPost, "/wallets/1/balance-changes", strings.Repeat("a", maxSignedBodySize+1))
+		_, err := newVerifier().Verify(req)
+		var errTooLarge *ErrBodyTooLarge
+		assert.True(t, errors.As(err, &errTooLarge))
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		tamperedBody := sign(signer, http.MethodPost, "/wallets/1/balance-changes", `{"amount": 10}`)
+		tamperedBody.Body = ioutil.NopCloser(strings.NewReader(`{"amount": 10000}`))
+		tamperedPath := sign(signer, http.MethodPost, "/wallets/1/balance-changes", `{"amount": 10}`)
+		tamperedPath.RequestURI = "/wallets/2/balance-changes"
+		missingHeaders := sign(signer, http.MethodGet, "/wallets/1", "")
+		missingHeaders.Header.Del(signing.HeaderNonce)
+
+		cases := map[string]struct {
+			req    *http.Request
+			reason string
+		}{
+			"stale":           {sign(signing.Signer{KeyID: "7", Secret: secret, Now: func() time.Time { return now.Add(-6 * time.Minute) }}, http.MethodGet, "/wallets/1", ""), "stale timestamp"},
+			"from the future": {sign(signing.Signer{KeyID: "7", Secret: secret, Now: func() time.Time { return now.Add(6 * time.Minute) }}, http.MethodGet, "/wallets/1", ""), "stale timestamp"},
+			"unknown key":     {sign(signing.Signer{KeyID: "8", Secret: secret}, http.MethodGet, "/wallets/1", ""), "unknown key"},
+			"malformed key":   {sign(signing.Signer{KeyID: "wsk_abc", Secret: secret}, http.MethodGet, "/wallets/1", ""), "unknown key"},
+			"wrong secret":    {sign(signing.Signer{KeyID: "7", Secret: "wss_forged"}, http.MethodGet, "/wallets/1", ""), "signature mismatch"},
+			"tampered body":   {tamperedBody, "signature mismatch"},
+			"tampered path":   {tamperedPath, "signature mismatch"},
+			"missing headers": {missingHeaders, "missing signature headers"},
+		}
+		for name, tc := range cases {
+			_, err := newVerifier().Verify(tc.req)
+			var errSig *ErrInvalidSignature
+			if assert.True(t, errors.As(err, &errSig), name) {
+				assert.EqualError(t, errSig.Inner, tc.reason, name)
+			}
+		}
+	})
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryNonceStore()
+	s.now = func() time.Time { return now }
+
+	fresh, err := s.Use(ctx, 1, "nonce-1", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+
+	fresh, err = s.Use(ctx, 1, "nonce-1", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.False(t, fresh)
+
+	// Nonces are per key.
+	fresh, err = s.Use(ctx, 2, "nonce-1", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+
+	// Expired nonces are forgotten.
+	now = now.Add(2 * time.Minute)
+	s.Sweep()
+	assert.Empty(t, s.nonces)
+	fresh, err = s.Use(ctx, 1, "nonce-1", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+}
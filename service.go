@@ -1,20 +1,66 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WalletService struct {
-	store WalletStorer
+	store               WalletStorer
+	lowBalanceThreshold uint64
+	metrics             *WalletMetrics
 }
 
-func (s *WalletService) Create(w *Wallet) error {
-	return s.store.Create(w)
+func (s *WalletService) Create(ctx context.Context, w *Wallet) error {
+	ctx, span := startSpan(ctx, "WalletService.Create")
+	defer span.End()
+
+	tx, err := s.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.Create(ctx, w, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	ev, err := NewOutboxEvent(EventWalletCreated, w.ID, NewWalletCreatedData(w))
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	if err := s.store.CreateOutboxEvent(ctx, ev, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditWalletCreated, nil, w, ""); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (s *WalletService) GetByID(id uint) (*Wallet, error) {
-	w, err := s.store.GetByID(id)
+func (s *WalletService) GetByID(ctx context.Context, id uint) (*Wallet, error) {
+	ctx, span := startSpan(ctx, "WalletService.GetByID", trace.WithAttributes(walletIDAttribute(id)))
+	defer span.End()
+
+	w, err := s.store.GetByID(ctx, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &ErrNotFound{Inner: err}
@@ -24,75 +70,291 @@ func (s *WalletService) GetByID(id uint) (*Wallet, error) {
 	return w, nil
 }
 
-func (s *WalletService) ChangeBalance(wID uint, c *BalanceChange) error {
-	tx, err := s.store.BeginTx()
+// BeginTx starts a transaction whose commits and rollbacks are reported to
+// the metrics, and traced within `ctx`.
+func (s *WalletService) BeginTx(ctx context.Context) (TxExecutor, error) {
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{TxExecutor: tx, ctx: ctx, metrics: s.metrics}, nil
+}
+
+// audit records the change of the wallet from `before` to `after` within
+// `tx`. The name and the owner are redacted, as they may identify the owner,
+// and the audit log can't be purged.
+func (s *WalletService) audit(ctx context.Context, tx TxExecutor, action string, before, after *Wallet, reason string) error {
+	var b interface{}
+	if before != nil {
+		b = redactWallet(before)
+	}
+	ev, err := NewAuditEvent(ctx, action, "wallet", after.ID, b, redactWallet(after), reason)
 	if err != nil {
 		return err
 	}
+	return s.store.CreateAuditEvent(ctx, ev, tx)
+}
+
+func redactWallet(w *Wallet) *Wallet {
+	r := *w
+	r.Name = redacted
+	if w.OwnerID != nil {
+		owner := redacted
+		r.OwnerID = &owner
+	}
+	return &r
+}
+
+// lockWallet locks the wallet within `tx`, reporting how long it waited for
+// the lock.
+func (s *WalletService) lockWallet(ctx context.Context, tx TxExecutor, wID uint) (*Wallet, error) {
+	start := time.Now()
+	w, err := s.store.LockAndGetByID(ctx, wID, tx)
+	s.metrics.LockWait.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *WalletService) ChangeBalance(ctx context.Context, wID uint, c *BalanceChange) error {
+	ctx, span := startSpan(ctx, "WalletService.ChangeBalance", trace.WithAttributes(walletIDAttribute(wID)))
+	defer span.End()
 
-	w, err := s.store.LockAndGetByID(wID, tx)
+	tx, err := s.BeginTx(ctx)
 	if err != nil {
+		return err
+	}
+
+	if err := s.ChangeBalanceTx(ctx, tx, wID, c); err != nil {
 		if rbErr := tx.Rollback(); rbErr != nil {
 			return rbErr
 		}
-		if errors.Is(err, sql.ErrNoRows) {
-			return &ErrNotFound{Inner: err}
-		}
 		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ChangeBalanceTx applies the balance change within `tx`, so it can be part of
+// a larger operation. Committing or rolling back is up to the caller.
+func (s *WalletService) ChangeBalanceTx(ctx context.Context, tx TxExecutor, wID uint, c *BalanceChange) error {
+	return s.changeBalanceTx(ctx, tx, wID, c, false)
+}
+
+// ForceDebitTx substracts `c.Amount` from the wallet within `tx`, even if the
+// balance and credit limit can't cover it. Whatever they're short of becomes
+// debt.
+func (s *WalletService) ForceDebitTx(ctx context.Context, tx TxExecutor, wID uint, c *BalanceChange) error {
+	c.Operation = SubstractBalance
+	return s.changeBalanceTx(ctx, tx, wID, c, true)
+}
+
+func (s *WalletService) changeBalanceTx(ctx context.Context, tx TxExecutor, wID uint, c *BalanceChange, allowDebt bool) error {
+	ctx, span := startSpan(ctx, "WalletService.changeBalanceTx", trace.WithAttributes(walletIDAttribute(wID)))
+	defer span.End()
+
+	w, err := s.lockWallet(ctx, tx, wID)
+	if err != nil {
+		return err
+	}
+	before := *w
+
 	c.BalanceBefore = w.Balance
+	c.DebtBefore = w.Debt
 
 	if c.Operation == SubstractBalance {
-		if c.Amount > w.Balance {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				return rbErr
+		// The balance can go as far below zero as the credit limit allows.
+		var available uint64
+		if floor := -int64(w.CreditLimit); w.Balance > floor {
+			available = uint64(w.Balance - floor)
+		}
+		if c.Amount > available {
+			if !allowDebt {
+				s.metrics.InsufficientBalance.Inc()
+				return &ErrInsufficientBalance{}
 			}
-			return &ErrInsufficientBalance{}
+			w.Debt += c.Amount - available
+			w.Balance -= int64(available)
+		} else {
+			w.Balance -= int64(c.Amount)
 		}
-		w.Balance -= c.Amount
 	} else {
-		w.Balance += c.Amount
+		// Any debt is repaid before the funds become spendable.
+		repaid := c.Amount
+		if repaid > w.Debt {
+			repaid = w.Debt
+		}
+		w.Debt -= repaid
+		w.Balance += int64(c.Amount - repaid)
 	}
 
-	if err := s.store.UpdateWallet(w, tx); err != nil {
-		if rbErr := tx.Rollback(); rbErr != nil {
-			return rbErr
-		}
+	if err := s.store.UpdateWallet(ctx, w, tx); err != nil {
 		return err
 	}
 
 	c.WalletID = w.ID
 	c.Wallet = w
+	if k := APIKeyFromContext(ctx); k != nil {
+		c.APIKeyID = &k.ID
+	}
 	c.BalanceAfter = w.Balance
+	c.DebtAfter = w.Debt
+
+	if err := s.store.CreateBalanceChange(ctx, c, tx); err != nil {
+		return err
+	}
+	if err := s.audit(ctx, tx, AuditBalanceChanged, &before, w, c.Reference); err != nil {
+		return err
+	}
+	s.metrics.BalanceChanges.WithLabelValues(c.Operation).Inc()
+	s.metrics.BalanceChangeAmount.WithLabelValues(c.Operation).Add(float64(c.Amount))
+
+	ev, err := NewOutboxEvent(EventBalanceChanged, w.ID, NewBalanceChangedData(c))
+	if err != nil {
+		return err
+	}
+	if err := s.store.CreateOutboxEvent(ctx, ev, tx); err != nil {
+		return err
+	}
+
+	// Only the change that crosses the threshold raises the alert.
+	threshold := int64(s.lowBalanceThreshold)
+	if s.lowBalanceThreshold > 0 && c.BalanceBefore >= threshold && c.BalanceAfter < threshold {
+		ev, err := NewOutboxEvent(EventLowBalance, w.ID, &LowBalanceData{
+			WalletID:  w.ID,
+			Balance:   w.Balance,
+			Threshold: s.lowBalanceThreshold,
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.store.CreateOutboxEvent(ctx, ev, tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetCreditLimit changes how far below zero the wallet's balance can go. The
+// limit can't be lowered below what the wallet already spent on credit.
+func (s *WalletService) SetCreditLimit(ctx context.Context, wID uint, limit uint64) (*Wallet, error) {
+	ctx, span := startSpan(ctx, "WalletService.SetCreditLimit", trace.WithAttributes(walletIDAttribute(wID)))
+	defer span.End()
+
+	tx, err := s.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := s.store.CreateBalanceChange(c, tx); err != nil {
+	w, err := s.lockWallet(ctx, tx, wID)
+	if err != nil {
 		if rbErr := tx.Rollback(); rbErr != nil {
-			return rbErr
+			return nil, rbErr
 		}
-		return err
+		return nil, err
+	}
+
+	if w.Balance < -int64(limit) {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, &ErrCreditLimitBelowOverdraft{Overdraft: uint64(-w.Balance)}
+	}
+
+	before := *w
+	w.CreditLimit = limit
+	if err := s.store.UpdateWallet(ctx, w, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+	if err := s.audit(ctx, tx, AuditCreditLimitChanged, &before, w, ""); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// AdjustPendingBalance adds `delta`, which may be negative, to the funds the
+// wallet has on their way but can't spend yet.
+func (s *WalletService) AdjustPendingBalance(ctx context.Context, tx TxExecutor, wID uint, delta int64) error {
+	ctx, span := startSpan(ctx, "WalletService.AdjustPendingBalance", trace.WithAttributes(walletIDAttribute(wID)))
+	defer span.End()
+
+	w, err := s.lockWallet(ctx, tx, wID)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	if delta < 0 && uint64(-delta) > w.PendingBalance {
+		return fmt.Errorf("pending balance of wallet %d would go negative", wID)
+	}
+	before := *w
+	w.PendingBalance = uint64(int64(w.PendingBalance) + delta)
+
+	if err := s.store.UpdateWallet(ctx, w, tx); err != nil {
+		return err
+	}
+	return s.audit(ctx, tx, AuditPendingBalanceChanged, &before, w, "")
+}
+
+func (s *WalletService) GetBalanceAt(ctx context.Context, wID uint, at time.Time) (*WalletBalance, error) {
+	ctx, span := startSpan(ctx, "WalletService.GetBalanceAt", trace.WithAttributes(walletIDAttribute(wID)))
+	defer span.End()
+
+	if _, err := s.GetByID(ctx, wID); err != nil {
+		return nil, err
+	}
+
+	balance, err := s.store.GetBalanceAt(ctx, wID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WalletBalance{
+		WalletID: wID,
+		At:       at,
+		Balance:  balance,
+	}, nil
 }
 
-func NewWalletService(store WalletStorer) *WalletService {
+// NewWalletService builds a WalletService. Balance changes that leave a wallet
+// below `lowBalanceThreshold` raise a low balance event; 0 disables them.
+func NewWalletService(store WalletStorer, lowBalanceThreshold uint64, metrics *WalletMetrics) *WalletService {
 	return &WalletService{
-		store: store,
+		store:               store,
+		lowBalanceThreshold: lowBalanceThreshold,
+		metrics:             metrics,
 	}
 }
 
 type WalletStorer interface {
-	BeginTx() (TxExecutor, error)
-	Create(*Wallet) error
-	GetByID(uint) (*Wallet, error)
-	LockAndGetByID(uint, TxExecutor) (*Wallet, error)
-	UpdateWallet(*Wallet, TxExecutor) error
-	CreateBalanceChange(*BalanceChange, TxExecutor) error
+	BeginTx(context.Context) (TxExecutor, error)
+	Create(context.Context, *Wallet, TxExecutor) error
+	GetByID(context.Context, uint) (*Wallet, error)
+	LockAndGetByID(context.Context, uint, TxExecutor) (*Wallet, error)
+	UpdateWallet(context.Context, *Wallet, TxExecutor) error
+	CreateBalanceChange(context.Context, *BalanceChange, TxExecutor) error
+	CreateOutboxEvent(context.Context, *OutboxEvent, TxExecutor) error
+	CreateAuditEvent(context.Context, *AuditEvent, TxExecutor) error
+	GetBalanceAt(context.Context, uint, time.Time) (int64, error)
 }
 
 type ErrNotFound struct {
@@ -107,6 +369,14 @@ func (e *ErrNotFound) Unwrap() error {
 	return e.Inner
 }
 
+type ErrCreditLimitBelowOverdraft struct {
+	Overdraft uint64
+}
+
+func (e *ErrCreditLimitBelowOverdraft) Error() string {
+	return fmt.Sprintf("Credit limit can't be lower than the current overdraft of %d", e.Overdraft)
+}
+
 type ErrInsufficientBalance struct {
 }
 
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,6 +33,14 @@ func (d *DummyTx) Get(dest interface{}, stm string, args ...interface{}) error {
 	return nil
 }
 
+func (d *DummyTx) Select(dest interface{}, stm string, args ...interface{}) error {
+	return nil
+}
+
+func (d *DummyTx) Exec(stm string, args ...interface{}) (sql.Result, error) {
+	return nil, nil
+}
+
 func (d *DummyTx) PrepareNamed(stm string) (*sqlx.NamedStmt, error) {
 	return nil, nil
 }
@@ -69,39 +82,84 @@ type DummyWalletStoreAllSucceeds struct {
 	UpdateWalletCalls               []UpdateWalletArgs
 	CreateBalanceChangeCalls        []CreateBalanceChangeArgs
 	CreateBalanceChangeCallsResults []CreateBalanceChangeResult
+	CreateOutboxEventCalls          []*OutboxEvent
+	CreateAuditEventCalls           []*AuditEvent
 }
 
-func (s *DummyWalletStoreAllSucceeds) BeginTx() (TxExecutor, error) {
+func (s *DummyWalletStoreAllSucceeds) BeginTx(ctx context.Context) (TxExecutor, error) {
 	res := s.BeginTxCallsResults[0]
 	s.BeginTxCallsResults = s.BeginTxCallsResults[1:]
 	return res.Tx, res.Err
 }
 
-func (s *DummyWalletStoreAllSucceeds) LockAndGetByID(wID uint, tx TxExecutor) (*Wallet, error) {
+func (s *DummyWalletStoreAllSucceeds) LockAndGetByID(ctx context.Context, wID uint, tx TxExecutor) (*Wallet, error) {
 	res := s.LockAndGetByIdCallsResults[0]
 	s.LockAndGetByIdCallsResults = s.LockAndGetByIdCallsResults[1:]
 	return res.Wallet, res.Err
 }
 
-func (s *DummyWalletStoreAllSucceeds) UpdateWallet(w *Wallet, tx TxExecutor) error {
+func (s *DummyWalletStoreAllSucceeds) UpdateWallet(ctx context.Context, w *Wallet, tx TxExecutor) error {
 	return nil
 }
 
-func (s *DummyWalletStoreAllSucceeds) CreateBalanceChange(c *BalanceChange, tx TxExecutor) error {
+func (s *DummyWalletStoreAllSucceeds) CreateBalanceChange(ctx context.Context, c *BalanceChange, tx TxExecutor) error {
 	c.ID = 1
 	res := s.CreateBalanceChangeCallsResults[0]
 	s.CreateBalanceChangeCallsResults = s.CreateBalanceChangeCallsResults[1:]
 	return res.Err
 }
 
-func (s *DummyWalletStoreAllSucceeds) Create(w *Wallet) error {
+func (s *DummyWalletStoreAllSucceeds) CreateOutboxEvent(ctx context.Context, ev *OutboxEvent, tx TxExecutor) error {
+	s.CreateOutboxEventCalls = append(s.CreateOutboxEventCalls, ev)
+	return nil
+}
+
+func (s *DummyWalletStoreAllSucceeds) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	s.CreateAuditEventCalls = append(s.CreateAuditEventCalls, ev)
+	return nil
+}
+
+func (s *DummyWalletStoreAllSucceeds) Create(ctx context.Context, w *Wallet, tx TxExecutor) error {
+	w.ID = 1
 	return nil
 }
 
-func (s *DummyWalletStoreAllSucceeds) GetByID(id uint) (*Wallet, error) {
+func (s *DummyWalletStoreAllSucceeds) GetByID(ctx context.Context, id uint) (*Wallet, error) {
 	return nil, nil
 }
 
+func (s *DummyWalletStoreAllSucceeds) GetBalanceAt(ctx context.Context, id uint, at time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestWalletServiceCreate(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		owner := "player-1"
+		w := Wallet{Name: "new wallet", OwnerID: &owner}
+
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		assert.NoError(t, service.Create(context.Background(), &w))
+
+		assert.Equal(t, uint(1), w.ID)
+		assert.Equal(t, len(store.CreateOutboxEventCalls), 1)
+		assert.Equal(t, EventWalletCreated, store.CreateOutboxEventCalls[0].EventType)
+		assert.Equal(t, len(store.CreateAuditEventCalls), 1)
+		assert.Equal(t, AuditWalletCreated, store.CreateAuditEventCalls[0].Action)
+		assert.Equal(t, len(tx.CommitCalls), 1)
+
+		// The name and the owner may identify someone, so they're redacted.
+		var diff map[string]auditChange
+		assert.NoError(t, json.Unmarshal(store.CreateAuditEventCalls[0].Diff, &diff))
+		assert.JSONEq(t, `"[REDACTED]"`, string(diff["name"].After))
+		assert.JSONEq(t, `"[REDACTED]"`, string(diff["owner_id"].After))
+		assert.Equal(t, "new wallet", w.Name)
+	})
+}
+
 func TestWalletServiceChangeBalance(t *testing.T) {
 	t.Run("ADD succeeds", func(t *testing.T) {
 		var walletID uint = 1
@@ -117,15 +175,26 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 				{nil},
 			},
 		}
-		service := NewWalletService(&store)
-		err := service.ChangeBalance(walletID, &bc)
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		err := service.ChangeBalance(context.Background(), walletID, &bc)
 		assert.NoError(t, err)
 
 		assert.Equal(t, bc.ID, uint(1))
 		assert.NotNil(t, bc.Wallet)
-		assert.Equal(t, bc.Wallet.Balance, uint64(700))
-		assert.Equal(t, bc.BalanceAfter, uint64(700))
-		assert.Equal(t, bc.BalanceBefore, uint64(500))
+		assert.Equal(t, bc.Wallet.Balance, int64(700))
+		assert.Equal(t, bc.BalanceAfter, int64(700))
+		assert.Equal(t, bc.BalanceBefore, int64(500))
+
+		assert.Equal(t, len(store.CreateOutboxEventCalls), 1)
+		ev := store.CreateOutboxEventCalls[0]
+		assert.Equal(t, EventBalanceChanged, ev.EventType)
+		assert.Equal(t, uint(1), ev.AggregateID)
+		var ce CloudEvent
+		assert.NoError(t, json.Unmarshal(ev.Payload, &ce))
+		assert.Equal(t, EventBalanceChanged, ce.Type)
+		var data BalanceChangedData
+		assert.NoError(t, json.Unmarshal(ce.Data, &data))
+		assert.Equal(t, int64(700), data.BalanceAfter)
 
 		assert.Equal(t, len(tx.CommitCalls), 1)
 		assert.Equal(t, len(tx.RollbackCalls), 0)
@@ -145,20 +214,78 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 				{nil},
 			},
 		}
-		service := NewWalletService(&store)
-		err := service.ChangeBalance(walletID, &bc)
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		err := service.ChangeBalance(context.Background(), walletID, &bc)
 		assert.NoError(t, err)
 
 		assert.Equal(t, bc.ID, uint(1))
 		assert.NotNil(t, bc.Wallet)
-		assert.Equal(t, bc.Wallet.Balance, uint64(300))
-		assert.Equal(t, bc.BalanceAfter, uint64(300))
-		assert.Equal(t, bc.BalanceBefore, uint64(500))
+		assert.Equal(t, bc.Wallet.Balance, int64(300))
+		assert.Equal(t, bc.BalanceAfter, int64(300))
+		assert.Equal(t, bc.BalanceBefore, int64(500))
 
 		assert.Equal(t, len(tx.CommitCalls), 1)
 		assert.Equal(t, len(tx.RollbackCalls), 0)
 	})
 
+	t.Run("records the API key the change was made with", func(t *testing.T) {
+		bc := BalanceChange{Operation: "ADD", Amount: 200}
+
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			BeginTxCallsResults:             []BeginTxResult{{&tx, nil}},
+			LockAndGetByIdCallsResults:      []LockAndGetByIDResults{{&Wallet{Balance: 500, ID: 1}, nil}},
+			CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{{nil}},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		ctx := ContextWithAPIKey(context.Background(), &APIKey{ID: 7})
+		assert.NoError(t, service.ChangeBalance(ctx, 1, &bc))
+
+		if assert.NotNil(t, bc.APIKeyID) {
+			assert.Equal(t, uint(7), *bc.APIKeyID)
+		}
+
+		if assert.Len(t, store.CreateAuditEventCalls, 1) {
+			ev := store.CreateAuditEventCalls[0]
+			assert.Equal(t, AuditBalanceChanged, ev.Action)
+			assert.Equal(t, ActorAPIKey, ev.ActorType)
+			assert.Equal(t, "7", *ev.ActorID)
+			assert.JSONEq(t, `{"balance":{"before":500,"after":700}}`, string(ev.Diff))
+		}
+	})
+
+	t.Run("SUBSTRACT raises low balance event when crossing the threshold", func(t *testing.T) {
+		for _, tc := range []struct {
+			balance int64
+			events  []string
+		}{
+			{balance: 500, events: []string{EventBalanceChanged, EventLowBalance}},
+			{balance: 600, events: []string{EventBalanceChanged}},
+			{balance: 300, events: []string{EventBalanceChanged}},
+		} {
+			bc := BalanceChange{Operation: "SUBSTRACT", Amount: 200}
+
+			tx := DummyTx{}
+			store := DummyWalletStoreAllSucceeds{
+				BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+				LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+					{&Wallet{Balance: tc.balance, ID: 1}, nil},
+				},
+				CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+					{nil},
+				},
+			}
+			service := NewWalletService(&store, 350, NewWalletMetrics(prometheus.NewRegistry()))
+			assert.NoError(t, service.ChangeBalance(context.Background(), 1, &bc))
+
+			var events []string
+			for _, ev := range store.CreateOutboxEventCalls {
+				events = append(events, ev.EventType)
+			}
+			assert.Equal(t, tc.events, events)
+		}
+	})
+
 	t.Run("SUBSTRACT fails: insufficient balance", func(t *testing.T) {
 		var walletID uint = 1
 		bc := BalanceChange{Operation: "SUBSTRACT", Amount: 200}
@@ -173,16 +300,123 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 				{nil},
 			},
 		}
-		service := NewWalletService(&store)
-		err := service.ChangeBalance(walletID, &bc)
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		err := service.ChangeBalance(context.Background(), walletID, &bc)
 		assert.Error(t, err)
 		var errInsfBal *ErrInsufficientBalance
 		assert.True(t, errors.As(err, &errInsfBal))
+		assert.Equal(t, len(store.CreateOutboxEventCalls), 0)
 
 		assert.Equal(t, len(tx.CommitCalls), 0)
 		assert.Equal(t, len(tx.RollbackCalls), 1)
 	})
 
+	t.Run("ADD repays debt first", func(t *testing.T) {
+		for _, tc := range []struct {
+			debt, debtAfter uint64
+			balanceAfter    int64
+		}{
+			{debt: 50, balanceAfter: 150, debtAfter: 0},
+			{debt: 300, balanceAfter: 0, debtAfter: 100},
+		} {
+			bc := BalanceChange{Operation: "ADD", Amount: 200}
+
+			tx := DummyTx{}
+			store := DummyWalletStoreAllSucceeds{
+				BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+				LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+					{&Wallet{Debt: tc.debt, ID: 1}, nil},
+				},
+				CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+					{nil},
+				},
+			}
+			service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+			assert.NoError(t, service.ChangeBalance(context.Background(), 1, &bc))
+
+			assert.Equal(t, tc.balanceAfter, bc.BalanceAfter)
+			assert.Equal(t, tc.debt, bc.DebtBefore)
+			assert.Equal(t, tc.debtAfter, bc.DebtAfter)
+		}
+	})
+
+	t.Run("ForceDebitTx turns the shortfall into debt", func(t *testing.T) {
+		bc := BalanceChange{Amount: 200}
+
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+				{&Wallet{Balance: 150, Debt: 10, ID: 1}, nil},
+			},
+			CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+				{nil},
+			},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		assert.NoError(t, service.ForceDebitTx(context.Background(), &tx, 1, &bc))
+
+		assert.Equal(t, SubstractBalance, bc.Operation)
+		assert.Equal(t, int64(0), bc.BalanceAfter)
+		assert.Equal(t, uint64(10), bc.DebtBefore)
+		assert.Equal(t, uint64(60), bc.DebtAfter)
+	})
+
+	t.Run("SUBSTRACT can spend the credit limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			amount       uint64
+			balanceAfter int64
+			err          bool
+		}{
+			{amount: 300, balanceAfter: -200},
+			{amount: 600, balanceAfter: -500},
+			{amount: 601, err: true},
+		} {
+			bc := BalanceChange{Operation: "SUBSTRACT", Amount: tc.amount}
+
+			tx := DummyTx{}
+			store := DummyWalletStoreAllSucceeds{
+				BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+				LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+					{&Wallet{Balance: 100, CreditLimit: 500, ID: 1}, nil},
+				},
+				CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+					{nil},
+				},
+			}
+			service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+			err := service.ChangeBalance(context.Background(), 1, &bc)
+			if tc.err {
+				var errInsfBal *ErrInsufficientBalance
+				assert.True(t, errors.As(err, &errInsfBal))
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.balanceAfter, bc.BalanceAfter)
+			assert.Equal(t, uint64(0), bc.DebtAfter)
+			// Crossing zero doesn't raise low balance events if they're disabled.
+			assert.Len(t, store.CreateOutboxEventCalls, 1)
+		}
+	})
+
+	t.Run("ForceDebitTx spends the credit limit before going into debt", func(t *testing.T) {
+		bc := BalanceChange{Amount: 700}
+
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+				{&Wallet{Balance: 100, CreditLimit: 500, ID: 1}, nil},
+			},
+			CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+				{nil},
+			},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		assert.NoError(t, service.ForceDebitTx(context.Background(), &tx, 1, &bc))
+
+		assert.Equal(t, int64(-500), bc.BalanceAfter)
+		assert.Equal(t, uint64(100), bc.DebtAfter)
+	})
+
 	t.Run("fails: ErrNotFound if Wallet doesn't exist", func(t *testing.T) {
 		var walletID uint = 1
 		bc := BalanceChange{Operation: "ADD", Amount: 200}
@@ -197,8 +431,8 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 				{nil},
 			},
 		}
-		service := NewWalletService(&store)
-		err := service.ChangeBalance(walletID, &bc)
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		err := service.ChangeBalance(context.Background(), walletID, &bc)
 		assert.Error(t, err)
 		var err404 *ErrNotFound
 		assert.True(t, errors.As(err, &err404))
@@ -222,8 +456,8 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 				{dummyErr},
 			},
 		}
-		service := NewWalletService(&store)
-		err := service.ChangeBalance(walletID, &bc)
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		err := service.ChangeBalance(context.Background(), walletID, &bc)
 		assert.Error(t, err)
 		assert.True(t, errors.Is(err, dummyErr))
 
@@ -231,3 +465,62 @@ func TestWalletServiceChangeBalance(t *testing.T) {
 		assert.Equal(t, len(tx.RollbackCalls), 1)
 	})
 }
+
+func TestWalletServiceSetCreditLimit(t *testing.T) {
+	t.Run("Succeeds", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+			LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+				{&Wallet{Balance: -200, CreditLimit: 500, ID: 1}, nil},
+			},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		w, err := service.SetCreditLimit(context.Background(), 1, 200)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(200), w.CreditLimit)
+		assert.Equal(t, len(tx.CommitCalls), 1)
+	})
+
+	t.Run("fails: can't go below the current overdraft", func(t *testing.T) {
+		tx := DummyTx{}
+		store := DummyWalletStoreAllSucceeds{
+			BeginTxCallsResults: []BeginTxResult{{&tx, nil}},
+			LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+				{&Wallet{Balance: -200, CreditLimit: 500, ID: 1}, nil},
+			},
+		}
+		service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+		_, err := service.SetCreditLimit(context.Background(), 1, 100)
+		var errOverdraft *ErrCreditLimitBelowOverdraft
+		assert.True(t, errors.As(err, &errOverdraft))
+		assert.Equal(t, uint64(200), errOverdraft.Overdraft)
+		assert.Equal(t, len(tx.RollbackCalls), 1)
+	})
+}
+
+func TestWalletServiceMetrics(t *testing.T) {
+	tx := DummyTx{}
+	store := DummyWalletStoreAllSucceeds{
+		BeginTxCallsResults: []BeginTxResult{{&tx, nil}, {&tx, nil}},
+		LockAndGetByIdCallsResults: []LockAndGetByIDResults{
+			{&Wallet{Balance: 500, ID: 1}, nil},
+			{&Wallet{Balance: 500, ID: 1}, nil},
+		},
+		CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{
+			{nil},
+		},
+	}
+	metrics := NewWalletMetrics(prometheus.NewRegistry())
+	service := NewWalletService(&store, 0, metrics)
+
+	assert.NoError(t, service.ChangeBalance(context.Background(), 1, &BalanceChange{Operation: SubstractBalance, Amount: 200}))
+	assert.Error(t, service.ChangeBalance(context.Background(), 1, &BalanceChange{Operation: SubstractBalance, Amount: 600}))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.BalanceChanges.WithLabelValues(SubstractBalance)))
+	assert.Equal(t, float64(200), testutil.ToFloat64(metrics.BalanceChangeAmount.WithLabelValues(SubstractBalance)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.InsufficientBalance))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.Rollbacks))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.CommitDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.LockWait))
+}
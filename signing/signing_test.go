@@ -0,0 +1,85 @@
+package signing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign(t *testing.T) {
+	sts := StringToSign("POST", "/wallets/1/balance-changes", 1700000000, "0123456789abcdef", []byte(`{"amount": 10}`))
+	assert.Equal(t, "POST\n/wallets/1/balance-changes\n1700000000\n0123456789abcdef\n", sts[:len(sts)-64])
+
+	sig := Sign("secret", sts)
+	assert.True(t, strings.HasPrefix(sig, "sha256="))
+	assert.True(t, Verify("secret", sts, sig))
+	assert.False(t, Verify("other", sts, sig))
+	assert.False(t, Verify("secret", sts+"x", sig))
+}
+
+func TestTransport(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	client := NewClient("7", "wss_secret", time.Second)
+	client.Transport.(*Transport).Signer.Now = func() time.Time { return now }
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/wallets/1/balance-changes?dry=1", strings.NewReader(`{"amount": 10}`))
+	assert.NoError(t, err)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// The request given isn't modified.
+	assert.Empty(t, req.Header.Get(HeaderSignature))
+
+	assert.Equal(t, `{"amount": 10}`, string(body))
+	p, err := ParseHeaders(got.Header)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "7", p.KeyID)
+		assert.Equal(t, now.Unix(), p.Timestamp)
+		sts := StringToSign(http.MethodPost, got.RequestURI, p.Timestamp, p.Nonce, body)
+		assert.Equal(t, "/wallets/1/balance-changes?dry=1", got.RequestURI)
+		assert.True(t, Verify("wss_secret", sts, p.Signature))
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	valid := func() http.Header {
+		h := http.Header{}
+		h.Set(HeaderKeyID, "7")
+		h.Set(HeaderTimestamp, strconv.Itoa(1700000000))
+		h.Set(HeaderNonce, "0123456789abcdef")
+		h.Set(HeaderSignature, "sha256=00")
+		return h
+	}
+	_, err := ParseHeaders(valid())
+	assert.NoError(t, err)
+
+	cases := map[string]func(http.Header){
+		"missing key ID":      func(h http.Header) { h.Del(HeaderKeyID) },
+		"missing timestamp":   func(h http.Header) { h.Del(HeaderTimestamp) },
+		"missing signature":   func(h http.Header) { h.Del(HeaderSignature) },
+		"short nonce":         func(h http.Header) { h.Set(HeaderNonce, "abc") },
+		"long nonce":          func(h http.Header) { h.Set(HeaderNonce, strings.Repeat("a", 129)) },
+		"malformed timestamp": func(h http.Header) { h.Set(HeaderTimestamp, "2026-10-19T21:00:00Z") },
+	}
+	for name, breakIt := range cases {
+		h := valid()
+		breakIt(h)
+		_, err := ParseHeaders(h)
+		assert.Error(t, err, name)
+	}
+}
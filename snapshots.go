@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const dateLayout = "2006-01-02"
+
+type BalanceSnapshotStorer interface {
+	LastSnapshotDay(context.Context) (*time.Time, error)
+	FirstBalanceChangeAt(context.Context) (*time.Time, error)
+	CreateDailySnapshots(context.Context, time.Time) error
+}
+
+// BalanceSnapshotter periodically stores each wallet's end-of-day balance, so
+// balance-as-of-time queries don't need to scan a wallet's whole history.
+type BalanceSnapshotter struct {
+	store    BalanceSnapshotStorer
+	interval time.Duration
+	logger   zerolog.Logger
+}
+
+func (s *BalanceSnapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.SnapshotUntil(ctx, time.Now()); err != nil {
+			s.logger.Error().Err(err).Msg("taking balance snapshots")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SnapshotUntil takes the missing snapshots of every day that ended before
+// `until`. Days are snapshotted in order, since each one builds on the previous.
+func (s *BalanceSnapshotter) SnapshotUntil(ctx context.Context, until time.Time) error {
+	ctx, span := startSpan(ctx, "BalanceSnapshotter.SnapshotUntil")
+	defer span.End()
+
+	lastDay, err := s.store.LastSnapshotDay(ctx)
+	if err != nil {
+		return err
+	}
+
+	var day time.Time
+	if lastDay != nil {
+		day = startOfDay(*lastDay).AddDate(0, 0, 1)
+	} else {
+		firstChange, err := s.store.FirstBalanceChangeAt(ctx)
+		if err != nil {
+			return err
+		}
+		if firstChange == nil {
+			return nil
+		}
+		day = startOfDay(*firstChange)
+	}
+
+	for today := startOfDay(until); day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := s.store.CreateDailySnapshots(ctx, day); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewBalanceSnapshotter(store BalanceSnapshotStorer, interval time.Duration, logger zerolog.Logger) *BalanceSnapshotter {
+	return &BalanceSnapshotter{
+		store:    store,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
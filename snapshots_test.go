@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummySnapshotStore struct {
+	LastSnapshotDayResult      *time.Time
+	FirstBalanceChangeAtResult *time.Time
+	CreateDailySnapshotsCalls  []time.Time
+}
+
+func (s *DummySnapshotStore) LastSnapshotDay(ctx context.Context) (*time.Time, error) {
+	return s.LastSnapshotDayResult, nil
+}
+
+func (s *DummySnapshotStore) FirstBalanceChangeAt(ctx context.Context) (*time.Time, error) {
+	return s.FirstBalanceChangeAtResult, nil
+}
+
+func (s *DummySnapshotStore) CreateDailySnapshots(ctx context.Context, day time.Time) error {
+	s.CreateDailySnapshotsCalls = append(s.CreateDailySnapshotsCalls, day)
+	return nil
+}
+
+func TestBalanceSnapshotterSnapshotUntil(t *testing.T) {
+	until := time.Date(2021, 9, 14, 10, 30, 0, 0, time.UTC)
+
+	t.Run("does nothing without balance changes", func(t *testing.T) {
+		store := DummySnapshotStore{}
+		snapshotter := NewBalanceSnapshotter(&store, time.Hour, zerolog.Nop())
+
+		assert.NoError(t, snapshotter.SnapshotUntil(context.Background(), until))
+		assert.Empty(t, store.CreateDailySnapshotsCalls)
+	})
+
+	t.Run("starts from the first balance change", func(t *testing.T) {
+		firstChange := time.Date(2021, 9, 12, 17, 4, 26, 0, time.UTC)
+		store := DummySnapshotStore{FirstBalanceChangeAtResult: &firstChange}
+		snapshotter := NewBalanceSnapshotter(&store, time.Hour, zerolog.Nop())
+
+		assert.NoError(t, snapshotter.SnapshotUntil(context.Background(), until))
+		assert.Equal(t, []time.Time{
+			time.Date(2021, 9, 12, 0, 0, 0, 0, time.UTC),
+			time.Date(2021, 9, 13, 0, 0, 0, 0, time.UTC),
+		}, store.CreateDailySnapshotsCalls)
+	})
+
+	t.Run("continues after the last snapshot", func(t *testing.T) {
+		lastDay := time.Date(2021, 9, 10, 0, 0, 0, 0, time.UTC)
+		store := DummySnapshotStore{LastSnapshotDayResult: &lastDay}
+		snapshotter := NewBalanceSnapshotter(&store, time.Hour, zerolog.Nop())
+
+		assert.NoError(t, snapshotter.SnapshotUntil(context.Background(), until))
+		assert.Equal(t, []time.Time{
+			time.Date(2021, 9, 11, 0, 0, 0, 0, time.UTC),
+			time.Date(2021, 9, 12, 0, 0, 0, 0, time.UTC),
+			time.Date(2021, 9, 13, 0, 0, 0, 0, time.UTC),
+		}, store.CreateDailySnapshotsCalls)
+	})
+
+	t.Run("is up to date once yesterday was snapshotted", func(t *testing.T) {
+		lastDay := time.Date(2021, 9, 13, 0, 0, 0, 0, time.UTC)
+		store := DummySnapshotStore{LastSnapshotDayResult: &lastDay}
+		snapshotter := NewBalanceSnapshotter(&store, time.Hour, zerolog.Nop())
+
+		assert.NoError(t, snapshotter.SnapshotUntil(context.Background(), until))
+		assert.Empty(t, store.CreateDailySnapshotsCalls)
+	})
+}
@@ -1,76 +1,281 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type WalletStore struct {
 	db DbExecutor
 }
 
-func (s *WalletStore) BeginTx() (TxExecutor, error) {
-	return s.db.Beginx()
+func (s *WalletStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	span := startStoreSpan(ctx, "WalletStore.BeginTx", "begin")
+	defer span.End()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, failSpan(span, err)
+	}
+	return tx, nil
 }
 
-func (s *WalletStore) Create(w *Wallet) error {
-	stmt, err := s.db.PrepareNamed("INSERT INTO wallets (name) VALUES (:name) RETURNING id")
+func (s *WalletStore) Create(ctx context.Context, w *Wallet, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WalletStore.Create", "insert_wallet")
+	defer span.End()
+
+	stmt, err := tx.PrepareNamed("INSERT INTO wallets (name, owner_id) VALUES (:name,:owner_id) RETURNING id, created_at")
 	if err != nil {
-		return err
+		return failSpan(span, err)
 	}
 
 	if err := stmt.Get(w, w); err != nil {
-		return err
+		return failSpan(span, err)
 	}
+	span.SetAttributes(walletIDAttribute(w.ID))
 
 	return nil
 }
 
-func (s *WalletStore) GetByID(id uint) (*Wallet, error) {
+func (s *WalletStore) GetByID(ctx context.Context, id uint) (*Wallet, error) {
+	span := startStoreSpan(ctx, "WalletStore.GetByID", "select_wallet", walletIDAttribute(id))
+	defer span.End()
+
 	var w Wallet
 	stm := `SELECT * FROM wallets WHERE id=$1 FOR UPDATE`
 	if err := s.db.Get(&w, stm, id); err != nil {
-		return nil, err
+		return nil, failSpan(span, err)
 	}
 
 	return &w, nil
 }
 
-func (s *WalletStore) LockAndGetByID(id uint, tx TxExecutor) (*Wallet, error) {
+func (s *WalletStore) LockAndGetByID(ctx context.Context, id uint, tx TxExecutor) (*Wallet, error) {
+	span := startStoreSpan(ctx, "WalletStore.LockAndGetByID", "lock_wallet", walletIDAttribute(id))
+	defer span.End()
+
 	var w Wallet
 	fetchWallet := `SELECT * FROM wallets WHERE id=$1 FOR UPDATE`
 	if err := tx.Get(&w, fetchWallet, id); err != nil {
-		return nil, err
+		return nil, failSpan(span, err)
 	}
 
 	return &w, nil
 }
 
-func (s *WalletStore) UpdateWallet(w *Wallet, tx TxExecutor) error {
-	updateWallet, err := tx.PrepareNamed(`UPDATE wallets SET balance=:balance WHERE id=:id RETURNING id`)
+func (s *WalletStore) UpdateWallet(ctx context.Context, w *Wallet, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WalletStore.UpdateWallet", "update_wallet", walletIDAttribute(w.ID))
+	defer span.End()
+
+	updateWallet, err := tx.PrepareNamed(`UPDATE wallets SET balance=:balance, pending_balance=:pending_balance, debt=:debt, credit_limit=:credit_limit WHERE id=:id RETURNING id`)
 	if err != nil {
-		return err
+		return failSpan(span, err)
 	}
 	if err := updateWallet.Get(w, w); err != nil {
-		return err
+		return failSpan(span, err)
 	}
 	return nil
 }
 
-func (s *WalletStore) CreateBalanceChange(bc *BalanceChange, tx TxExecutor) error {
+func (s *WalletStore) CreateBalanceChange(ctx context.Context, bc *BalanceChange, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WalletStore.CreateBalanceChange", "insert_balance_change", walletIDAttribute(bc.WalletID))
+	defer span.End()
+
 	insertChange, err := tx.PrepareNamed(`INSERT INTO balance_changes
-		(wallet_id, operation, amount, balance_before, balance_after, reference)
-		VALUES (:wallet_id,:operation,:amount,:balance_before,:balance_after,:reference)
-		RETURNING id`,
+		(wallet_id, operation, amount, balance_before, balance_after, debt_before, debt_after, reference, api_key_id)
+		VALUES (:wallet_id,:operation,:amount,:balance_before,:balance_after,:debt_before,:debt_after,:reference,:api_key_id)
+		RETURNING id, created_at`,
 	)
 	if err != nil {
-		return err
+		return failSpan(span, err)
 	}
 
 	err = insertChange.Get(bc, bc)
 	if err != nil {
-		return err
+		return failSpan(span, err)
+	}
+
+	return nil
+}
+
+func (s *WalletStore) CreateOutboxEvent(ctx context.Context, ev *OutboxEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WalletStore.CreateOutboxEvent", "insert_outbox_event", walletIDAttribute(ev.AggregateID))
+	defer span.End()
+
+	insertEvent, err := tx.PrepareNamed(`INSERT INTO outbox
+		(event_type, aggregate_id, payload)
+		VALUES (:event_type,:aggregate_id,:payload)
+		RETURNING id, created_at`,
+	)
+	if err != nil {
+		return failSpan(span, err)
 	}
 
+	if err := insertEvent.Get(ev, ev); err != nil {
+		return failSpan(span, err)
+	}
+
+	return nil
+}
+
+func (s *WalletStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WalletStore.CreateAuditEvent", "insert_audit_event")
+	defer span.End()
+
+	if err := insertAuditEvent(tx, ev); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+// ClaimUnpublishedEvents returns the oldest unpublished events, oldest first,
+// claiming them for `lease` so no other relay picks them up while they're
+// being published. Events whose claim ran out are up for grabs again.
+func (s *WalletStore) ClaimUnpublishedEvents(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	span := startStoreSpan(ctx, "WalletStore.ClaimUnpublishedEvents", "claim_unpublished_events")
+	defer span.End()
+
+	var events []OutboxEvent
+	claimEvents := `UPDATE outbox
+		SET claimed_until = current_timestamp + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE published_at IS NULL
+				AND (claimed_until IS NULL OR claimed_until <= current_timestamp)
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`
+	if err := s.db.Select(&events, claimEvents, limit, lease.Seconds()); err != nil {
+		return nil, failSpan(span, err)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+func (s *WalletStore) MarkEventsPublished(ctx context.Context, ids []uint) error {
+	span := startStoreSpan(ctx, "WalletStore.MarkEventsPublished", "mark_events_published")
+	defer span.End()
+
+	markPublished := `UPDATE outbox SET published_at=current_timestamp, claimed_until=NULL WHERE id = ANY($1)`
+	if _, err := s.db.Exec(markPublished, pq.Array(outboxIDs(ids))); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+// ReleaseEvents gives up the claim on events that couldn't be published, so
+// they're retried right away rather than once the claim runs out.
+func (s *WalletStore) ReleaseEvents(ctx context.Context, ids []uint) error {
+	span := startStoreSpan(ctx, "WalletStore.ReleaseEvents", "release_events")
+	defer span.End()
+
+	release := `UPDATE outbox SET claimed_until=NULL WHERE id = ANY($1) AND published_at IS NULL`
+	if _, err := s.db.Exec(release, pq.Array(outboxIDs(ids))); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func outboxIDs(ids []uint) []int64 {
+	ids64 := make([]int64, len(ids))
+	for i, id := range ids {
+		ids64[i] = int64(id)
+	}
+	return ids64
+}
+
+func (s *WalletStore) GetBalanceAt(ctx context.Context, walletID uint, at time.Time) (int64, error) {
+	span := startStoreSpan(ctx, "WalletStore.GetBalanceAt", "select_balance_at", walletIDAttribute(walletID))
+	defer span.End()
+
+	var balance int64
+	var from time.Time
+
+	var snap BalanceSnapshot
+	fetchSnapshot := `SELECT wallet_id, day, balance FROM balance_snapshots
+		WHERE wallet_id=$1 AND day < $2
+		ORDER BY day DESC LIMIT 1`
+	err := s.db.Get(&snap, fetchSnapshot, walletID, startOfDay(at).Format(dateLayout))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, failSpan(span, err)
+	}
+	if err == nil {
+		balance = snap.Balance
+		from = startOfDay(snap.Day).AddDate(0, 0, 1)
+	}
+
+	fetchChange := `SELECT balance_after FROM balance_changes
+		WHERE wallet_id=$1 AND created_at >= $2 AND created_at <= $3
+		ORDER BY created_at DESC, id DESC LIMIT 1`
+	err = s.db.Get(&balance, fetchChange, walletID, from, at)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, failSpan(span, err)
+	}
+
+	return balance, nil
+}
+
+func (s *WalletStore) LastSnapshotDay(ctx context.Context) (*time.Time, error) {
+	span := startStoreSpan(ctx, "WalletStore.LastSnapshotDay", "select_last_snapshot_day")
+	defer span.End()
+
+	var day sql.NullTime
+	if err := s.db.Get(&day, `SELECT max(day) FROM balance_snapshots`); err != nil {
+		return nil, failSpan(span, err)
+	}
+	if !day.Valid {
+		return nil, nil
+	}
+	return &day.Time, nil
+}
+
+func (s *WalletStore) FirstBalanceChangeAt(ctx context.Context) (*time.Time, error) {
+	span := startStoreSpan(ctx, "WalletStore.FirstBalanceChangeAt", "select_first_balance_change")
+	defer span.End()
+
+	var createdAt sql.NullTime
+	if err := s.db.Get(&createdAt, `SELECT min(created_at) FROM balance_changes`); err != nil {
+		return nil, failSpan(span, err)
+	}
+	if !createdAt.Valid {
+		return nil, nil
+	}
+	return &createdAt.Time, nil
+}
+
+// CreateDailySnapshots stores the end-of-day balance of every wallet that had
+// activity on `day`, or a snapshot on the day before it.
+func (s *WalletStore) CreateDailySnapshots(ctx context.Context, day time.Time) error {
+	span := startStoreSpan(ctx, "WalletStore.CreateDailySnapshots", "insert_daily_snapshots")
+	defer span.End()
+
+	day = startOfDay(day)
+	insertSnapshots := `INSERT INTO balance_snapshots (wallet_id, day, balance)
+		SELECT DISTINCT ON (wallet_id) wallet_id, $1::date, balance
+		FROM (
+			SELECT wallet_id, created_at, id, balance_after AS balance
+			FROM balance_changes
+			WHERE created_at >= $2 AND created_at < $3
+			UNION ALL
+			SELECT wallet_id, '-infinity'::timestamptz, 0, balance
+			FROM balance_snapshots
+			WHERE day = $1::date - 1
+		) AS latest
+		ORDER BY wallet_id, created_at DESC, id DESC
+		ON CONFLICT (wallet_id, day) DO NOTHING`
+
+	if _, err := s.db.Exec(insertSnapshots, day.Format(dateLayout), day, day.AddDate(0, 0, 1)); err != nil {
+		return failSpan(span, err)
+	}
 	return nil
 }
 
@@ -82,6 +287,8 @@ func NewWalletStore(db DbExecutor) *WalletStore {
 
 type TxExecutor interface {
 	Get(interface{}, string, ...interface{}) error
+	Select(interface{}, string, ...interface{}) error
+	Exec(string, ...interface{}) (sql.Result, error)
 	PrepareNamed(string) (*sqlx.NamedStmt, error)
 	Commit() error
 	Rollback() error
@@ -89,6 +296,8 @@ type TxExecutor interface {
 
 type DbExecutor interface {
 	Get(interface{}, string, ...interface{}) error
+	Select(interface{}, string, ...interface{}) error
+	Exec(string, ...interface{}) (sql.Result, error)
 	PrepareNamed(string) (*sqlx.NamedStmt, error)
 	Beginx() (*sqlx.Tx, error)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+const balanceChangesChannel = "balance_changes"
+
+// subscriberBuffer is how many balance changes a subscriber can fall behind
+// before being dropped.
+const subscriberBuffer = 16
+
+// BalanceChangeBroker fans out the balance changes notified by Postgres to the
+// subscribers of each wallet. Since every replica listens on its own, changes
+// made through any replica reach every subscriber.
+type BalanceChangeBroker struct {
+	mu      sync.Mutex
+	subs    map[uint]map[chan *BalanceChange]struct{}
+	connStr string
+	logger  zerolog.Logger
+}
+
+// Subscribe returns a channel that receives the wallet's balance changes, and
+// the function that cancels the subscription. The channel is closed if the
+// subscriber falls too far behind.
+func (b *BalanceChangeBroker) Subscribe(walletID uint) (<-chan *BalanceChange, func()) {
+	ch := make(chan *BalanceChange, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[walletID] == nil {
+		b.subs[walletID] = make(map[chan *BalanceChange]struct{})
+	}
+	b.subs[walletID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(walletID, ch)
+	}
+}
+
+func (b *BalanceChangeBroker) Run(ctx context.Context) {
+	listener := pq.NewListener(b.connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			b.logger.Error().Err(err).Msg("listening for balance changes")
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(balanceChangesChannel); err != nil {
+		b.logger.Error().Err(err).Msg("listening for balance changes")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.unsubscribeAll()
+			return
+		case n := <-listener.Notify:
+			// A nil notification means the connection was re-established,
+			// and notifications sent meanwhile were lost.
+			if n == nil {
+				continue
+			}
+			b.dispatch(n.Extra)
+		}
+	}
+}
+
+func (b *BalanceChangeBroker) dispatch(payload string) {
+	var bc BalanceChange
+	if err := json.Unmarshal([]byte(payload), &bc); err != nil {
+		b.logger.Error().Err(err).Msg("decoding balance change notification")
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[bc.WalletID] {
+		select {
+		case ch <- &bc:
+		default:
+			b.remove(bc.WalletID, ch)
+		}
+	}
+}
+
+// unsubscribeAll ends every subscription, so the streams fed by the broker
+// don't hold up the shutdown.
+func (b *BalanceChangeBroker) unsubscribeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for walletID, chans := range b.subs {
+		for ch := range chans {
+			b.remove(walletID, ch)
+		}
+	}
+}
+
+func (b *BalanceChangeBroker) remove(walletID uint, ch chan *BalanceChange) {
+	if _, ok := b.subs[walletID][ch]; !ok {
+		return
+	}
+	delete(b.subs[walletID], ch)
+	if len(b.subs[walletID]) == 0 {
+		delete(b.subs, walletID)
+	}
+	close(ch)
+}
+
+func NewBalanceChangeBroker(connStr string, logger zerolog.Logger) *BalanceChangeBroker {
+	return &BalanceChangeBroker{
+		subs:    make(map[uint]map[chan *BalanceChange]struct{}),
+		connStr: connStr,
+		logger:  logger,
+	}
+}
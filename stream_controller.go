@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const sseHeartbeatInterval = 15 * time.Second
+
+type BalanceChangeSubscriber interface {
+	Subscribe(uint) (<-chan *BalanceChange, func())
+}
+
+type StreamController struct {
+	walletService WalletServiceProvider
+	broker        BalanceChangeSubscriber
+}
+
+// StreamBalanceChanges pushes every new balance change of the wallet, as
+// Server-Sent Events, or as WebSocket messages if the client asks for an
+// upgrade.
+func (h *StreamController) StreamBalanceChanges(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+	addLogField(c, "wallet_id", id)
+
+	if _, err := h.walletService.GetByID(c.Request().Context(), id); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	changes, unsubscribe := h.broker.Subscribe(id)
+	defer unsubscribe()
+
+	if strings.EqualFold(c.Request().Header.Get(echo.HeaderUpgrade), "websocket") {
+		websocket.Server{
+			Handshake: checkWebSocketOrigin,
+			Handler: func(ws *websocket.Conn) {
+				streamWebSocket(ws, changes)
+			},
+		}.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+
+	return streamSSE(c, changes)
+}
+
+func streamSSE(c echo.Context, changes <-chan *BalanceChange) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case bc, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(bc)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: balance_change\ndata: %s\n\n", bc.ID, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+// checkWebSocketOrigin only lets browsers connect from the service's own
+// origin, so other sites can't stream wallets with their visitors'
+// credentials. Other clients don't send an Origin, and are let through: they
+// have to authenticate like any other request.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Host, r.Host) {
+		return fmt.Errorf("cross-origin WebSocket from %s", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func streamWebSocket(ws *websocket.Conn, changes <-chan *BalanceChange) {
+	// Clients aren't expected to send anything: reading only tells us
+	// when they go away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case bc, ok := <-changes:
+			if !ok {
+				ws.Close()
+				return
+			}
+			if err := websocket.JSON.Send(ws, bc); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *StreamController) Register(r *echo.Group) {
+	r.GET("/:id/stream", h.StreamBalanceChanges, RequireScope(ScopeWalletsRead))
+}
+
+func NewStreamController(ws WalletServiceProvider, broker BalanceChangeSubscriber) *StreamController {
+	return &StreamController{
+		walletService: ws,
+		broker:        broker,
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestBalanceChangeBrokerDispatch(t *testing.T) {
+	t.Run("only reaches the wallet's subscribers", func(t *testing.T) {
+		broker := NewBalanceChangeBroker("", zerolog.Nop())
+		changes1, unsubscribe1 := broker.Subscribe(1)
+		defer unsubscribe1()
+		changes2, unsubscribe2 := broker.Subscribe(2)
+		defer unsubscribe2()
+
+		broker.dispatch(`{"id":10,"wallet_id":1,"amount":300,"operation":"ADD","balance_after":300}`)
+
+		bc := <-changes1
+		assert.Equal(t, uint(10), bc.ID)
+		assert.Equal(t, int64(300), bc.BalanceAfter)
+		assert.Equal(t, 0, len(changes2))
+	})
+
+	t.Run("drops subscribers that fall behind", func(t *testing.T) {
+		broker := NewBalanceChangeBroker("", zerolog.Nop())
+		changes, unsubscribe := broker.Subscribe(1)
+
+		for i := 0; i <= subscriberBuffer; i++ {
+			broker.dispatch(`{"id":10,"wallet_id":1}`)
+		}
+
+		for i := 0; i < subscriberBuffer; i++ {
+			<-changes
+		}
+		_, ok := <-changes
+		assert.False(t, ok)
+		unsubscribe()
+	})
+
+	t.Run("ends every subscription when stopping", func(t *testing.T) {
+		broker := NewBalanceChangeBroker("", zerolog.Nop())
+		changes1, unsubscribe1 := broker.Subscribe(1)
+		changes2, unsubscribe2 := broker.Subscribe(2)
+
+		broker.unsubscribeAll()
+		_, ok := <-changes1
+		assert.False(t, ok)
+		_, ok = <-changes2
+		assert.False(t, ok)
+		unsubscribe1()
+		unsubscribe2()
+	})
+}
+
+type DummyBroker struct {
+	Changes chan *BalanceChange
+}
+
+func (b *DummyBroker) Subscribe(walletID uint) (<-chan *BalanceChange, func()) {
+	return b.Changes, func() {}
+}
+
+func TestStreamControllerStreamBalanceChanges(t *testing.T) {
+	t.Run("streams balance changes as SSE", func(t *testing.T) {
+		broker := DummyBroker{Changes: make(chan *BalanceChange, 1)}
+		ctrl := NewStreamController(&DummyWalletService{}, &broker)
+
+		reqCtx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/wallets/1/stream", nil).WithContext(reqCtx)
+
+		e := echo.New()
+		resp := httptest.NewRecorder()
+		ctx := e.NewContext(req, resp)
+		ctx.SetParamNames("id")
+		ctx.SetParamValues("1")
+
+		broker.Changes <- &BalanceChange{ID: 10, WalletID: 1, BalanceAfter: 300}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+
+		assert.NoError(t, ctrl.StreamBalanceChanges(ctx))
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "text/event-stream", resp.Header().Get(echo.HeaderContentType))
+		assert.True(t, strings.HasPrefix(resp.Body.String(), "id: 10\nevent: balance_change\ndata: {"))
+	})
+
+	t.Run("streams balance changes over WebSocket", func(t *testing.T) {
+		broker := DummyBroker{Changes: make(chan *BalanceChange, 1)}
+		e := echo.New()
+		e.GET("/wallets/:id/stream", NewStreamController(&DummyWalletService{}, &broker).StreamBalanceChanges)
+		srv := httptest.NewServer(e)
+		defer srv.Close()
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/wallets/1/stream"
+
+		t.Run("from the service's own origin", func(t *testing.T) {
+			ws, err := websocket.Dial(url, "", srv.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer ws.Close()
+
+			broker.Changes <- &BalanceChange{ID: 10, WalletID: 1, BalanceAfter: 300}
+			var bc BalanceChange
+			assert.NoError(t, websocket.JSON.Receive(ws, &bc))
+			assert.Equal(t, uint(10), bc.ID)
+			assert.Equal(t, int64(300), bc.BalanceAfter)
+		})
+
+		t.Run("from clients without an origin", func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "GET /wallets/1/stream HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", srv.Listener.Addr())
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+			}
+		})
+
+		t.Run("fails: from another origin", func(t *testing.T) {
+			_, err := websocket.Dial(url, "", "https://evil.example.com")
+			assert.Error(t, err)
+		})
+	})
+}
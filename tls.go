@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertReloader serves the certificate, and the client CAs, found in its
+// files, reloading them when the files change.
+type CertReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	interval     time.Duration
+	logger       zerolog.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+// Load reads the files. If they can't be, the ones loaded last are kept.
+func (r *CertReloader) Load() error {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("loading client CAs: no certificates found")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *CertReloader) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// changed tells whether any file was modified since it was loaded.
+func (r *CertReloader) changed() bool {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		// A file being replaced may be briefly missing. It's retried later.
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reloads the files when they change, until `ctx` is done.
+func (r *CertReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Load(); err != nil {
+				r.logger.Error().Err(err).Msg("reloading TLS certificates")
+				continue
+			}
+			r.logger.Info().Msg("reloaded TLS certificates")
+		}
+	}
+}
+
+// TLSConfig returns the server's TLS config, always using the files loaded
+// last. Client certificates are required, and verified, if there are
+// client CAs.
+func (r *CertReloader) TLSConfig(minVersion uint16) *tls.Config {
+	base := &tls.Config{MinVersion: minVersion}
+	return &tls.Config{
+		MinVersion: minVersion,
+		// Handshakes get a config with the current client CAs.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			cfg := base.Clone()
+			cfg.Certificates = []tls.Certificate{*r.cert}
+			if r.clientCAs != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = r.clientCAs
+			}
+			return cfg, nil
+		},
+	}
+}
+
+func NewCertReloader(certFile, keyFile, clientCAFile string, interval time.Duration, logger zerolog.Logger) *CertReloader {
+	return &CertReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		interval:     interval,
+		logger:       logger,
+	}
+}
+
+type clientCertContextKey struct{}
+
+// ContextWithClientCert returns a copy of `ctx` carrying the certificate the
+// client presented.
+func ContextWithClientCert(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, clientCertContextKey{}, cert)
+}
+
+// ClientCertFromContext returns the certificate the client presented, or nil
+// if it didn't.
+func ClientCertFromContext(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(clientCertContextKey{}).(*x509.Certificate)
+	return cert
+}
+
+// ClientCertMiddleware passes the verified client certificate along, for the
+// middlewares after it to authorize requests with its subject.
+func ClientCertMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		state := c.Request().TLS
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return next(c)
+		}
+
+		cert := state.VerifiedChains[0][0]
+		addLogField(c, "client_subject", cert.Subject.String())
+		c.SetRequest(c.Request().WithContext(ContextWithClientCert(c.Request().Context(), cert)))
+		return next(c)
+	}
+}
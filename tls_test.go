@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issueCert issues a certificate for `cn`, signed by `ca`, or self-signed as
+// a CA if it's nil.
+func issueCert(t *testing.T, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"BlueLabs"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.NoError(t, err)
+	return cert
+}
+
+// writeCert writes `c` out, changing the files' modification time so the
+// reloader notices, even within the file system's time resolution.
+func writeCert(t *testing.T, dir string, c *testCert, at time.Time) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, c.certPEM(), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, c.keyPEM(t), 0600))
+	assert.NoError(t, os.Chtimes(certFile, at, at))
+	assert.NoError(t, os.Chtimes(keyFile, at, at))
+}
+
+func TestTLSServer(t *testing.T) {
+	ca := issueCert(t, "internal CA", nil)
+	otherCA := issueCert(t, "other CA", nil)
+	server := issueCert(t, "wallets", ca)
+	client := issueCert(t, "ledger", ca)
+	stranger := issueCert(t, "stranger", otherCA)
+
+	dir := t.TempDir()
+	writeCert(t, dir, server, time.Now().Add(-time.Minute))
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, ca.certPEM(), 0600))
+
+	certs := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), caFile, 10*time.Millisecond, zerolog.Nop())
+	assert.NoError(t, certs.Load())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.Run(ctx)
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(ClientCertMiddleware)
+	e.GET("/whoami", func(c echo.Context) error {
+		return c.String(http.StatusOK, ClientCertFromContext(c.Request().Context()).Subject.CommonName)
+	})
+	hooks := ServerHooks(e, "127.0.0.1:0", certs.TLSConfig(tls.VersionTLS12), NewInFlightRequests(), func(error) {}, zerolog.Nop())
+	assert.NoError(t, hooks.Start())
+	defer hooks.Stop(context.Background())
+	url := "https://" + e.Listener.Addr().String() + "/whoami"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cfg *tls.Config) (*http.Response, error) {
+		cfg.RootCAs = roots
+		c := http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		return c.Get(url)
+	}
+
+	t.Run("passes the client certificate along", func(t *testing.T) {
+		resp, err := get(&tls.Config{Certificates: []tls.Certificate{client.tlsCert(t)}})
+		if assert.NoError(t, err) {
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, "ledger", string(body))
+		}
+	})
+
+	t.Run("fails: no client certificate, or an untrusted one", func(t *testing.T) {
+		for _, cfg := range []*tls.Config{{}, {Certificates: []tls.Certificate{stranger.tlsCert(t)}}} {
+			_, err := get(cfg)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("fails: TLS older than the minimum version", func(t *testing.T) {
+		e := echo.New()
+		e.HideBanner = true
+		hooks := ServerHooks(e, "127.0.0.1:0", certs.TLSConfig(tls.VersionTLS13), NewInFlightRequests(), func(error) {}, zerolog.Nop())
+		assert.NoError(t, hooks.Start())
+		defer hooks.Stop(context.Background())
+
+		conn, err := tls.Dial("tcp", e.Listener.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{client.tlsCert(t)},
+			MaxVersion:   tls.VersionTLS12,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("reloads the certificate when it changes", func(t *testing.T) {
+		renewed := issueCert(t, "wallets renewed", ca)
+		writeCert(t, dir, renewed, time.Now())
+
+		assert.Eventually(t, func() bool {
+			resp, err := get(&tls.Config{Certificates: []tls.Certificate{client.tlsCert(t)}})
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.TLS.PeerCertificates[0].Subject.CommonName == "wallets renewed"
+		}, time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("keeps the certificate loaded last if the new one is broken", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("garbage"), 0600))
+		assert.Error(t, certs.Load())
+
+		resp, err := get(&tls.Config{Certificates: []tls.Certificate{client.tlsCert(t)}})
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, "wallets renewed", resp.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// tokenMethods are the signing algorithms accepted. Symmetric ones, and
+// unsigned tokens, are rejected: the JWKS only holds public keys.
+var tokenMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// ownerScopes are the scopes bearer tokens may grant. The rest are kept for
+// API keys.
+var ownerScopes = []string{ScopeWalletsRead, ScopeBalanceCredit, ScopeBalanceDebit}
+
+type KeySource interface {
+	Key(kid string) (interface{}, bool)
+}
+
+// TokenValidator validates the JWTs player-facing apps authenticate with, and
+// maps them to the owner of the wallets they're for.
+type TokenValidator struct {
+	keys       KeySource
+	issuer     string
+	audience   string
+	ownerClaim string
+}
+
+// Validate checks the token's signature, expiry, and, if set, its issuer and
+// audience. The owner's ID is read from the owner claim, and their scopes
+// from the space-separated `scope` claim.
+func (v *TokenValidator) Validate(token string) (*Owner, error) {
+	parser := jwt.Parser{ValidMethods: tokenMethods}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := v.keys.Key(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, &ErrInvalidToken{Reason: err.Error()}
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, &ErrInvalidToken{Reason: "token doesn't expire"}
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, &ErrInvalidToken{Reason: "unexpected issuer"}
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, &ErrInvalidToken{Reason: "unexpected audience"}
+	}
+
+	ownerID, _ := claims[v.ownerClaim].(string)
+	if ownerID == "" {
+		return nil, &ErrInvalidToken{Reason: fmt.Sprintf("missing %s claim", v.ownerClaim)}
+	}
+
+	owner := Owner{ID: ownerID}
+	scope, _ := claims["scope"].(string)
+	for _, s := range strings.Fields(scope) {
+		for _, allowed := range ownerScopes {
+			if s == allowed {
+				owner.Scopes = append(owner.Scopes, s)
+			}
+		}
+	}
+	return &owner, nil
+}
+
+// NewTokenValidator builds a TokenValidator checking tokens against `keys`.
+// Empty `issuer` or `audience` aren't checked.
+func NewTokenValidator(keys KeySource, issuer, audience, ownerClaim string) *TokenValidator {
+	return &TokenValidator{
+		keys:       keys,
+		issuer:     issuer,
+		audience:   audience,
+		ownerClaim: ownerClaim,
+	}
+}
+
+type ErrInvalidToken struct {
+	Reason string
+}
+
+func (e *ErrInvalidToken) Error() string {
+	return "Invalid token: " + e.Reason
+}
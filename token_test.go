@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticKeys map[string]interface{}
+
+func (k staticKeys) Key(kid string) (interface{}, bool) {
+	key, ok := k[kid]
+	return key, ok
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestTokenValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	keys := staticKeys{"rsa-1": &rsaKey.PublicKey, "ec-1": &ecKey.PublicKey}
+	v := NewTokenValidator(keys, "https://id.example.com", "wallets", "sub")
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   "https://id.example.com",
+			"aud":   "wallets",
+			"sub":   "player-1",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"scope": "wallets:read balance:debit admin",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	t.Run("maps the token to its owner", func(t *testing.T) {
+		for _, token := range []string{
+			signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)),
+			signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(nil)),
+		} {
+			o, err := v.Validate(token)
+			assert.NoError(t, err)
+			// Scopes only API keys can have are dropped.
+			assert.Equal(t, &Owner{ID: "player-1", Scopes: []string{ScopeWalletsRead, ScopeBalanceDebit}}, o)
+		}
+	})
+
+	t.Run("reads the owner from the configured claim", func(t *testing.T) {
+		v := NewTokenValidator(keys, "", "", "player_id")
+		o, err := v.Validate(signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"player_id": "p-42", "aud": "games"})))
+		assert.NoError(t, err)
+		assert.Equal(t, "p-42", o.ID)
+	})
+
+	t.Run("fails", func(t *testing.T) {
+		hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil))
+		hmacToken.Header["kid"] = "rsa-1"
+		hmacSigned, err := hmacToken.SignedString([]byte("secret"))
+		assert.NoError(t, err)
+
+		cases := map[string]string{
+			"garbage":         "not.a.token",
+			"unknown key":     signToken(t, jwt.SigningMethodRS256, "rsa-2", otherKey, claims(nil)),
+			"forged":          signToken(t, jwt.SigningMethodRS256, "rsa-1", otherKey, claims(nil)),
+			"symmetric":       hmacSigned,
+			"expired":         signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})),
+			"never expires":   signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"exp": nil})),
+			"wrong issuer":    signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+			"wrong audience":  signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"aud": "payments"})),
+			"no owner":        signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(jwt.MapClaims{"sub": nil})),
+			"key type switch": signToken(t, jwt.SigningMethodRS256, "ec-1", rsaKey, claims(nil)),
+		}
+		for name, token := range cases {
+			_, err := v.Validate(token)
+			var errToken *ErrInvalidToken
+			assert.True(t, errors.As(err, &errToken), name)
+		}
+	})
+}
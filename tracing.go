@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/lalvarezguillen/bluelabs-wallets-service"
+	serviceName = "wallets-service"
+)
+
+var (
+	walletIDKey        = attribute.Key("wallet.id")
+	dbStatementNameKey = attribute.Key("db.statement.name")
+)
+
+// NewTracerProvider builds the tracer provider exporting spans through
+// `cfg.Exporter`: none, stdout (written to `out`) or otlp. The returned
+// function flushes the spans left and stops the provider.
+func NewTracerProvider(cfg TracingConfig, out io.Writer) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return trace.NewNoopTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String(serviceName))),
+	)
+	return tp, tp.Shutdown, nil
+}
+
+// startSpan starts a span with the tracer provider installed in main.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// startStoreSpan starts the span of a store method running the SQL statement
+// named `stmt`.
+func startStoreSpan(ctx context.Context, name, stmt string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, semconv.DBSystemPostgreSQL, dbStatementNameKey.String(stmt))
+	_, span := startSpan(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return span
+}
+
+// failSpan records `err` on the span, and returns it. Missing rows are how
+// lookups report there's nothing to find, so they don't fail the span.
+func failSpan(span trace.Span, err error) error {
+	if !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func walletIDAttribute(id uint) attribute.KeyValue {
+	return walletIDKey.Int64(int64(id))
+}
+
+// NewTracingMiddleware covers every request with a span, continuing the trace
+// given by its W3C traceparent header, if any.
+func NewTracingMiddleware() echo.MiddlewareFunc {
+	propagator := propagation.TraceContext{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			ctx, span := startSpan(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(serviceName, route, req)...),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				// Let echo write the error response, so its status gets recorded.
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that records every span ended, until
+// the test is over.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func spansByName(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		tp, stop, err := NewTracerProvider(TracingConfig{Exporter: "none"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, trace.NewNoopTracerProvider(), tp)
+		assert.NoError(t, stop(context.Background()))
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		var out bytes.Buffer
+		tp, stop, err := NewTracerProvider(TracingConfig{Exporter: "stdout"}, &out)
+		assert.NoError(t, err)
+
+		_, span := tp.Tracer(tracerName).Start(context.Background(), "WalletService.ChangeBalance")
+		span.End()
+		assert.NoError(t, stop(context.Background()))
+		assert.Contains(t, out.String(), `"Name":"WalletService.ChangeBalance"`)
+	})
+
+	t.Run("fails: unknown exporter", func(t *testing.T) {
+		_, _, err := NewTracerProvider(TracingConfig{Exporter: "zipkin"}, nil)
+		assert.EqualError(t, err, "unknown tracing exporter: zipkin")
+	})
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	e := echo.New()
+	e.Use(NewTracingMiddleware())
+	e.GET("/wallets/:id", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/wallets/7", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+
+	span := spansByName(recorder)["GET /wallets/:id"]
+	assert.NotNil(t, span)
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+	assert.Equal(t, codes.Error, span.Status().Code)
+}
+
+func TestWalletServiceTracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	tx := DummyTx{}
+	store := DummyWalletStoreAllSucceeds{
+		BeginTxCallsResults:             []BeginTxResult{{&tx, nil}},
+		LockAndGetByIdCallsResults:      []LockAndGetByIDResults{{&Wallet{Balance: 500, ID: 1}, nil}},
+		CreateBalanceChangeCallsResults: []CreateBalanceChangeResult{{nil}},
+	}
+	service := NewWalletService(&store, 0, NewWalletMetrics(prometheus.NewRegistry()))
+
+	bc := BalanceChange{Operation: SubstractBalance, Amount: 200}
+	assert.NoError(t, service.ChangeBalance(context.Background(), 1, &bc))
+
+	spans := spansByName(recorder)
+	root := spans["WalletService.ChangeBalance"]
+	assert.NotNil(t, root)
+	assert.Contains(t, root.Attributes(), walletIDAttribute(1))
+
+	for _, name := range []string{"WalletService.changeBalanceTx", "Tx.Commit"} {
+		span := spans[name]
+		assert.NotNil(t, span, name)
+		assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID(), name)
+	}
+	assert.Contains(t, spans["Tx.Commit"].Attributes(), dbStatementNameKey.String("commit"))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type WebhookServiceProvider interface {
+	Create(context.Context, *WebhookSubscription) error
+	GetByID(uint) (*WebhookSubscription, error)
+	List() ([]WebhookSubscription, error)
+	Update(context.Context, *WebhookSubscription) error
+	Delete(context.Context, uint) error
+	ListDeadLetters(uint) ([]WebhookDelivery, error)
+	ReplayDeadLetter(context.Context, uint) (*WebhookDelivery, error)
+}
+
+type WebhookController struct {
+	webhookService WebhookServiceProvider
+}
+
+func (h *WebhookController) CreateSubscription(c echo.Context) error {
+	var req WebhookSubscriptionRequest
+	var ws WebhookSubscription
+	if err := req.Bind(c, &ws); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	if err := h.webhookService.Create(c.Request().Context(), &ws); err != nil {
+		return internalError(c, err)
+	}
+
+	// The secret is only ever revealed when the subscription is created.
+	return c.JSON(http.StatusCreated, ws)
+}
+
+func (h *WebhookController) ListSubscriptions(c echo.Context) error {
+	subs, err := h.webhookService.List()
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return c.JSON(http.StatusOK, subs)
+}
+
+func (h *WebhookController) GetSubscription(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	ws, err := h.webhookService.GetByID(id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	ws.Secret = ""
+	return c.JSON(http.StatusOK, ws)
+}
+
+func (h *WebhookController) UpdateSubscription(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	ws, err := h.webhookService.GetByID(id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	var req WebhookSubscriptionRequest
+	if err := req.Bind(c, ws); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	if err := h.webhookService.Update(c.Request().Context(), ws); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	ws.Secret = ""
+	return c.JSON(http.StatusOK, ws)
+}
+
+func (h *WebhookController) DeleteSubscription(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	if err := h.webhookService.Delete(c.Request().Context(), id); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *WebhookController) ListDeadLetters(c echo.Context) error {
+	var subscriptionID uint
+	if err := echo.QueryParamsBinder(c).Uint("subscription_id", &subscriptionID).BindError(); err != nil {
+		ve := NewValidationErrors()
+		ve.Add("subscription_id", "Should be a positive integer")
+		return c.JSON(http.StatusBadRequest, ve.GetRespError())
+	}
+
+	deliveries, err := h.webhookService.ListDeadLetters(subscriptionID)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func (h *WebhookController) ReplayDeadLetter(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	d, err := h.webhookService.ReplayDeadLetter(c.Request().Context(), id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusAccepted, d)
+}
+
+func (h *WebhookController) Register(r *echo.Group) {
+	r.POST("", h.CreateSubscription, RequireScope(ScopeAdmin))
+	r.GET("", h.ListSubscriptions, RequireScope(ScopeAdmin))
+	r.GET("/dead-letters", h.ListDeadLetters, RequireScope(ScopeAdmin))
+	r.POST("/dead-letters/:id/replay", h.ReplayDeadLetter, RequireScope(ScopeAdmin))
+	r.GET("/:id", h.GetSubscription, RequireScope(ScopeAdmin))
+	r.PUT("/:id", h.UpdateSubscription, RequireScope(ScopeAdmin))
+	r.DELETE("/:id", h.DeleteSubscription, RequireScope(ScopeAdmin))
+}
+
+func NewWebhookController(ws WebhookServiceProvider) *WebhookController {
+	return &WebhookController{
+		webhookService: ws,
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyWebhookService struct{}
+
+func (s *DummyWebhookService) Create(ctx context.Context, ws *WebhookSubscription) error {
+	ws.ID = 1
+	ws.Secret = "whsec_dummy"
+	ws.Active = true
+	return nil
+}
+
+func (s *DummyWebhookService) GetByID(id uint) (*WebhookSubscription, error) {
+	return &WebhookSubscription{ID: id, Secret: "whsec_dummy"}, nil
+}
+
+func (s *DummyWebhookService) List() ([]WebhookSubscription, error) {
+	return []WebhookSubscription{{ID: 1, Secret: "whsec_dummy"}}, nil
+}
+
+func (s *DummyWebhookService) Update(ctx context.Context, ws *WebhookSubscription) error {
+	return nil
+}
+
+func (s *DummyWebhookService) Delete(ctx context.Context, id uint) error {
+	return nil
+}
+
+func (s *DummyWebhookService) ListDeadLetters(subscriptionID uint) ([]WebhookDelivery, error) {
+	return []WebhookDelivery{}, nil
+}
+
+func (s *DummyWebhookService) ReplayDeadLetter(ctx context.Context, id uint) (*WebhookDelivery, error) {
+	return &WebhookDelivery{ID: id, Status: DeliveryPending}, nil
+}
+
+func TestWebhookControllerCreateSubscription(t *testing.T) {
+	t.Run("Succeeds, revealing the secret", func(t *testing.T) {
+		ctrl := NewWebhookController(&DummyWebhookService{})
+
+		body := `{"url":"https://example.com/hooks","event_types":["wallet.created"]}`
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		e := echo.New()
+		resp := httptest.NewRecorder()
+		ctx := e.NewContext(req, resp)
+
+		assert.NoError(t, ctrl.CreateSubscription(ctx))
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var ws WebhookSubscription
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &ws))
+		assert.Equal(t, "https://example.com/hooks", ws.URL)
+		assert.Equal(t, "whsec_dummy", ws.Secret)
+	})
+
+	t.Run("HTTP 400 if URL or event types are invalid", func(t *testing.T) {
+		for _, body := range []string{
+			`{"url":"http://example.com/hooks","event_types":["wallet.created"]}`,
+			`{"url":"https://example.com/hooks","event_types":[]}`,
+			`{"url":"https://example.com/hooks","event_types":["wallet.deleted"]}`,
+		} {
+			t.Run(body, func(t *testing.T) {
+				ctrl := NewWebhookController(&DummyWebhookService{})
+
+				req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(body))
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+				e := echo.New()
+				resp := httptest.NewRecorder()
+				ctx := e.NewContext(req, resp)
+
+				assert.NoError(t, ctrl.CreateSubscription(ctx))
+				assert.Equal(t, http.StatusBadRequest, resp.Code)
+			})
+		}
+	})
+}
+
+func TestWebhookControllerListSubscriptions(t *testing.T) {
+	ctrl := NewWebhookController(&DummyWebhookService{})
+
+	req := httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	e := echo.New()
+	resp := httptest.NewRecorder()
+	ctx := e.NewContext(req, resp)
+
+	assert.NoError(t, ctrl.ListSubscriptions(ctx))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NotContains(t, resp.Body.String(), "whsec_dummy")
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+const (
+	HeaderWebhookID        = "X-Webhook-Id"
+	HeaderWebhookEvent     = "X-Webhook-Event"
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+type WebhookStorer interface {
+	BeginTx(context.Context) (TxExecutor, error)
+	Create(*WebhookSubscription, TxExecutor) error
+	GetByID(uint) (*WebhookSubscription, error)
+	LockAndGetByID(uint, TxExecutor) (*WebhookSubscription, error)
+	List() ([]WebhookSubscription, error)
+	Update(*WebhookSubscription, TxExecutor) error
+	Delete(uint, TxExecutor) error
+	ListDeadDeliveries(uint) ([]WebhookDelivery, error)
+	LockAndGetDeadDeliveryByID(uint, TxExecutor) (*WebhookDelivery, error)
+	ReplayDeadDelivery(uint, TxExecutor) (*WebhookDelivery, error)
+	CreateAuditEvent(context.Context, *AuditEvent, TxExecutor) error
+}
+
+type WebhookService struct {
+	store WebhookStorer
+}
+
+func (s *WebhookService) Create(ctx context.Context, ws *WebhookSubscription) error {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	ws.Secret = secret
+	ws.Active = true
+
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.Create(ws, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditWebhookCreated, nil, ws); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *WebhookService) GetByID(id uint) (*WebhookSubscription, error) {
+	ws, err := s.store.GetByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+	return ws, nil
+}
+
+func (s *WebhookService) List() ([]WebhookSubscription, error) {
+	return s.store.List()
+}
+
+func (s *WebhookService) Update(ctx context.Context, ws *WebhookSubscription) error {
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	before, err := s.store.LockAndGetByID(ws.ID, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ErrNotFound{Inner: err}
+		}
+		return err
+	}
+
+	if err := s.store.Update(ws, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditWebhookUpdated, before, ws); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *WebhookService) Delete(ctx context.Context, id uint) error {
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	before, err := s.store.LockAndGetByID(id, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ErrNotFound{Inner: err}
+		}
+		return err
+	}
+
+	if err := s.store.Delete(id, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := s.audit(ctx, tx, AuditWebhookDeleted, before, nil); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *WebhookService) ListDeadLetters(subscriptionID uint) ([]WebhookDelivery, error) {
+	return s.store.ListDeadDeliveries(subscriptionID)
+}
+
+func (s *WebhookService) ReplayDeadLetter(ctx context.Context, id uint) (*WebhookDelivery, error) {
+	tx, err := s.store.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := s.store.LockAndGetDeadDeliveryByID(id, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+
+	d, err := s.store.ReplayDeadDelivery(id, tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+
+	ev, err := NewAuditEvent(ctx, AuditDeliveryReplayed, "webhook_delivery", d.ID, before, d, "")
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+	if err := s.store.CreateAuditEvent(ctx, ev, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// audit records the change of the subscription from `before` to `after`
+// within `tx`. Its secret is left out.
+func (s *WebhookService) audit(ctx context.Context, tx TxExecutor, action string, before, after *WebhookSubscription) error {
+	var b, a interface{}
+	var id uint
+	if before != nil {
+		redacted := *before
+		redacted.Secret = ""
+		b, id = &redacted, before.ID
+	}
+	if after != nil {
+		redacted := *after
+		redacted.Secret = ""
+		a, id = &redacted, after.ID
+	}
+
+	ev, err := NewAuditEvent(ctx, action, "webhook", id, b, a, "")
+	if err != nil {
+		return err
+	}
+	return s.store.CreateAuditEvent(ctx, ev, tx)
+}
+
+func NewWebhookService(store WebhookStorer) *WebhookService {
+	return &WebhookService{
+		store: store,
+	}
+}
+
+type WebhookEnqueuer interface {
+	EnqueueDeliveries(uint, string, []byte) error
+}
+
+// WebhookFanout is a Publisher that queues a delivery of every event for each
+// of the webhook subscriptions interested in it.
+type WebhookFanout struct {
+	store WebhookEnqueuer
+}
+
+func (f *WebhookFanout) Publish(ctx context.Context, ev *OutboxEvent) error {
+	return f.store.EnqueueDeliveries(ev.ID, ev.EventType, ev.Payload)
+}
+
+func NewWebhookFanout(store WebhookEnqueuer) *WebhookFanout {
+	return &WebhookFanout{
+		store: store,
+	}
+}
+
+type WebhookDeliveryStorer interface {
+	ClaimDueDeliveries(int, time.Duration) ([]PendingWebhookDelivery, error)
+	UpdateDelivery(*WebhookDelivery) error
+	ReleaseDeliveries([]uint) error
+}
+
+type PendingWebhookDelivery struct {
+	WebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// WebhookDispatcher sends the queued webhook deliveries. Failed deliveries are
+// retried with exponential backoff, and marked as dead once they run out of
+// attempts.
+type WebhookDispatcher struct {
+	store       WebhookDeliveryStorer
+	client      *http.Client
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	interval    time.Duration
+	batchSize   int
+	logger      zerolog.Logger
+}
+
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := d.DispatchBatch(ctx)
+		if err != nil {
+			d.logger.Error().Err(err).Msg("dispatching webhooks")
+		}
+
+		if err == nil && n == d.batchSize && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchBatch attempts the due deliveries, returning how many were attempted.
+// Once `ctx` is cancelled it stops, and releases the deliveries it hasn't sent
+// without counting an attempt, so shutting down never dead-letters them.
+func (d *WebhookDispatcher) DispatchBatch(ctx context.Context) (int, error) {
+	// Leave enough room for every delivery of the batch to time out.
+	lease := d.client.Timeout*time.Duration(d.batchSize) + time.Minute
+	deliveries, err := d.store.ClaimDueDeliveries(d.batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range deliveries {
+		pd := &deliveries[i]
+		if ctx.Err() != nil {
+			return i, d.release(deliveries[i:])
+		}
+
+		err := d.send(ctx, pd)
+		if err != nil && ctx.Err() != nil {
+			return i, d.release(deliveries[i:])
+		}
+
+		pd.Attempts++
+		if err != nil {
+			errMsg := err.Error()
+			pd.LastError = &errMsg
+			if pd.Attempts >= d.maxAttempts {
+				pd.Status = DeliveryDead
+			} else {
+				pd.NextAttemptAt = time.Now().Add(d.backoff(pd.Attempts))
+			}
+		} else {
+			now := time.Now()
+			pd.Status = DeliveryDelivered
+			pd.DeliveredAt = &now
+			pd.LastError = nil
+		}
+
+		if err := d.store.UpdateDelivery(&pd.WebhookDelivery); err != nil {
+			return i, err
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+// release makes the claimed deliveries due again, leaving their attempts as
+// they were.
+func (d *WebhookDispatcher) release(deliveries []PendingWebhookDelivery) error {
+	ids := make([]uint, len(deliveries))
+	for i, pd := range deliveries {
+		ids[i] = pd.ID
+	}
+	return d.store.ReleaseDeliveries(ids)
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, pd *PendingWebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pd.URL, bytes.NewReader(pd.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set(echo.HeaderContentType, CloudEventsContentType)
+	req.Header.Set(HeaderWebhookID, strconv.FormatUint(uint64(pd.ID), 10))
+	req.Header.Set(HeaderWebhookEvent, pd.EventType)
+	req.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderWebhookSignature, SignWebhookPayload(pd.Secret, timestamp, pd.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &ErrUnexpectedStatus{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// backoff doubles the wait after every failed attempt, up to maxBackoff.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.baseBackoff
+	for i := 1; i < attempts && wait < d.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.maxBackoff {
+		wait = d.maxBackoff
+	}
+	return wait
+}
+
+func NewWebhookDispatcher(store WebhookDeliveryStorer, maxAttempts int, logger zerolog.Logger) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: maxAttempts,
+		baseBackoff: 30 * time.Second,
+		maxBackoff:  6 * time.Hour,
+		interval:    time.Second,
+		batchSize:   20,
+		logger:      logger,
+	}
+}
+
+// SignWebhookPayload computes the value of the X-Webhook-Signature header:
+// the hex-encoded HMAC-SHA256, keyed with the subscription's secret, of the
+// timestamp and the body joined by a dot.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyWebhookStore struct {
+	Tx           DummyTx
+	Subscription *WebhookSubscription
+	DeleteCalls  []uint
+	AuditEvents  []*AuditEvent
+}
+
+func (s *DummyWebhookStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	return &s.Tx, nil
+}
+
+func (s *DummyWebhookStore) Create(ws *WebhookSubscription, tx TxExecutor) error {
+	ws.ID = 1
+	return nil
+}
+
+func (s *DummyWebhookStore) GetByID(id uint) (*WebhookSubscription, error) {
+	if s.Subscription == nil {
+		return nil, sql.ErrNoRows
+	}
+	return s.Subscription, nil
+}
+
+func (s *DummyWebhookStore) LockAndGetByID(id uint, tx TxExecutor) (*WebhookSubscription, error) {
+	return s.GetByID(id)
+}
+
+func (s *DummyWebhookStore) List() ([]WebhookSubscription, error) {
+	return nil, nil
+}
+
+func (s *DummyWebhookStore) Update(ws *WebhookSubscription, tx TxExecutor) error {
+	return nil
+}
+
+func (s *DummyWebhookStore) Delete(id uint, tx TxExecutor) error {
+	s.DeleteCalls = append(s.DeleteCalls, id)
+	return nil
+}
+
+func (s *DummyWebhookStore) ListDeadDeliveries(subscriptionID uint) ([]WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (s *DummyWebhookStore) LockAndGetDeadDeliveryByID(id uint, tx TxExecutor) (*WebhookDelivery, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (s *DummyWebhookStore) ReplayDeadDelivery(id uint, tx TxExecutor) (*WebhookDelivery, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (s *DummyWebhookStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	s.AuditEvents = append(s.AuditEvents, ev)
+	return nil
+}
+
+func TestWebhookServiceCreate(t *testing.T) {
+	store := DummyWebhookStore{}
+	service := NewWebhookService(&store)
+
+	ws := WebhookSubscription{URL: "https://example.com/hooks", EventTypes: []string{"wallet.created"}}
+	assert.NoError(t, service.Create(context.Background(), &ws))
+	assert.NotEmpty(t, ws.Secret)
+	assert.Equal(t, len(store.Tx.CommitCalls), 1)
+
+	if assert.Len(t, store.AuditEvents, 1) {
+		ev := store.AuditEvents[0]
+		assert.Equal(t, AuditWebhookCreated, ev.Action)
+		assert.Equal(t, uint(1), ev.EntityID)
+		assert.NotContains(t, string(ev.Diff), ws.Secret)
+	}
+}
+
+func TestWebhookServiceDelete(t *testing.T) {
+	t.Run("deletes and audits the subscription", func(t *testing.T) {
+		store := DummyWebhookStore{Subscription: &WebhookSubscription{ID: 3, URL: "https://example.com/hooks", Secret: "s3cr3t"}}
+		service := NewWebhookService(&store)
+
+		assert.NoError(t, service.Delete(context.Background(), 3))
+		assert.Equal(t, []uint{3}, store.DeleteCalls)
+		assert.Equal(t, len(store.Tx.CommitCalls), 1)
+
+		if assert.Len(t, store.AuditEvents, 1) {
+			ev := store.AuditEvents[0]
+			assert.Equal(t, AuditWebhookDeleted, ev.Action)
+			assert.NotContains(t, string(ev.Diff), "s3cr3t")
+		}
+	})
+
+	t.Run("unknown subscription", func(t *testing.T) {
+		store := DummyWebhookStore{}
+		service := NewWebhookService(&store)
+
+		err := service.Delete(context.Background(), 3)
+		var err404 *ErrNotFound
+		assert.True(t, errors.As(err, &err404))
+		assert.Empty(t, store.DeleteCalls)
+		assert.Equal(t, len(store.Tx.RollbackCalls), 1)
+	})
+}
+
+type DummyWebhookDeliveryStore struct {
+	Deliveries             []PendingWebhookDelivery
+	UpdateDeliveryCalls    []WebhookDelivery
+	ReleaseDeliveriesCalls [][]uint
+}
+
+func (s *DummyWebhookDeliveryStore) ClaimDueDeliveries(limit int, lease time.Duration) ([]PendingWebhookDelivery, error) {
+	return s.Deliveries, nil
+}
+
+func (s *DummyWebhookDeliveryStore) UpdateDelivery(d *WebhookDelivery) error {
+	s.UpdateDeliveryCalls = append(s.UpdateDeliveryCalls, *d)
+	return nil
+}
+
+func (s *DummyWebhookDeliveryStore) ReleaseDeliveries(ids []uint) error {
+	s.ReleaseDeliveriesCalls = append(s.ReleaseDeliveriesCalls, ids)
+	return nil
+}
+
+func TestWebhookDispatcherDispatchBatch(t *testing.T) {
+	t.Run("delivers signed payloads", func(t *testing.T) {
+		var headers http.Header
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+		defer srv.Close()
+
+		store := DummyWebhookDeliveryStore{
+			Deliveries: []PendingWebhookDelivery{{
+				WebhookDelivery: WebhookDelivery{ID: 3, EventType: EventBalanceChanged, Payload: []byte(`{"id":1}`)},
+				URL:             srv.URL,
+				Secret:          "s3cr3t",
+			}},
+		}
+		dispatcher := NewWebhookDispatcher(&store, 3, zerolog.Nop())
+
+		n, err := dispatcher.DispatchBatch(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		assert.Equal(t, `{"id":1}`, string(body))
+		assert.Equal(t, "3", headers.Get(HeaderWebhookID))
+		assert.Equal(t, EventBalanceChanged, headers.Get(HeaderWebhookEvent))
+
+		timestamp := headers.Get(HeaderWebhookTimestamp)
+		mac := hmac.New(sha256.New, []byte("s3cr3t"))
+		fmt.Fprintf(mac, "%s.%s", timestamp, body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers.Get(HeaderWebhookSignature))
+
+		assert.Equal(t, 1, len(store.UpdateDeliveryCalls))
+		assert.Equal(t, DeliveryDelivered, store.UpdateDeliveryCalls[0].Status)
+		assert.Equal(t, 1, store.UpdateDeliveryCalls[0].Attempts)
+		assert.NotNil(t, store.UpdateDeliveryCalls[0].DeliveredAt)
+	})
+
+	t.Run("schedules a retry, then gives up", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		for attempts, status := range map[int]string{0: DeliveryPending, 2: DeliveryDead} {
+			t.Run(strconv.Itoa(attempts), func(t *testing.T) {
+				store := DummyWebhookDeliveryStore{
+					Deliveries: []PendingWebhookDelivery{{
+						WebhookDelivery: WebhookDelivery{ID: 3, Status: DeliveryPending, Attempts: attempts},
+						URL:             srv.URL,
+					}},
+				}
+				dispatcher := NewWebhookDispatcher(&store, 3, zerolog.Nop())
+
+				before := time.Now()
+				_, err := dispatcher.DispatchBatch(context.Background())
+				assert.NoError(t, err)
+
+				d := store.UpdateDeliveryCalls[0]
+				assert.Equal(t, status, d.Status)
+				assert.Equal(t, attempts+1, d.Attempts)
+				assert.NotNil(t, d.LastError)
+				if status == DeliveryPending {
+					assert.True(t, d.NextAttemptAt.After(before))
+				}
+			})
+		}
+	})
+
+	t.Run("releases the deliveries it didn't send once cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cancel()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer srv.Close()
+
+		store := DummyWebhookDeliveryStore{
+			Deliveries: []PendingWebhookDelivery{
+				{WebhookDelivery: WebhookDelivery{ID: 3, Status: DeliveryPending, Attempts: 2}, URL: srv.URL},
+				{WebhookDelivery: WebhookDelivery{ID: 4, Status: DeliveryPending, Attempts: 2}, URL: srv.URL},
+			},
+		}
+		dispatcher := NewWebhookDispatcher(&store, 3, zerolog.Nop())
+
+		n, err := dispatcher.DispatchBatch(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Empty(t, store.UpdateDeliveryCalls)
+		assert.Equal(t, [][]uint{{3, 4}}, store.ReleaseDeliveriesCalls)
+	})
+}
+
+func TestWebhookDispatcherBackoff(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(nil, 10, zerolog.Nop())
+	dispatcher.baseBackoff = time.Second
+	dispatcher.maxBackoff = 5 * time.Second
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1))
+	assert.Equal(t, 2*time.Second, dispatcher.backoff(2))
+	assert.Equal(t, 4*time.Second, dispatcher.backoff(3))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(4))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(40))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type WebhookStore struct {
+	db DbExecutor
+}
+
+func (s *WebhookStore) BeginTx(ctx context.Context) (TxExecutor, error) {
+	span := startStoreSpan(ctx, "WebhookStore.BeginTx", "begin")
+	defer span.End()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, failSpan(span, err)
+	}
+	return tx, nil
+}
+
+func (s *WebhookStore) Create(ws *WebhookSubscription, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`INSERT INTO webhook_subscriptions
+		(url, event_types, secret, active)
+		VALUES (:url,:event_types,:secret,:active)
+		RETURNING id, created_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(ws, ws); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *WebhookStore) GetByID(id uint) (*WebhookSubscription, error) {
+	var ws WebhookSubscription
+	stm := `SELECT * FROM webhook_subscriptions WHERE id=$1`
+	if err := s.db.Get(&ws, stm, id); err != nil {
+		return nil, err
+	}
+
+	return &ws, nil
+}
+
+func (s *WebhookStore) LockAndGetByID(id uint, tx TxExecutor) (*WebhookSubscription, error) {
+	var ws WebhookSubscription
+	fetchSubscription := `SELECT * FROM webhook_subscriptions WHERE id=$1 FOR UPDATE`
+	if err := tx.Get(&ws, fetchSubscription, id); err != nil {
+		return nil, err
+	}
+
+	return &ws, nil
+}
+
+func (s *WebhookStore) List() ([]WebhookSubscription, error) {
+	subs := []WebhookSubscription{}
+	stm := `SELECT * FROM webhook_subscriptions ORDER BY id`
+	if err := s.db.Select(&subs, stm); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+func (s *WebhookStore) Update(ws *WebhookSubscription, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`UPDATE webhook_subscriptions
+		SET url=:url, event_types=:event_types, active=:active
+		WHERE id=:id
+		RETURNING *`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(ws, ws); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *WebhookStore) Delete(id uint, tx TxExecutor) error {
+	_, err := tx.Exec(`DELETE FROM webhook_subscriptions WHERE id=$1`, id)
+	return err
+}
+
+// EnqueueDeliveries creates a delivery of the event for every active
+// subscription to its type. Enqueueing the same event twice is a no-op.
+func (s *WebhookStore) EnqueueDeliveries(eventID uint, eventType string, payload []byte) error {
+	insertDeliveries := `INSERT INTO webhook_deliveries
+		(subscription_id, event_id, event_type, payload)
+		SELECT id, $1, $2, $3
+		FROM webhook_subscriptions
+		WHERE active AND $2 = ANY(event_types)
+		ON CONFLICT (subscription_id, event_id) DO NOTHING`
+	_, err := s.db.Exec(insertDeliveries, eventID, eventType, payload)
+	return err
+}
+
+// ClaimDueDeliveries returns the pending deliveries that are due, pushing
+// their next attempt `lease` into the future so no one else picks them up
+// while they're being sent.
+func (s *WebhookStore) ClaimDueDeliveries(limit int, lease time.Duration) ([]PendingWebhookDelivery, error) {
+	var deliveries []PendingWebhookDelivery
+	claimDeliveries := `UPDATE webhook_deliveries d
+		SET next_attempt_at = current_timestamp + $2 * interval '1 second'
+		FROM webhook_subscriptions s
+		WHERE s.id = d.subscription_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= current_timestamp
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.*, s.url, s.secret`
+	if err := s.db.Select(&deliveries, claimDeliveries, limit, lease.Seconds()); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *WebhookStore) UpdateDelivery(d *WebhookDelivery) error {
+	stmt, err := s.db.PrepareNamed(`UPDATE webhook_deliveries
+		SET status=:status, attempts=:attempts, next_attempt_at=:next_attempt_at,
+			last_error=:last_error, delivered_at=:delivered_at
+		WHERE id=:id
+		RETURNING id`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(d, d); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseDeliveries gives up the claim on pending deliveries, making them due
+// right away.
+func (s *WebhookStore) ReleaseDeliveries(ids []uint) error {
+	pgIDs := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		pgIDs[i] = int64(id)
+	}
+
+	releaseDeliveries := `UPDATE webhook_deliveries
+		SET next_attempt_at = current_timestamp
+		WHERE id = ANY($1) AND status = 'pending'`
+	_, err := s.db.Exec(releaseDeliveries, pgIDs)
+	return err
+}
+
+func (s *WebhookStore) ListDeadDeliveries(subscriptionID uint) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	stm := `SELECT * FROM webhook_deliveries
+		WHERE status = 'dead' AND ($1 = 0 OR subscription_id = $1)
+		ORDER BY id`
+	if err := s.db.Select(&deliveries, stm, subscriptionID); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *WebhookStore) LockAndGetDeadDeliveryByID(id uint, tx TxExecutor) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	fetchDelivery := `SELECT * FROM webhook_deliveries WHERE id=$1 AND status = 'dead' FOR UPDATE`
+	if err := tx.Get(&d, fetchDelivery, id); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ReplayDeadDelivery puts a dead delivery back in the queue, with a fresh
+// attempts budget.
+func (s *WebhookStore) ReplayDeadDelivery(id uint, tx TxExecutor) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	replay := `UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = current_timestamp
+		WHERE id = $1 AND status = 'dead'
+		RETURNING *`
+	if err := tx.Get(&d, replay, id); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (s *WebhookStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WebhookStore.CreateAuditEvent", "insert_audit_event")
+	defer span.End()
+
+	if err := insertAuditEvent(tx, ev); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func NewWebhookStore(db DbExecutor) *WebhookStore {
+	return &WebhookStore{
+		db: db,
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type WithdrawalServiceProvider interface {
+	Create(context.Context, *Withdrawal) error
+	GetByID(uint) (*Withdrawal, error)
+}
+
+type WithdrawalController struct {
+	withdrawalService WithdrawalServiceProvider
+}
+
+// CreateWithdrawal processes the withdrawal up to its first payout attempt
+// before responding. Withdrawals that settled by then are 201 Created, the
+// rest are 202 Accepted, and carry on in the background.
+func (h *WithdrawalController) CreateWithdrawal(c echo.Context) error {
+	var req CreateWithdrawalRequest
+	var wd Withdrawal
+	if err := req.Bind(c, &wd); err != nil {
+		var valErrs *ValidationErrors
+		if errors.As(err, &valErrs) {
+			return c.JSON(http.StatusBadRequest, valErrs.GetRespError())
+		}
+		return c.JSON(http.StatusBadRequest, err)
+	}
+
+	addLogField(c, "wallet_id", wd.WalletID)
+
+	if err := h.withdrawalService.Create(c.Request().Context(), &wd); err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		var errKeyReused *ErrIdempotencyKeyReused
+		if errors.As(err, &errKeyReused) {
+			return echo.NewHTTPError(http.StatusConflict, errKeyReused.Error())
+		}
+		var errChanged *ErrWithdrawalChanged
+		if errors.As(err, &errChanged) {
+			return echo.NewHTTPError(http.StatusConflict, errChanged.Error())
+		}
+		return internalError(c, err)
+	}
+
+	switch wd.State {
+	case WithdrawalCompleted, WithdrawalRefunded, WithdrawalRejected:
+		return c.JSON(http.StatusCreated, wd)
+	default:
+		return c.JSON(http.StatusAccepted, wd)
+	}
+}
+
+func (h *WithdrawalController) GetWithdrawal(c echo.Context) error {
+	var id uint
+	echo.PathParamsBinder(c).Uint("id", &id)
+
+	wd, err := h.withdrawalService.GetByID(id)
+	if err != nil {
+		var err404 *ErrNotFound
+		if errors.As(err, &err404) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, wd)
+}
+
+func (h *WithdrawalController) Register(r *echo.Group) {
+	r.POST("", h.CreateWithdrawal, RequireScope(ScopeBalanceDebit))
+	r.GET("/:id", h.GetWithdrawal, RequireScope(ScopeWalletsRead))
+}
+
+func NewWithdrawalController(ws WithdrawalServiceProvider) *WithdrawalController {
+	return &WithdrawalController{
+		withdrawalService: ws,
+	}
+}
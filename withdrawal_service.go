@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+type WithdrawalStorer interface {
+	Create(*Withdrawal, TxExecutor) error
+	GetByID(uint) (*Withdrawal, error)
+	GetByIdempotencyKey(string) (*Withdrawal, error)
+	LockAndGetByID(uint, TxExecutor) (*Withdrawal, error)
+	// Update stores the changes to the withdrawal, as long as it's still in
+	// the `from` state. Otherwise it returns sql.ErrNoRows.
+	Update(wd *Withdrawal, from string, tx TxExecutor) error
+	ClaimDue(limit int, lease time.Duration) ([]Withdrawal, error)
+	CreateAuditEvent(context.Context, *AuditEvent, TxExecutor) error
+}
+
+type WithdrawalWallets interface {
+	BeginTx(context.Context) (TxExecutor, error)
+	GetByID(context.Context, uint) (*Wallet, error)
+	ChangeBalanceTx(context.Context, TxExecutor, uint, *BalanceChange) error
+}
+
+// withdrawalLease is how long a withdrawal being processed is left alone by
+// the WithdrawalResumer, e.g. while its payout is in flight.
+const withdrawalLease = 5 * time.Minute
+
+// WithdrawalService moves funds out of wallets through a PayoutProvider. Every
+// step is persisted before moving on to the next, so a withdrawal can be
+// picked up where it was left by calling Resume.
+type WithdrawalService struct {
+	store        WithdrawalStorer
+	wallets      WithdrawalWallets
+	provider     PayoutProvider
+	maxAttempts  int
+	retryBackoff time.Duration
+}
+
+// Create stores a new withdrawal, and processes it up to its first payout
+// attempt. Creating a withdrawal with an idempotency key that is already taken
+// returns the existing one instead, as long as it's for the same wallet,
+// amount and destination.
+func (s *WithdrawalService) Create(ctx context.Context, wd *Withdrawal) error {
+	if _, err := s.wallets.GetByID(ctx, wd.WalletID); err != nil {
+		return err
+	}
+
+	if wd.IdempotencyKey == "" {
+		key, err := newUUID()
+		if err != nil {
+			return err
+		}
+		wd.IdempotencyKey = key
+	}
+	wd.State = WithdrawalPending
+	// Keep the WithdrawalResumer off of it while it's processed below.
+	wd.NextAttemptAt = time.Now().Add(withdrawalLease)
+
+	if err := s.create(ctx, wd); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			existing, err := s.store.GetByIdempotencyKey(wd.IdempotencyKey)
+			if err != nil {
+				return err
+			}
+			if existing.WalletID != wd.WalletID || existing.Amount != wd.Amount || existing.Destination != wd.Destination {
+				return &ErrIdempotencyKeyReused{Key: wd.IdempotencyKey}
+			}
+			*wd = *existing
+			return nil
+		}
+		return err
+	}
+
+	return s.Process(ctx, wd)
+}
+
+// create stores the new withdrawal, auditing its creation.
+func (s *WithdrawalService) create(ctx context.Context, wd *Withdrawal) error {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.Create(wd, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	ev, err := NewAuditEvent(ctx, AuditWithdrawalCreated, "withdrawal", wd.ID, nil, wd, "")
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	if err := s.store.CreateAuditEvent(ctx, ev, tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *WithdrawalService) GetByID(id uint) (*Withdrawal, error) {
+	wd, err := s.store.GetByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+	return wd, nil
+}
+
+// Process drives the withdrawal through its states until it reaches a final
+// one (completed, refunded or rejected), waits on the provider to report the
+// payout's outcome (submitted or unresolved), or has to wait to retry the
+// payout. The WithdrawalResumer
+// carries on from there.
+func (s *WithdrawalService) Process(ctx context.Context, wd *Withdrawal) error {
+	for {
+		var err error
+		switch wd.State {
+		case WithdrawalPending:
+			err = s.debit(ctx, wd)
+		case WithdrawalDebited, WithdrawalSubmitted:
+			err = s.submit(ctx, wd)
+			if err == nil && wd.State == WithdrawalSubmitted {
+				return nil
+			}
+		case WithdrawalFailed:
+			err = s.refund(ctx, wd)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Resume carries on processing a withdrawal claimed by the WithdrawalResumer,
+// retrying its payout if the last attempt failed for a transient cause.
+func (s *WithdrawalService) Resume(ctx context.Context, wd *Withdrawal) error {
+	if wd.State == WithdrawalFailedTransient {
+		if err := s.submit(ctx, wd); err != nil || wd.State == WithdrawalSubmitted {
+			return err
+		}
+	}
+	return s.Process(ctx, wd)
+}
+
+// ResumeDue claims up to `limit` withdrawals that are due, and resumes them,
+// returning how many were claimed. Failing to resume one of them doesn't stop
+// the rest, it's retried once its claim runs out.
+func (s *WithdrawalService) ResumeDue(ctx context.Context, limit int, logger zerolog.Logger) (int, error) {
+	wds, err := s.store.ClaimDue(limit, withdrawalLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range wds {
+		if err := s.Resume(ctx, &wds[i]); err != nil {
+			logger.Error().Err(err).Uint("withdrawal_id", wds[i].ID).Msg("resuming withdrawal")
+		}
+	}
+	return len(wds), nil
+}
+
+func (s *WithdrawalService) debit(ctx context.Context, wd *Withdrawal) error {
+	before := *wd
+	bc := BalanceChange{
+		Operation: SubstractBalance,
+		Amount:    wd.Amount,
+		Reference: fmt.Sprintf("withdrawal:%d", wd.ID),
+	}
+	err := s.transition(ctx, wd, &before, func(tx TxExecutor) error {
+		if err := s.wallets.ChangeBalanceTx(ctx, tx, wd.WalletID, &bc); err != nil {
+			return err
+		}
+		wd.State = WithdrawalDebited
+		wd.DebitChangeID = &bc.ID
+		return nil
+	})
+	var errInsBal *ErrInsufficientBalance
+	if !errors.As(err, &errInsBal) {
+		return err
+	}
+
+	wd.State = WithdrawalRejected
+	errMsg := err.Error()
+	wd.LastError = &errMsg
+	return s.transition(ctx, wd, &before, nil)
+}
+
+func (s *WithdrawalService) submit(ctx context.Context, wd *Withdrawal) error {
+	// Marking it as submitted first leaves a trace of payouts that might
+	// have gone through, even if we go down before hearing back. Should that
+	// happen, the WithdrawalResumer submits it again once the lease runs out.
+	before := *wd
+	wd.State = WithdrawalSubmitted
+	wd.Attempts++
+	wd.NextAttemptAt = time.Now().Add(withdrawalLease)
+	if err := s.transition(ctx, wd, &before, nil); err != nil {
+		return s.reload(wd, err)
+	}
+	before = *wd
+
+	res, err := s.provider.Payout(ctx, &PayoutRequest{
+		IdempotencyKey: wd.IdempotencyKey,
+		WithdrawalID:   wd.ID,
+		Amount:         wd.Amount,
+		Destination:    wd.Destination,
+	})
+	if err != nil {
+		errMsg := err.Error()
+		wd.LastError = &errMsg
+
+		// Only a permanent failure tells us the payout didn't go through.
+		// Refunding after transient ones could pay the customer twice.
+		var errPermanent *ErrPayoutPermanent
+		switch {
+		case errors.As(err, &errPermanent):
+			wd.State = WithdrawalFailed
+		case wd.Attempts >= s.maxAttempts:
+			wd.State = WithdrawalUnresolved
+		default:
+			wd.State = WithdrawalFailedTransient
+			wd.NextAttemptAt = time.Now().Add(s.retryBackoff * time.Duration(wd.Attempts))
+		}
+		return s.reload(wd, s.transition(ctx, wd, &before, nil))
+	}
+
+	wd.ProviderReference = &res.ProviderReference
+	wd.LastError = nil
+	if !res.Pending {
+		wd.State = WithdrawalCompleted
+	}
+	return s.reload(wd, s.transition(ctx, wd, &before, nil))
+}
+
+// reload reads the withdrawal again if `err` says someone else moved it on,
+// e.g. the provider reported the payout's outcome while we were waiting on its
+// response, so processing carries on from where they left it.
+func (s *WithdrawalService) reload(wd *Withdrawal, err error) error {
+	var errChanged *ErrWithdrawalChanged
+	if !errors.As(err, &errChanged) {
+		return err
+	}
+
+	current, err := s.store.GetByID(wd.ID)
+	if err != nil {
+		return err
+	}
+	*wd = *current
+	return nil
+}
+
+// ApplyPayoutOutcome settles a submitted or unresolved withdrawal with the
+// outcome reported by the provider: completed, or failed, in which case it's refunded. Applying
+// an outcome the withdrawal already reflects is a no-op.
+func (s *WithdrawalService) ApplyPayoutOutcome(ctx context.Context, id uint, outcome string) (*Withdrawal, error) {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wd, err := s.ApplyPayoutOutcomeTx(ctx, tx, id, outcome)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, rbErr
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return wd, nil
+}
+
+// ApplyPayoutOutcomeTx is ApplyPayoutOutcome within `tx`, which keeps the
+// withdrawal locked until it's committed.
+func (s *WithdrawalService) ApplyPayoutOutcomeTx(ctx context.Context, tx TxExecutor, id uint, outcome string) (*Withdrawal, error) {
+	wd, err := s.store.LockAndGetByID(id, tx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &ErrNotFound{Inner: err}
+		}
+		return nil, err
+	}
+
+	switch {
+	case outcome == WithdrawalCompleted && wd.State == WithdrawalCompleted,
+		outcome == WithdrawalFailed && (wd.State == WithdrawalFailed || wd.State == WithdrawalRefunded):
+		return wd, nil
+	case outcome != WithdrawalCompleted && outcome != WithdrawalFailed,
+		wd.State != WithdrawalSubmitted && wd.State != WithdrawalFailedTransient && wd.State != WithdrawalUnresolved:
+		return nil, &ErrInvalidTransition{From: wd.State, To: outcome}
+	}
+
+	before := *wd
+	wd.State = outcome
+	if err := s.transitionTx(ctx, tx, wd, &before, nil); err != nil {
+		return nil, err
+	}
+
+	if wd.State == WithdrawalFailed {
+		before = *wd
+		err := s.transitionTx(ctx, tx, wd, &before, func(tx TxExecutor) error {
+			return s.refundTx(ctx, tx, wd)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wd, nil
+}
+
+func (s *WithdrawalService) refund(ctx context.Context, wd *Withdrawal) error {
+	before := *wd
+	return s.transition(ctx, wd, &before, func(tx TxExecutor) error {
+		return s.refundTx(ctx, tx, wd)
+	})
+}
+
+func (s *WithdrawalService) refundTx(ctx context.Context, tx TxExecutor, wd *Withdrawal) error {
+	bc := BalanceChange{
+		Operation: AddBalance,
+		Amount:    wd.Amount,
+		Reference: fmt.Sprintf("withdrawal-refund:%d", wd.ID),
+	}
+	if err := s.wallets.ChangeBalanceTx(ctx, tx, wd.WalletID, &bc); err != nil {
+		return err
+	}
+	wd.State = WithdrawalRefunded
+	wd.RefundChangeID = &bc.ID
+	return nil
+}
+
+// transition stores the changes made to the withdrawal since `before`, along
+// with whatever `apply` does to the wallet, in one transaction, auditing them
+// if its state changed. It fails with ErrWithdrawalChanged if someone else
+// moved the withdrawal on meanwhile. On failure the withdrawal is left as it
+// was in `before`.
+func (s *WithdrawalService) transition(ctx context.Context, wd, before *Withdrawal, apply func(TxExecutor) error) error {
+	tx, err := s.wallets.BeginTx(ctx)
+	if err != nil {
+		*wd = *before
+		return err
+	}
+
+	if err := s.transitionTx(ctx, tx, wd, before, apply); err != nil {
+		*wd = *before
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		*wd = *before
+		return err
+	}
+	return nil
+}
+
+func (s *WithdrawalService) transitionTx(ctx context.Context, tx TxExecutor, wd, before *Withdrawal, apply func(TxExecutor) error) error {
+	if apply != nil {
+		if err := apply(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := s.store.Update(wd, before.State, tx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ErrWithdrawalChanged{ID: wd.ID, From: before.State}
+		}
+		return err
+	}
+
+	if wd.State == before.State {
+		return nil
+	}
+	ev, err := NewAuditEvent(ctx, AuditWithdrawalStateChanged, "withdrawal", wd.ID, before, wd, "")
+	if err != nil {
+		return err
+	}
+	return s.store.CreateAuditEvent(ctx, ev, tx)
+}
+
+func NewWithdrawalService(store WithdrawalStorer, wallets WithdrawalWallets, provider PayoutProvider, maxAttempts int) *WithdrawalService {
+	return &WithdrawalService{
+		store:        store,
+		wallets:      wallets,
+		provider:     provider,
+		maxAttempts:  maxAttempts,
+		retryBackoff: time.Second,
+	}
+}
+
+// WithdrawalResumer picks up the withdrawals that were left half-way, e.g. by
+// a restart, and retries the payouts that failed for a transient cause once
+// their backoff is over.
+type WithdrawalResumer struct {
+	service   *WithdrawalService
+	interval  time.Duration
+	batchSize int
+	logger    zerolog.Logger
+}
+
+func (r *WithdrawalResumer) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := r.service.ResumeDue(ctx, r.batchSize, r.logger)
+		if err != nil {
+			r.logger.Error().Err(err).Msg("resuming withdrawals")
+		}
+
+		if err == nil && n == r.batchSize && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func NewWithdrawalResumer(service *WithdrawalService, interval time.Duration, batchSize int, logger zerolog.Logger) *WithdrawalResumer {
+	return &WithdrawalResumer{
+		service:   service,
+		interval:  interval,
+		batchSize: batchSize,
+		logger:    logger,
+	}
+}
+
+// ErrIdempotencyKeyReused means a withdrawal was created with the idempotency
+// key of an existing one, but for a different wallet, amount or destination.
+type ErrIdempotencyKeyReused struct {
+	Key string
+}
+
+func (e *ErrIdempotencyKeyReused) Error() string {
+	return fmt.Sprintf("Idempotency key %s was already used for a different withdrawal", e.Key)
+}
+
+// ErrWithdrawalChanged means the withdrawal moved on from the state it was
+// being processed in, e.g. because a payout outcome was applied meanwhile.
+type ErrWithdrawalChanged struct {
+	ID   uint
+	From string
+}
+
+func (e *ErrWithdrawalChanged) Error() string {
+	return fmt.Sprintf("Withdrawal %d is no longer %s", e.ID, e.From)
+}
+
+// uniqueViolation is the Postgres error code for unique constraint violations.
+const uniqueViolation = "23505"
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type DummyWithdrawalStore struct {
+	Withdrawal  *Withdrawal
+	Existing    *Withdrawal
+	Due         []Withdrawal
+	UpdateCalls []Withdrawal
+	UpdateFrom  []string
+	UpdateError error
+	// ChangedFrom makes updates from that state fail, as if someone else
+	// moved the withdrawal on.
+	ChangedFrom string
+	AuditEvents []*AuditEvent
+}
+
+func (s *DummyWithdrawalStore) Create(wd *Withdrawal, tx TxExecutor) error {
+	if s.Existing != nil {
+		return &pq.Error{Code: uniqueViolation}
+	}
+	wd.ID = 1
+	return nil
+}
+
+func (s *DummyWithdrawalStore) GetByID(id uint) (*Withdrawal, error) {
+	return s.Withdrawal, nil
+}
+
+func (s *DummyWithdrawalStore) GetByIdempotencyKey(key string) (*Withdrawal, error) {
+	return s.Existing, nil
+}
+
+func (s *DummyWithdrawalStore) LockAndGetByID(id uint, tx TxExecutor) (*Withdrawal, error) {
+	return s.Withdrawal, nil
+}
+
+func (s *DummyWithdrawalStore) Update(wd *Withdrawal, from string, tx TxExecutor) error {
+	if s.UpdateError != nil {
+		return s.UpdateError
+	}
+	if from == s.ChangedFrom {
+		return sql.ErrNoRows
+	}
+	s.UpdateCalls = append(s.UpdateCalls, *wd)
+	s.UpdateFrom = append(s.UpdateFrom, from)
+	return nil
+}
+
+func (s *DummyWithdrawalStore) ClaimDue(limit int, lease time.Duration) ([]Withdrawal, error) {
+	return s.Due, nil
+}
+
+func (s *DummyWithdrawalStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	s.AuditEvents = append(s.AuditEvents, ev)
+	return nil
+}
+
+func (s *DummyWithdrawalStore) States() []string {
+	var states []string
+	for _, wd := range s.UpdateCalls {
+		states = append(states, wd.State)
+	}
+	return states
+}
+
+type DummyWithdrawalWallets struct {
+	Tx                        DummyTx
+	ChangeBalanceCalls        []BalanceChange
+	ChangeBalanceCallsResults []error
+}
+
+func (w *DummyWithdrawalWallets) BeginTx(ctx context.Context) (TxExecutor, error) {
+	return &w.Tx, nil
+}
+
+func (w *DummyWithdrawalWallets) GetByID(ctx context.Context, id uint) (*Wallet, error) {
+	return &Wallet{ID: id}, nil
+}
+
+func (w *DummyWithdrawalWallets) ChangeBalanceTx(ctx context.Context, tx TxExecutor, wID uint, bc *BalanceChange) error {
+	bc.ID = uint(len(w.ChangeBalanceCalls) + 1)
+	w.ChangeBalanceCalls = append(w.ChangeBalanceCalls, *bc)
+	err := w.ChangeBalanceCallsResults[0]
+	w.ChangeBalanceCallsResults = w.ChangeBalanceCallsResults[1:]
+	return err
+}
+
+func TestWithdrawalServiceCreate(t *testing.T) {
+	t.Run("completes", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalCompleted, wd.State)
+		assert.Equal(t, []string{WithdrawalDebited, WithdrawalSubmitted, WithdrawalCompleted}, store.States())
+		assert.Len(t, store.AuditEvents, 4)
+		for i, ev := range store.AuditEvents {
+			action := AuditWithdrawalStateChanged
+			if i == 0 {
+				action = AuditWithdrawalCreated
+			}
+			assert.Equal(t, action, ev.Action)
+			assert.Equal(t, ActorSystem, ev.ActorType)
+		}
+		assert.Equal(t, SubstractBalance, wallets.ChangeBalanceCalls[0].Operation)
+		assert.Equal(t, "withdrawal:1", wallets.ChangeBalanceCalls[0].Reference)
+		assert.Equal(t, uint(1), *wd.DebitChangeID)
+		assert.NotEmpty(t, wd.IdempotencyKey)
+		assert.Equal(t, wd.IdempotencyKey, provider.Calls[0].IdempotencyKey)
+		assert.NotNil(t, wd.ProviderReference)
+		assert.Equal(t, []string{WithdrawalPending, WithdrawalDebited, WithdrawalSubmitted}, store.UpdateFrom)
+		// Creating it, then every transition, commits a transaction.
+		assert.Len(t, wallets.Tx.CommitCalls, 4)
+	})
+
+	t.Run("is rejected if the wallet has insufficient balance", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{&ErrInsufficientBalance{}}}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalRejected, wd.State)
+		assert.Nil(t, wd.DebitChangeID)
+		assert.Empty(t, provider.Calls)
+	})
+
+	t.Run("schedules transient failures to be retried", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider(errors.New("timeout"))
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalFailedTransient, wd.State)
+		assert.Equal(t, 1, wd.Attempts)
+		assert.WithinDuration(t, time.Now().Add(time.Second), wd.NextAttemptAt, time.Second)
+		assert.Equal(t, 1, len(provider.Calls))
+	})
+
+	t.Run("returns the existing withdrawal for a reused idempotency key", func(t *testing.T) {
+		existing := Withdrawal{ID: 5, WalletID: 1, Amount: 100, Destination: "user@example.com", State: WithdrawalCompleted, IdempotencyKey: "key"}
+		store := DummyWithdrawalStore{Existing: &existing}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &DummyWithdrawalWallets{}, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com", IdempotencyKey: "key"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+		assert.Equal(t, existing, wd)
+		assert.Empty(t, provider.Calls)
+	})
+
+	t.Run("fails: ErrIdempotencyKeyReused", func(t *testing.T) {
+		existing := Withdrawal{ID: 5, WalletID: 1, Amount: 100, Destination: "user@example.com", IdempotencyKey: "key"}
+		for _, wd := range []Withdrawal{
+			{WalletID: 2, Amount: 100, Destination: "user@example.com", IdempotencyKey: "key"},
+			{WalletID: 1, Amount: 200, Destination: "user@example.com", IdempotencyKey: "key"},
+			{WalletID: 1, Amount: 100, Destination: "other@example.com", IdempotencyKey: "key"},
+		} {
+			store := DummyWithdrawalStore{Existing: &existing}
+			service := NewWithdrawalService(&store, &DummyWithdrawalWallets{}, NewFakePayoutProvider(), 3)
+
+			err := service.Create(context.Background(), &wd)
+			var errKeyReused *ErrIdempotencyKeyReused
+			assert.True(t, errors.As(err, &errKeyReused))
+		}
+	})
+
+	t.Run("rolls the debit back if the withdrawal moved on", func(t *testing.T) {
+		store := DummyWithdrawalStore{UpdateError: sql.ErrNoRows}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		err := service.Create(context.Background(), &wd)
+		var errChanged *ErrWithdrawalChanged
+		assert.True(t, errors.As(err, &errChanged))
+
+		assert.Equal(t, WithdrawalPending, wd.State)
+		assert.Nil(t, wd.DebitChangeID)
+		assert.Len(t, wallets.Tx.RollbackCalls, 1)
+		assert.Len(t, wallets.Tx.CommitCalls, 1)
+		assert.Empty(t, provider.Calls)
+	})
+
+	t.Run("returns the withdrawal settled while its payout was in flight", func(t *testing.T) {
+		settled := Withdrawal{ID: 1, WalletID: 1, Amount: 100, Destination: "user@example.com", State: WithdrawalCompleted}
+		store := DummyWithdrawalStore{Withdrawal: &settled, ChangedFrom: WithdrawalSubmitted}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+
+		assert.Equal(t, settled, wd)
+		assert.Equal(t, []string{WithdrawalDebited, WithdrawalSubmitted}, store.States())
+		assert.Len(t, wallets.Tx.RollbackCalls, 1)
+	})
+
+	t.Run("refunds permanent failures without retrying", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil, nil}}
+		provider := NewFakePayoutProvider(&ErrPayoutPermanent{Inner: errors.New("receiver unregistered")})
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalRefunded, wd.State)
+		assert.Equal(t, 1, len(provider.Calls))
+		assert.Equal(t, []string{WithdrawalDebited, WithdrawalSubmitted, WithdrawalFailed, WithdrawalRefunded}, store.States())
+	})
+}
+
+func TestWithdrawalServiceApplyPayoutOutcome(t *testing.T) {
+	t.Run("async payouts wait for the outcome", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider()
+		provider.Async = true
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+		assert.Equal(t, WithdrawalSubmitted, wd.State)
+
+		store.Withdrawal = &wd
+		res, err := service.ApplyPayoutOutcome(context.Background(), 1, WithdrawalCompleted)
+		assert.NoError(t, err)
+		assert.Equal(t, WithdrawalCompleted, res.State)
+		assert.Equal(t, 1, len(provider.Calls))
+	})
+
+	t.Run("refunds failed payouts", func(t *testing.T) {
+		store := DummyWithdrawalStore{
+			Withdrawal: &Withdrawal{ID: 1, WalletID: 1, Amount: 100, State: WithdrawalSubmitted},
+		}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		service := NewWithdrawalService(&store, &wallets, NewFakePayoutProvider(), 3)
+
+		res, err := service.ApplyPayoutOutcome(context.Background(), 1, WithdrawalFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, WithdrawalRefunded, res.State)
+		assert.Equal(t, AddBalance, wallets.ChangeBalanceCalls[0].Operation)
+		assert.Equal(t, []string{WithdrawalSubmitted, WithdrawalFailed}, store.UpdateFrom)
+		assert.Len(t, wallets.Tx.CommitCalls, 1)
+
+		res, err = service.ApplyPayoutOutcome(context.Background(), 1, WithdrawalFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, WithdrawalRefunded, res.State)
+		assert.Equal(t, 1, len(wallets.ChangeBalanceCalls))
+	})
+
+	t.Run("fails: ErrInvalidTransition", func(t *testing.T) {
+		store := DummyWithdrawalStore{
+			Withdrawal: &Withdrawal{ID: 1, WalletID: 1, Amount: 100, State: WithdrawalRefunded},
+		}
+		service := NewWithdrawalService(&store, &DummyWithdrawalWallets{}, NewFakePayoutProvider(), 3)
+
+		_, err := service.ApplyPayoutOutcome(context.Background(), 1, WithdrawalCompleted)
+		var errTransition *ErrInvalidTransition
+		assert.True(t, errors.As(err, &errTransition))
+	})
+}
+
+func TestWithdrawalServiceResume(t *testing.T) {
+	t.Run("retries transient failures with the same idempotency key", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider(errors.New("timeout"))
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+		assert.NoError(t, service.Resume(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalCompleted, wd.State)
+		assert.Equal(t, 2, wd.Attempts)
+		assert.Equal(t, []string{
+			WithdrawalDebited,
+			WithdrawalSubmitted, WithdrawalFailedTransient,
+			WithdrawalSubmitted, WithdrawalCompleted,
+		}, store.States())
+		assert.Equal(t, provider.Calls[0].IdempotencyKey, provider.Calls[1].IdempotencyKey)
+	})
+
+	t.Run("leaves it unresolved once transient failures exhaust the attempts", func(t *testing.T) {
+		store := DummyWithdrawalStore{}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil, nil}}
+		provider := NewFakePayoutProvider(errors.New("timeout"), errors.New("timeout"))
+		service := NewWithdrawalService(&store, &wallets, provider, 2)
+
+		wd := Withdrawal{WalletID: 1, Amount: 100, Destination: "user@example.com"}
+		assert.NoError(t, service.Create(context.Background(), &wd))
+		assert.NoError(t, service.Resume(context.Background(), &wd))
+
+		assert.Equal(t, WithdrawalUnresolved, wd.State)
+		assert.Equal(t, 2, len(provider.Calls))
+		assert.Len(t, wallets.ChangeBalanceCalls, 1)
+		assert.Nil(t, wd.RefundChangeID)
+
+		// It's only refunded once the provider reports the payout failed.
+		store.Withdrawal = &wd
+		res, err := service.ApplyPayoutOutcome(context.Background(), 1, WithdrawalFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, WithdrawalRefunded, res.State)
+		assert.Equal(t, AddBalance, wallets.ChangeBalanceCalls[1].Operation)
+		assert.Equal(t, uint64(100), wallets.ChangeBalanceCalls[1].Amount)
+		assert.Equal(t, "withdrawal-refund:1", wallets.ChangeBalanceCalls[1].Reference)
+		assert.Equal(t, uint(2), *wd.RefundChangeID)
+	})
+
+	t.Run("resumes the withdrawals that are due", func(t *testing.T) {
+		store := DummyWithdrawalStore{Due: []Withdrawal{
+			{ID: 1, WalletID: 1, Amount: 100, State: WithdrawalPending},
+			{ID: 2, WalletID: 1, Amount: 100, State: WithdrawalDebited, Attempts: 1},
+		}}
+		wallets := DummyWithdrawalWallets{ChangeBalanceCallsResults: []error{nil}}
+		provider := NewFakePayoutProvider()
+		service := NewWithdrawalService(&store, &wallets, provider, 3)
+
+		n, err := service.ResumeDue(context.Background(), 20, zerolog.Nop())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, []string{
+			WithdrawalDebited, WithdrawalSubmitted, WithdrawalCompleted,
+			WithdrawalSubmitted, WithdrawalCompleted,
+		}, store.States())
+		assert.Equal(t, 2, len(provider.Calls))
+	})
+}
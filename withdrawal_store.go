@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type WithdrawalStore struct {
+	db DbExecutor
+}
+
+func (s *WithdrawalStore) Create(wd *Withdrawal, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`INSERT INTO withdrawals
+		(wallet_id, amount, destination, state, idempotency_key, next_attempt_at)
+		VALUES (:wallet_id,:amount,:destination,:state,:idempotency_key,:next_attempt_at)
+		RETURNING id, created_at, updated_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := stmt.Get(wd, wd); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *WithdrawalStore) GetByID(id uint) (*Withdrawal, error) {
+	var wd Withdrawal
+	stm := `SELECT * FROM withdrawals WHERE id=$1`
+	if err := s.db.Get(&wd, stm, id); err != nil {
+		return nil, err
+	}
+
+	return &wd, nil
+}
+
+func (s *WithdrawalStore) GetByIdempotencyKey(key string) (*Withdrawal, error) {
+	var wd Withdrawal
+	stm := `SELECT * FROM withdrawals WHERE idempotency_key=$1`
+	if err := s.db.Get(&wd, stm, key); err != nil {
+		return nil, err
+	}
+
+	return &wd, nil
+}
+
+func (s *WithdrawalStore) LockAndGetByID(id uint, tx TxExecutor) (*Withdrawal, error) {
+	var wd Withdrawal
+	fetchWithdrawal := `SELECT * FROM withdrawals WHERE id=$1 FOR UPDATE`
+	if err := tx.Get(&wd, fetchWithdrawal, id); err != nil {
+		return nil, err
+	}
+
+	return &wd, nil
+}
+
+// Update stores the changes to the withdrawal, as long as it's still in the
+// `from` state. Otherwise it returns sql.ErrNoRows.
+func (s *WithdrawalStore) Update(wd *Withdrawal, from string, tx TxExecutor) error {
+	stmt, err := tx.PrepareNamed(`UPDATE withdrawals
+		SET state=:state, attempts=:attempts, debit_change_id=:debit_change_id,
+			refund_change_id=:refund_change_id, provider_reference=:provider_reference,
+			last_error=:last_error, next_attempt_at=:next_attempt_at, updated_at=current_timestamp
+		WHERE id=:id AND state=:from
+		RETURNING updated_at`,
+	)
+	if err != nil {
+		return err
+	}
+
+	args := struct {
+		*Withdrawal
+		From string `db:"from"`
+	}{wd, from}
+	if err := stmt.Get(wd, args); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimDue returns the unsettled withdrawals that are due, pushing their next
+// attempt `lease` into the future so no one else picks them up while they're
+// being processed.
+func (s *WithdrawalStore) ClaimDue(limit int, lease time.Duration) ([]Withdrawal, error) {
+	var wds []Withdrawal
+	claimWithdrawals := `UPDATE withdrawals
+		SET next_attempt_at = current_timestamp + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM withdrawals
+			WHERE state IN ('pending', 'debited', 'submitted', 'failed_transient', 'failed')
+				AND next_attempt_at <= current_timestamp
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`
+	if err := s.db.Select(&wds, claimWithdrawals, limit, lease.Seconds()); err != nil {
+		return nil, err
+	}
+
+	return wds, nil
+}
+
+func (s *WithdrawalStore) CreateAuditEvent(ctx context.Context, ev *AuditEvent, tx TxExecutor) error {
+	span := startStoreSpan(ctx, "WithdrawalStore.CreateAuditEvent", "insert_audit_event")
+	defer span.End()
+
+	if err := insertAuditEvent(tx, ev); err != nil {
+		return failSpan(span, err)
+	}
+	return nil
+}
+
+func NewWithdrawalStore(db DbExecutor) *WithdrawalStore {
+	return &WithdrawalStore{
+		db: db,
+	}
+}